@@ -0,0 +1,615 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/db"
+	"github.com/sash2721/Relay/handlers"
+	"github.com/sash2721/Relay/middlewares"
+	"github.com/sash2721/Relay/proxy"
+	"github.com/sash2721/Relay/repositories"
+	"github.com/sash2721/Relay/server"
+	"github.com/sash2721/Relay/services"
+)
+
+// App is the whole backend, New wires every dependency and Run serves it
+// until its context ends
+type App struct {
+	cfg             *configs.ServerConfig
+	lifecycle       *server.Lifecycle
+	readiness       *services.ReadinessService
+	inFlightTracker *middlewares.InFlightTracker
+	webhookService  *services.WebhookService
+	relay           *proxy.RelayHandler
+	defaultRelay    *proxy.RelayHandler
+	routes          *server.RouteTable
+	healthPoller    *proxy.HealthPoller
+	// the settings a SIGHUP reload changes while serving
+	rateLimiter    *middlewares.ClientRateLimiter
+	requestTimeout *middlewares.ReloadableTimeout
+	apiServer      *http.Server
+	proxyServer    *http.Server
+	// serves the operational routes with ADMIN_PORT, nil without
+	adminServer *http.Server
+
+	// when New started, the uptime of /stats counts from here
+	startedAt time.Time
+
+	// components send what they can't recover from here, Run shuts down on it
+	fatal chan error
+
+	// closed once Run has bound both listeners, addr and proxyAddr are set by then
+	listening chan struct{}
+	addr      string
+	proxyAddr string
+	adminAddr string
+
+	// PreShutdown, when set, runs first thing on a shutdown signal, before
+	// /readyz flips and the servers drain, to deregister from service
+	// discovery such as Consul or etcd. It gets PRE_SHUTDOWN_TIMEOUT of its
+	// own, and an error is logged without holding up the shutdown
+	PreShutdown server.ShutdownHook
+}
+
+// New validates cfg and connects everything the servers need without
+// listening yet, whatever it started before an error is closed again
+func New(cfg *configs.ServerConfig) (_ *App, err error) {
+	startedAt := time.Now()
+	configs.InitProviders()
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid server configuration: %w", err)
+	}
+
+	// every component registers how it stops right after it starts, shutdown
+	// runs them in reverse
+	lifecycle := server.NewLifecycle()
+	defer func() {
+		if err != nil {
+			lifecycle.Shutdown(cfg.ShutdownTimeout)
+		}
+	}()
+
+	shutdownTracing, err := configs.InitTracing(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise tracing: %w", err)
+	}
+	lifecycle.OnShutdown("tracing", shutdownTracing)
+
+	inFlightTracker := middlewares.NewInFlightTracker()
+	readinessService := services.NewReadinessService()
+
+	// creating db connection and running the migrations
+	err = db.Connect(cfg.DbConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("DB connection not established: %w", err)
+	}
+	lifecycle.OnShutdown("database", func(ctx context.Context) error {
+		db.Close()
+		return nil
+	})
+
+	readinessService.Register("database", services.ReadinessCheckerFunc(func(ctx context.Context) error {
+		return db.Pool.Ping(ctx)
+	}))
+
+	readinessService.AddWarmup("database", func(ctx context.Context) error {
+		return db.Pool.Ping(ctx)
+	})
+
+	err = db.RunMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the migrations: %w", err)
+	}
+
+	// initialising the log streamer
+	logStreamer := services.NewLogStreamer()
+
+	// creating repositories
+	authRepository := repositories.NewAuthRepository(db.Pool)
+	projectRepository := repositories.NewProjectRepository(db.Pool)
+	deploymentRepository := repositories.NewDeploymentRepository(db.Pool)
+
+	var webhookQueue services.WebhookQueue = services.NewMemoryWebhookQueue(cfg.WebhookVisibilityTimeout)
+	if cfg.QueueBackend == "redis" {
+		redisQueue, err := services.NewRedisWebhookQueue(context.Background(), cfg.RedisURL, cfg.WebhookVisibilityTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("webhook queue not available: %w", err)
+		}
+		lifecycle.OnShutdown("webhook queue", func(ctx context.Context) error {
+			return redisQueue.Close()
+		})
+		readinessService.Register("queue", services.ReadinessCheckerFunc(redisQueue.Ping))
+		webhookQueue = redisQueue
+	}
+
+	// creating services
+	authService := services.NewAuthService(authRepository)
+	projectService := services.NewProjectService(projectRepository)
+	builderService := services.NewBuilderService(logStreamer)
+	deploymentService := services.NewDeploymentService(deploymentRepository, projectRepository, builderService, logStreamer)
+	webhookService := services.NewWebhookService(
+		webhookQueue,
+		cfg.WebhookMaxAttempts,
+		cfg.WebhookRetryBackoff,
+		cfg.WebhookTimeout,
+	)
+
+	// creating handlers and injecting services into them
+	deps := server.Dependencies{
+		AuthHandler:       &handlers.AuthHandler{Service: authService},
+		ProjectHandler:    &handlers.ProjectHandler{Service: projectService},
+		LogStreamHandler:  &handlers.LogStreamHandler{LogStreamer: logStreamer},
+		DeploymentHandler: &handlers.DeploymentHandler{Service: deploymentService},
+		WebhookHandler:    &handlers.WebhookHandler{Service: webhookService},
+		HealthHandler:     &handlers.HealthHandler{Readiness: readinessService},
+		AdminHandler:      &handlers.AdminHandler{Readiness: readinessService},
+		StatsHandler:      &handlers.StatsHandler{},
+		InFlightTracker:   inFlightTracker,
+		RateLimiter:       middlewares.NewClientRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst),
+		RequestTimeout:    middlewares.NewReloadableTimeout(cfg.RequestTimeout),
+	}
+
+	if cfg.RateLimitBackend == "redis" {
+		store, err := middlewares.NewRedisRateLimitStore(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit store: %w", err)
+		}
+		lifecycle.OnShutdown("rate limit store", func(ctx context.Context) error {
+			return store.Close()
+		})
+		deps.RateLimiter.UseStore(store)
+	}
+
+	// polls the upstreams in the background so the balancers skip dead ones
+	var healthPoller *proxy.HealthPoller
+	if cfg.HealthCheckInterval > 0 {
+		healthPoller = proxy.NewHealthPoller(cfg.HealthCheckInterval, cfg.HealthCheckPath, cfg.UpstreamCheckTimeout, proxy.ConfiguredTransport(cfg))
+		healthPoller.UseThresholds(cfg.HealthCheckRemoveAfter, cfg.HealthCheckHealthyThreshold)
+	}
+
+	// relay, everything under RelayAPI is balanced across the upstreams
+	var relay *proxy.RelayHandler
+	if upstreams := cfg.RelayUpstreams(); len(upstreams) > 0 {
+		relay, err = proxy.NewRouteRelay(cfg, proxy.Route{Upstreams: upstreams}, healthPoller)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay upstream: %w", err)
+		}
+		deps.Relay = relay
+
+		// a pool with some upstreams down still serves, only a fully unreachable one fails
+		balancer := relay.Balancer()
+		readinessService.Register("upstreams", services.ReadinessCheckerFunc(func(ctx context.Context) error {
+			unreachable := balancer.Unreachable(ctx)
+			switch {
+			case len(unreachable) == 0:
+				return nil
+			case len(unreachable) == len(balancer.Upstreams()):
+				return fmt.Errorf("no upstream reachable: %v", unreachable)
+			default:
+				return services.Degraded(fmt.Errorf("unreachable upstreams: %v", unreachable))
+			}
+		}))
+		slog.Info("Relay enabled",
+			slog.String("Path", cfg.RelayAPI),
+			slog.Any("Upstreams", upstreams),
+		)
+	}
+
+	// catch-all, every request no route matches goes to DEFAULT_UPSTREAM
+	var defaultRelay *proxy.RelayHandler
+	if cfg.DefaultUpstream != "" {
+		defaultRelay, err = proxy.NewRouteRelay(cfg, proxy.Route{Upstreams: []string{cfg.DefaultUpstream}}, healthPoller)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default upstream: %w", err)
+		}
+		deps.DefaultRelay = defaultRelay
+		slog.Info("Forwarding unmatched requests", slog.String("Upstream", cfg.DefaultUpstream))
+	}
+
+	trustedProxies, err := configs.ParseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	middlewares.SetTrustedProxies(trustedProxies)
+
+	deps.IPFilter, err = middlewares.NewIPFilter(cfg.AllowCIDRs, cfg.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP filter: %w", err)
+	}
+
+	if cfg.RelayCacheMaxBytes > 0 {
+		deps.ResponseCache = middlewares.NewResponseCache(cfg.RelayCacheMaxBytes)
+	}
+
+	// the webhook API rejects malformed bodies before they reach the queue
+	deps.JSONValidator = middlewares.NewJSONValidator()
+	if cfg.WebhookJSONSchema != "" {
+		raw, err := os.ReadFile(cfg.WebhookJSONSchema)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the webhook JSON schema: %w", err)
+		}
+		schema, err := middlewares.ParseJSONSchema(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook JSON schema %s: %w", cfg.WebhookJSONSchema, err)
+		}
+		deps.JSONValidator.Register(cfg.WebhookAPI, schema)
+	}
+
+	if cfg.AccessRulesFile != "" {
+		deps.AccessRules, err = middlewares.LoadAccessRules(cfg.AccessRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Access rules loaded", slog.String("File", cfg.AccessRulesFile))
+	}
+
+	if cfg.IdempotencyTTL > 0 {
+		deps.Idempotency = middlewares.NewIdempotency(middlewares.NewMemoryIdempotencyStore(), cfg.IdempotencyTTL)
+	}
+
+	// routes from ROUTES_FILE, each prefix with its own upstream pool
+	if cfg.RoutesFile != "" {
+		deps.Routes = server.NewRouteTable(cfg, deps.IPFilter, deps.ResponseCache, deps.Idempotency, healthPoller)
+		err = deps.Routes.Load()
+		if err != nil {
+			return nil, fmt.Errorf("invalid route table: %w", err)
+		}
+	}
+
+	// probe the upstreams once, strict mode refuses to start without all of them
+	if cfg.UpstreamCheckOnStart != "off" {
+		upstreams := cfg.RelayUpstreams()
+		if deps.Routes != nil {
+			for _, route := range deps.Routes.Routes() {
+				upstreams = append(upstreams, route.Upstreams...)
+			}
+		}
+
+		err = proxy.CheckUpstreams(context.Background(), upstreams, cfg.UpstreamCheckTimeout, proxy.ConfiguredTransport(cfg))
+		if err != nil && cfg.UpstreamCheckOnStart == "strict" {
+			return nil, fmt.Errorf("upstream check failed: %w", err)
+		}
+	}
+
+	// /readyz keeps answering 503 until the warmup is done
+	if cfg.StartupDelay > 0 {
+		readinessService.AddWarmup("startup delay", func(ctx context.Context) error {
+			select {
+			case <-time.After(cfg.StartupDelay):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+
+	router := server.BuildRouter(cfg, deps)
+
+	a := &App{
+		cfg:             cfg,
+		lifecycle:       lifecycle,
+		readiness:       readinessService,
+		inFlightTracker: inFlightTracker,
+		webhookService:  webhookService,
+		relay:           relay,
+		defaultRelay:    defaultRelay,
+		routes:          deps.Routes,
+		healthPoller:    healthPoller,
+		rateLimiter:     deps.RateLimiter,
+		requestTimeout:  deps.RequestTimeout,
+		apiServer:       server.NewServer(cfg, router),
+		proxyServer: &http.Server{
+			Addr:              cfg.ProxyPort,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+			Handler:           middlewares.SecurityHeadersMiddleware(cfg.SecurityHeaders(), cfg.SecurityHeadersDefer)(proxy.NewProxyHandler(deploymentRepository)),
+		},
+		startedAt: startedAt,
+		fatal:     make(chan error, 1),
+		listening: make(chan struct{}),
+	}
+	// the router is built before the App it reports on
+	deps.StatsHandler.Snapshot = a.stats
+	deps.AdminHandler.Breakers = a.breakers
+	deps.AdminHandler.ResetBreaker = a.resetBreaker
+
+	if cfg.AdminPort != "" {
+		a.adminServer = &http.Server{
+			Addr:              cfg.AdminAddr(),
+			Handler:           server.BuildAdminRouter(cfg, deps),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		}
+	}
+	return a, nil
+}
+
+// Fatal is where a component reports an error it can't recover from, with
+// services.ReportFatal, Run then shuts the app down gracefully and returns it
+func (a *App) Fatal() chan<- error {
+	return a.fatal
+}
+
+// Addr is the address the backend server listens on, the port resolved when
+// PORT=0 asked for any free one, or "" until Run has bound it
+func (a *App) Addr() string {
+	select {
+	case <-a.listening:
+		return a.addr
+	default:
+		return ""
+	}
+}
+
+// ProxyAddr is Addr for the deployed sites proxy
+func (a *App) ProxyAddr() string {
+	select {
+	case <-a.listening:
+		return a.proxyAddr
+	default:
+		return ""
+	}
+}
+
+// AdminAddr is Addr for the ADMIN_PORT server, "" without one
+func (a *App) AdminAddr() string {
+	select {
+	case <-a.listening:
+		return a.adminAddr
+	default:
+		return ""
+	}
+}
+
+// Listening is closed once Addr, ProxyAddr and AdminAddr report the bound addresses
+func (a *App) Listening() <-chan struct{} {
+	return a.listening
+}
+
+// Run binds the listeners, warms up and serves until ctx is done or a serve
+// goroutine fails, then drains and closes everything New started. The error
+// joins the serve failures with the shutdown ones, an error before the
+// service became ready still shuts down what was running
+func (a *App) Run(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// a serve goroutine that fails or panics stops the app, Run reports it
+	// along with the shutdown errors so the process exits non-zero
+	var failuresMu sync.Mutex
+	var failures []error
+	fail := func(err error) {
+		failuresMu.Lock()
+		failures = append(failures, err)
+		failuresMu.Unlock()
+		stop()
+	}
+
+	apiListener, err := server.Listen(a.cfg, a.apiServer)
+	if err != nil {
+		a.lifecycle.Shutdown(a.cfg.ShutdownTimeout)
+		return fmt.Errorf("failed to start the server: %w", err)
+	}
+
+	proxyListener, err := server.ListenTCP(a.cfg, a.proxyServer)
+	if err != nil {
+		apiListener.Close()
+		a.lifecycle.Shutdown(a.cfg.ShutdownTimeout)
+		return fmt.Errorf("failed to start the proxy server: %w", err)
+	}
+
+	// a plain listener, the probes and the scrapers talk to it directly and
+	// never through the PROXY_PROTOCOL load balancer
+	var adminListener net.Listener
+	if a.adminServer != nil {
+		adminListener, err = net.Listen("tcp", a.adminServer.Addr)
+		if err != nil {
+			apiListener.Close()
+			proxyListener.Close()
+			a.lifecycle.Shutdown(a.cfg.ShutdownTimeout)
+			return fmt.Errorf("failed to start the admin server: %w", err)
+		}
+		a.adminAddr = adminListener.Addr().String()
+	}
+	a.addr = apiListener.Addr().String()
+	a.proxyAddr = proxyListener.Addr().String()
+	close(a.listening)
+
+	// start cleanup job
+	services.StartCleanupJob()
+
+	if a.healthPoller != nil {
+		a.healthPoller.Start(ctx)
+		a.lifecycle.OnShutdown("health poller", a.healthPoller.Wait)
+	}
+
+	// the workers stop taking jobs with ctx, shutdown waits for the ones in
+	// progress once the servers stopped queueing new ones
+	workers := services.NewWorkerGroup()
+	a.webhookService.StartWorker(ctx, workers, a.fatal)
+	a.lifecycle.OnShutdown("background workers", workers.Wait)
+
+	// the admin server stops after the others, /readyz keeps answering while they drain
+	if a.adminServer != nil {
+		a.lifecycle.OnShutdown("admin server", a.adminServer.Shutdown)
+	}
+	a.lifecycle.OnShutdown("proxy server", a.proxyServer.Shutdown)
+	a.lifecycle.OnShutdown("api server", func(ctx context.Context) error {
+		err := a.apiServer.Shutdown(ctx)
+		if err != nil {
+			for _, req := range a.inFlightTracker.Snapshot() {
+				slog.Warn("In-flight request forcibly closed",
+					slog.String("Method", req.Method),
+					slog.String("Path", req.Path),
+					slog.Duration("Elapsed", time.Since(req.Started)),
+				)
+			}
+			a.apiServer.Close()
+		}
+		return err
+	})
+
+	// a panic in these goroutines cancels ctx, so Run still drains and closes
+	// everything in order
+	a.logStartup()
+	server.Go("api server", func() {
+		err := server.Serve(a.cfg, a.apiServer, apiListener)
+
+		if err != nil && !closedCleanly(err) {
+			slog.Error("Error while starting the Server:",
+				slog.Any("Error:", err),
+			)
+			fail(fmt.Errorf("api server: %w", err))
+		}
+	}, func() { fail(errors.New("api server panicked")) })
+
+	server.Go("proxy server", func() {
+		err := a.proxyServer.Serve(proxyListener)
+		if err != nil && !closedCleanly(err) {
+			slog.Error("Error while serving the Proxy server", slog.Any("Error", err))
+			fail(fmt.Errorf("proxy server: %w", err))
+		}
+	}, func() { fail(errors.New("proxy server panicked")) })
+
+	if a.adminServer != nil {
+		server.Go("admin server", func() {
+			err := a.adminServer.Serve(adminListener)
+			if err != nil && !closedCleanly(err) {
+				slog.Error("Error while serving the Admin server", slog.Any("Error", err))
+				fail(fmt.Errorf("admin server: %w", err))
+			}
+		}, func() { fail(errors.New("admin server panicked")) })
+	}
+
+	// SIGHUP reopens LOG_FILE for logrotate, reloads the live settings of the
+	// config and the route table, requests in flight finish on the old table
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	server.Go("sighup handler", func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				slog.Info("SIGHUP received")
+				err := configs.ReopenLogFile()
+				if err != nil {
+					slog.Error("Failed to reopen the log file, still writing to the old one", slog.Any("Error", err))
+				}
+				a.reloadConfig()
+
+				if a.routes != nil {
+					err = a.routes.Load()
+					if err != nil {
+						slog.Error("Failed to reload the route table, keeping the current one", slog.Any("Error", err))
+					}
+				}
+			}
+		}
+	}, func() { fail(errors.New("sighup handler panicked")) })
+
+	// a component that fails for good shuts everything down rather than
+	// leaving the app running degraded
+	server.Go("fatal error watcher", func() {
+		select {
+		case <-ctx.Done():
+		case err := <-a.fatal:
+			component := "unknown"
+			var fatalErr *services.FatalError
+			if errors.As(err, &fatalErr) {
+				component = fatalErr.Component
+			}
+			slog.Error("Fatal component error, shutting down",
+				slog.String("Component", component),
+				slog.Any("Error", err),
+			)
+			fail(err)
+		}
+	}, func() { fail(errors.New("fatal error watcher panicked")) })
+
+	// SIGUSR1 logs the runtime stats, there is no such signal on every platform
+	if len(statsSignals) > 0 {
+		dump := make(chan os.Signal, 1)
+		signal.Notify(dump, statsSignals...)
+		server.Go("stats signal handler", func() {
+			defer signal.Stop(dump)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-dump:
+					a.logRuntimeStats()
+				}
+			}
+		}, func() { fail(errors.New("stats signal handler panicked")) })
+	}
+
+	warmupCtx, cancelWarmup := context.WithTimeout(ctx, a.cfg.WarmupTimeout)
+	err = a.readiness.Warmup(warmupCtx)
+	cancelWarmup()
+	if err != nil {
+		a.readiness.MarkShuttingDown()
+		a.lifecycle.Shutdown(a.cfg.ShutdownTimeout)
+		return err
+	}
+
+	a.readiness.MarkStarted()
+
+	<-ctx.Done()
+
+	slog.Info("Shutdown Signal received, shutting down the backend server gracefully!")
+	shutdownStarted := time.Now()
+	preShutdown := a.runPreShutdown()
+	a.readiness.MarkShuttingDown()
+
+	// every response from here on carries Connection: close, so the clients
+	// move off their keep-alive connections while the load balancer drains
+	a.apiServer.SetKeepAlivesEnabled(false)
+	a.proxyServer.SetKeepAlivesEnabled(false)
+	if a.adminServer != nil {
+		a.adminServer.SetKeepAlivesEnabled(false)
+	}
+
+	// give the load balancer time to see /readyz fail before the listeners close
+	if a.cfg.ShutdownGracePeriod > 0 {
+		slog.Info("Waiting for the load balancer to drain", slog.Duration("GracePeriod", a.cfg.ShutdownGracePeriod))
+		time.Sleep(a.cfg.ShutdownGracePeriod)
+	}
+	grace := time.Since(shutdownStarted) - preShutdown
+	server.RecordShutdownPhase("grace period", grace)
+
+	err = a.lifecycle.Shutdown(a.cfg.ShutdownTimeout)
+
+	phases := []server.ShutdownPhase{{Name: "grace period", Duration: grace}}
+	if a.PreShutdown != nil {
+		phases = append([]server.ShutdownPhase{{Name: "pre-shutdown", Duration: preShutdown}}, phases...)
+	}
+	a.logShutdownSummary(time.Since(shutdownStarted), phases)
+
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	return errors.Join(append(failures, err)...)
+}
+
+// helper functions
+
+// closedCleanly reports whether a Serve error only says the server was shut
+// down, an Accept in flight on a listener closed under it reports
+// net.ErrClosed rather than http.ErrServerClosed
+func closedCleanly(err error) bool {
+	return errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,372 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/handlers"
+	"github.com/sash2721/Relay/middlewares"
+	"github.com/sash2721/Relay/server"
+	"github.com/sash2721/Relay/services"
+)
+
+func TestAppRunShutsDownOnContextCancel(t *testing.T) {
+	a := newTestApp(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	waitListening(t, a)
+
+	resp, err := http.Get("http://" + a.Addr() + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+
+	conn, err := net.DialTimeout("tcp", a.Addr(), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Errorf("%s still accepts connections after Run returned", a.Addr())
+	}
+}
+
+func TestAppShutsDownOnFatalComponentError(t *testing.T) {
+	a := newTestApp(t, nil)
+
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+	waitListening(t, a)
+
+	lost := errors.New("connection lost")
+	services.ReportFatal(a.Fatal(), "webhook queue", lost)
+
+	select {
+	case err := <-done:
+		var fatalErr *services.FatalError
+		if !errors.As(err, &fatalErr) || fatalErr.Component != "webhook queue" {
+			t.Errorf("Run = %v, want the webhook queue's fatal error", err)
+		}
+		if !errors.Is(err, lost) {
+			t.Errorf("Run = %v, want it to wrap %v", err, lost)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the fatal error")
+	}
+
+	conn, err := net.DialTimeout("tcp", a.Addr(), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Errorf("%s still accepts connections after the shutdown", a.Addr())
+	}
+}
+
+func TestAppClosesKeepAlivesOnceShutdownBegins(t *testing.T) {
+	a := newTestApp(t, map[string]string{"SHUTDOWN_GRACE_PERIOD": "2s"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	waitListening(t, a)
+
+	client := &http.Client{Transport: &http.Transport{}}
+	get := func() *http.Response {
+		t.Helper()
+		resp, err := client.Get("http://" + a.Addr() + "/healthz")
+		if err != nil {
+			t.Fatalf("GET /healthz: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get(); resp.Close {
+		t.Fatal("Connection: close before the shutdown began")
+	}
+
+	cancel()
+	// the servers keep answering through the grace period, every response
+	// from the moment the shutdown began tells the client to close, which
+	// the client reports as resp.Close
+	deadline := time.Now().Add(time.Second)
+	for !get().Close {
+		if time.Now().After(deadline) {
+			t.Fatal("no Connection: close after the shutdown began")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !get().Close {
+		t.Error("a response during the drain kept the connection alive")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the grace period")
+	}
+}
+
+func TestAdminPortKeepsMetricsOffThePublicPort(t *testing.T) {
+	a := newTestApp(t, map[string]string{"ADMIN_PORT": "0"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	waitListening(t, a)
+
+	status := func(addr string, path string) int {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("GET %s on %s: %v", path, addr, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if a.AdminAddr() == "" || a.AdminAddr() == a.Addr() {
+		t.Fatalf("AdminAddr = %q next to Addr %q, want a port of its own", a.AdminAddr(), a.Addr())
+	}
+	for _, path := range []string{"/metrics", "/healthz"} {
+		if got := status(a.Addr(), path); got != http.StatusNotFound {
+			t.Errorf("%s on the public port = %d, want %d", path, got, http.StatusNotFound)
+		}
+		if got := status(a.AdminAddr(), path); got != http.StatusOK {
+			t.Errorf("%s on the admin port = %d, want %d", path, got, http.StatusOK)
+		}
+	}
+
+	// both servers go down with the app
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	for _, addr := range []string{a.Addr(), a.AdminAddr()} {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after Run returned", addr)
+		}
+	}
+}
+
+func TestClosedListenerIsACleanShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		close func(*http.Server, net.Listener)
+	}{
+		{name: "server shut down", close: func(s *http.Server, _ net.Listener) { s.Shutdown(context.Background()) }},
+		// a listener the caller made and closes itself fails the Accept in flight
+		{name: "listener closed", close: func(_ *http.Server, l net.Listener) { l.Close() }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &http.Server{Handler: http.NotFoundHandler()}
+			served := make(chan error, 1)
+			go func() { served <- s.Serve(listener) }()
+
+			// a request makes sure Serve is accepting before the close
+			resp, err := http.Get("http://" + listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			tt.close(s, listener)
+			err = <-served
+			if !closedCleanly(err) {
+				t.Errorf("closedCleanly(%v) = false", err)
+			}
+			s.Close()
+		})
+	}
+}
+
+func TestAppShutdownLogsNoErrors(t *testing.T) {
+	a := newTestApp(t, nil)
+	logs := captureErrorLogs(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	waitListening(t, a)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+
+	if errs := logs.messages(); len(errs) > 0 {
+		t.Errorf("a clean shutdown logged errors: %v", errs)
+	}
+}
+
+// helper functions
+
+// newTestApp is what New builds without the database and the upstreams, the
+// API and proxy servers on random ports. env sets more of the config
+func newTestApp(t *testing.T, env map[string]string) *App {
+	t.Helper()
+	for key, value := range testEnv {
+		t.Setenv(key, value)
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	err := configs.InitServerConfig()
+	if err != nil {
+		t.Fatalf("InitServerConfig: %v", err)
+	}
+	cfg := *configs.GetServerConfig()
+
+	readiness := services.NewReadinessService()
+	inFlightTracker := middlewares.NewInFlightTracker()
+	deps := server.Dependencies{
+		AuthHandler:       &handlers.AuthHandler{},
+		ProjectHandler:    &handlers.ProjectHandler{},
+		LogStreamHandler:  &handlers.LogStreamHandler{},
+		DeploymentHandler: &handlers.DeploymentHandler{},
+		WebhookHandler:    &handlers.WebhookHandler{},
+		HealthHandler:     &handlers.HealthHandler{Readiness: readiness},
+		AdminHandler:      &handlers.AdminHandler{Readiness: readiness},
+		StatsHandler:      &handlers.StatsHandler{},
+		InFlightTracker:   inFlightTracker,
+		JSONValidator:     middlewares.NewJSONValidator(),
+	}
+
+	a := &App{
+		cfg:             &cfg,
+		lifecycle:       server.NewLifecycle(),
+		readiness:       readiness,
+		inFlightTracker: inFlightTracker,
+		webhookService:  services.NewWebhookService(services.NewMemoryWebhookQueue(cfg.WebhookVisibilityTimeout), cfg.WebhookMaxAttempts, cfg.WebhookRetryBackoff, cfg.WebhookTimeout),
+		apiServer:       server.NewServer(&cfg, server.BuildRouter(&cfg, deps)),
+		proxyServer: &http.Server{
+			Addr:              cfg.ProxyPort,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			Handler:           http.NotFoundHandler(),
+		},
+		startedAt: time.Now(),
+		fatal:     make(chan error, 1),
+		listening: make(chan struct{}),
+	}
+	deps.StatsHandler.Snapshot = a.stats
+	if cfg.AdminPort != "" {
+		a.adminServer = &http.Server{
+			Addr:    cfg.AdminAddr(),
+			Handler: server.BuildAdminRouter(&cfg, deps),
+		}
+	}
+	return a
+}
+
+// the env of every test app, the route paths are those of template.env
+var testEnv = map[string]string{
+	"PORT":                   "127.0.0.1:0",
+	"PROXY_PORT":             "127.0.0.1:0",
+	"STARTUP_BANNER":         "false",
+	"GOOGLE_LOGIN_API":       "/auth/google/login",
+	"GOOGLE_CALLBACK_API":    "/auth/google/callback",
+	"GITHUB_LOGIN_API":       "/auth/github/login",
+	"GITHUB_CALLBACK_API":    "/auth/github/callback",
+	"LOGIN_API":              "/auth/login",
+	"SIGNUP_API":             "/auth/signup",
+	"LOGOUT_API":             "/auth/logout",
+	"PROJECT_API":            "/api/projects",
+	"UPDATE_PROJECT_API":     "/api/projects/{projectID}",
+	"STREAM_LOGS_API":        "/api/projects/{projectID}/deployments/{deploymentID}/logs",
+	"TRIGGER_DEPLOYMENT_API": "/api/projects/{projectID}/deployments",
+	"LIST_DEPLOYMENTS_API":   "/api/projects/{projectID}/deployments",
+	"GET_DEPLOYMENT_API":     "/api/projects/{projectID}/deployments/{deploymentID}",
+	"DELETE_DEPLOYMENT_API":  "/api/projects/{projectID}/deployments/{deploymentID}",
+}
+
+// errorLogs keeps the messages logged at error level
+type errorLogs struct {
+	slog.Handler
+	mu     *sync.Mutex
+	logged *[]string
+}
+
+func (l errorLogs) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError {
+		l.mu.Lock()
+		*l.logged = append(*l.logged, record.Message)
+		l.mu.Unlock()
+	}
+	return l.Handler.Handle(ctx, record)
+}
+
+func (l errorLogs) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return errorLogs{Handler: l.Handler.WithAttrs(attrs), mu: l.mu, logged: l.logged}
+}
+
+func (l errorLogs) WithGroup(name string) slog.Handler {
+	return errorLogs{Handler: l.Handler.WithGroup(name), mu: l.mu, logged: l.logged}
+}
+
+func (l errorLogs) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), *l.logged...)
+}
+
+func captureErrorLogs(t *testing.T) errorLogs {
+	t.Helper()
+	previous := slog.Default()
+	// the default handler writes through the log package, which SetDefault
+	// points back at the new logger
+	logs := errorLogs{Handler: slog.NewTextHandler(os.Stderr, nil), mu: &sync.Mutex{}, logged: &[]string{}}
+	slog.SetDefault(slog.New(logs))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func waitListening(t *testing.T, a *App) {
+	t.Helper()
+	select {
+	case <-a.Listening():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the app never started listening")
+	}
+}
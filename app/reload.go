@@ -0,0 +1,37 @@
+package app
+
+import (
+	"log/slog"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+// reloadConfig reads the env again and applies what can change while serving:
+// LOG_LEVEL, RATE_LIMIT_RPS, RATE_LIMIT_BURST and REQUEST_TIMEOUT. A changed
+// listener or TLS setting is only logged, everything else keeps its startup
+// value until the next restart
+func (a *App) reloadConfig() {
+	next, err := configs.ReloadConfig()
+	if err != nil {
+		slog.Error("Failed to reload the config, keeping the current settings", slog.Any("Error", err))
+		return
+	}
+
+	for _, setting := range a.cfg.RestartRequired(next) {
+		slog.Warn("Config change requires restart, ignoring it", slog.String("Setting", setting))
+	}
+
+	err = configs.SetLogLevel(next.LogLevel)
+	if err != nil {
+		slog.Warn("Keeping the current log level", slog.Any("Error", err))
+	}
+	a.rateLimiter.SetLimit(next.RateLimitRPS, next.RateLimitBurst)
+	a.requestTimeout.Set(next.RequestTimeout)
+
+	slog.Info("Config reloaded",
+		slog.String("LogLevel", next.LogLevel),
+		slog.Float64("RateLimitRPS", next.RateLimitRPS),
+		slog.Int("RateLimitBurst", next.RateLimitBurst),
+		slog.Duration("RequestTimeout", next.RequestTimeout),
+	)
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sash2721/Relay/server"
+)
+
+// runPreShutdown runs PreShutdown within PRE_SHUTDOWN_TIMEOUT and returns how
+// long it took, a failure or a timeout is only logged. A hook that ignores
+// ctx is left running once the timeout is up, the shutdown goes on without it
+func (a *App) runPreShutdown() time.Duration {
+	if a.PreShutdown == nil {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.PreShutdownTimeout)
+	defer cancel()
+
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- fmt.Errorf("panicked: %v", recovered)
+			}
+		}()
+		done <- a.PreShutdown(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	took := time.Since(started)
+	server.RecordShutdownPhase("pre-shutdown", took)
+
+	if err != nil {
+		slog.Error("Pre-shutdown hook failed, shutting down anyway",
+			slog.Duration("Budget", a.cfg.PreShutdownTimeout),
+			slog.Duration("Duration", took),
+			slog.Any("Error", err),
+		)
+		return took
+	}
+	slog.Info("Pre-shutdown hook done", slog.Duration("Duration", took))
+	return took
+}
+
+// logShutdownSummary logs the whole shutdown in one line, the total and the
+// time of every phase in the order they ran, to show what SHUTDOWN_TIMEOUT,
+// SHUTDOWN_GRACE_PERIOD and PRE_SHUTDOWN_TIMEOUT have to cover. early are the
+// phases before the lifecycle hooks
+func (a *App) logShutdownSummary(total time.Duration, early []server.ShutdownPhase) {
+	server.RecordShutdown(total)
+
+	var phases []any
+	for _, phase := range append(early, a.lifecycle.Phases()...) {
+		phases = append(phases, slog.Duration(phase.Name, phase.Duration))
+	}
+
+	slog.Info("Shutdown complete",
+		slog.Duration("Total", total),
+		slog.Duration("Budget", a.cfg.ShutdownTimeout),
+		slog.Group("Phases", phases...),
+	)
+}
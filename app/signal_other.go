@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package app
+
+import "os"
+
+// there is no SIGUSR1 here, the stats dump is off
+var statsSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build !windows && !plan9
+
+package app
+
+import (
+	"os"
+	"syscall"
+)
+
+// statsSignals make Run log the runtime stats
+var statsSignals = []os.Signal{syscall.SIGUSR1}
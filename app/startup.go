@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+// logStartup logs the one structured startup event once every listener is
+// bound, and prints the human banner on stdout unless STARTUP_BANNER is off.
+// Service, Env and Version are on every log line already
+func (a *App) logStartup() {
+	_, commit, buildTime, goVersion := configs.BuildVersion()
+	mode := "HTTP"
+	if a.cfg.TLSEnabled() {
+		mode = "HTTPS"
+	}
+	routes := 0
+	if a.routes != nil {
+		routes = len(a.routes.Routes())
+	}
+
+	slog.Info("Relay started",
+		slog.String("Commit", commit),
+		slog.String("BuildTime", buildTime),
+		slog.String("GoVersion", goVersion),
+		slog.String("Network", a.cfg.ListenNetwork),
+		slog.String("Addr", a.addr),
+		slog.String("Mode", mode),
+		slog.String("ProxyAddr", a.proxyAddr),
+		slog.String("AdminAddr", a.adminAddr),
+		slog.Group("Features",
+			slog.Bool("TLS", a.cfg.TLSEnabled()),
+			slog.Bool("Pprof", a.cfg.EnablePprof),
+			slog.Bool("Metrics", true),
+			slog.Bool("Tracing", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""),
+			slog.Bool("ProxyProtocol", a.cfg.ProxyProtocol),
+			slog.Bool("Relay", a.relay != nil),
+		),
+		slog.Int("Routes", routes),
+	)
+
+	if !a.cfg.StartupBanner {
+		return
+	}
+	if a.cfg.ListenNetwork == "unix" {
+		fmt.Printf("Relay Backend Server listening on unix socket %s (%s)\n", a.addr, mode)
+	} else {
+		fmt.Printf("Relay Backend Server listening on %s (%s)\n", a.addr, mode)
+	}
+	fmt.Printf("Proxy server listening on %s\n", a.proxyAddr)
+	if a.adminServer != nil {
+		fmt.Printf("Admin server listening on %s\n", a.adminAddr)
+	}
+}
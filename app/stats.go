@@ -0,0 +1,151 @@
+package app
+
+import (
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/sash2721/Relay/middlewares"
+	"github.com/sash2721/Relay/models"
+	"github.com/sash2721/Relay/proxy"
+)
+
+// logRuntimeStats logs the goroutine count, the memory stats, the requests
+// in flight and the state of every upstream circuit in one line
+func (a *App) logRuntimeStats() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	inFlight := 0
+	if a.inFlightTracker != nil {
+		inFlight = a.inFlightTracker.Count()
+	}
+
+	slog.Info("Runtime stats",
+		slog.Int("Goroutines", runtime.NumGoroutine()),
+		slog.Int("InFlightRequests", inFlight),
+		slog.Group("Memory",
+			slog.Uint64("HeapAllocBytes", mem.HeapAlloc),
+			slog.Uint64("HeapInuseBytes", mem.HeapInuse),
+			slog.Uint64("HeapObjects", mem.HeapObjects),
+			slog.Uint64("StackInuseBytes", mem.StackInuse),
+			slog.Uint64("SysBytes", mem.Sys),
+			slog.Uint64("NumGC", uint64(mem.NumGC)),
+			slog.Duration("GCPauseTotal", time.Duration(mem.PauseTotalNs)),
+		),
+		slog.Any("Breakers", a.breakerStates()),
+	)
+}
+
+// stats is the /stats snapshot, built from atomic counters and the upstream
+// states so it stays cheap under load
+func (a *App) stats() models.StatsResponse {
+	total, inFlight := middlewares.RequestCounts()
+	response := models.StatsResponse{
+		StartedAt:        a.startedAt,
+		UptimeSeconds:    time.Since(a.startedAt).Seconds(),
+		RequestsTotal:    total,
+		RequestsInFlight: inFlight,
+		Upstreams:        make(map[string]map[string]models.UpstreamStats),
+	}
+
+	for name, relay := range a.relays() {
+		balancer := relay.Balancer()
+		breakers := balancer.CircuitBreakers()
+
+		members := balancer.Members()
+		hosts := make(map[string]models.UpstreamStats)
+		for host, available := range balancer.Available() {
+			upstream := models.UpstreamStats{Available: available, InPool: members[host]}
+			if breakers != nil {
+				upstream.Breaker = breakers.Get(host).State().String()
+			}
+			hosts[host] = upstream
+		}
+		response.Upstreams[name] = hosts
+	}
+
+	depth, err := a.webhookService.Queue.Depth()
+	if err != nil {
+		response.QueueError = err.Error()
+	}
+	response.QueueDepth = depth
+
+	return response
+}
+
+// breakerStates maps every relay onto the states of its upstream circuits
+func (a *App) breakerStates() map[string]map[string]string {
+	relays := a.relays()
+	states := make(map[string]map[string]string, len(relays))
+	for name, relay := range relays {
+		breakers := relay.Balancer().CircuitBreakers()
+		if breakers == nil {
+			continue
+		}
+		hosts := make(map[string]string)
+		for host, state := range breakers.States() {
+			hosts[host] = state.String()
+		}
+		states[name] = hosts
+	}
+	return states
+}
+
+// breakers maps every relay onto the circuits of its upstreams for
+// GET /admin/breakers, the relays without breakers left out
+func (a *App) breakers() map[string]map[string]models.BreakerStatus {
+	relays := a.relays()
+	breakers := make(map[string]map[string]models.BreakerStatus, len(relays))
+	for name, relay := range relays {
+		registry := relay.Balancer().CircuitBreakers()
+		if registry == nil {
+			continue
+		}
+		hosts := make(map[string]models.BreakerStatus)
+		for _, host := range registry.Hosts() {
+			breaker, _ := registry.Lookup(host)
+			hosts[host] = models.BreakerStatus{
+				State:    breaker.State().String(),
+				Failures: breaker.Failures(),
+			}
+		}
+		breakers[name] = hosts
+	}
+	return breakers
+}
+
+// resetBreaker closes the circuit of upstream in every relay that balances
+// over it, false when none does
+func (a *App) resetBreaker(upstream string) bool {
+	found := false
+	for _, relay := range a.relays() {
+		registry := relay.Balancer().CircuitBreakers()
+		if registry == nil {
+			continue
+		}
+		if breaker, ok := registry.Lookup(upstream); ok {
+			breaker.Reset()
+			found = true
+		}
+	}
+	return found
+}
+
+// relays returns every relay, RelayAPI as "relay" and the route table routes
+// by key
+func (a *App) relays() map[string]*proxy.RelayHandler {
+	relays := make(map[string]*proxy.RelayHandler)
+	if a.relay != nil {
+		relays["relay"] = a.relay
+	}
+	if a.defaultRelay != nil {
+		relays["default"] = a.defaultRelay
+	}
+	if a.routes != nil {
+		for key, relay := range a.routes.Relays() {
+			relays[key] = relay
+		}
+	}
+	return relays
+}
@@ -0,0 +1,177 @@
+package configs
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reads a string from the env, falling back when unset
+func getEnvString(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// reads a duration like "10s" from the env, falling back when unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration in env, using the default",
+			slog.String("Key", key),
+			slog.String("Value", value),
+			slog.Duration("Default", fallback),
+		)
+		return fallback
+	}
+
+	return duration
+}
+
+// reads an integer from the env, falling back when unset or invalid
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer in env, using the default",
+			slog.String("Key", key),
+			slog.String("Value", value),
+			slog.Int("Default", fallback),
+		)
+		return fallback
+	}
+
+	return parsed
+}
+
+// reads a float from the env, falling back when unset or invalid
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid number in env, using the default",
+			slog.String("Key", key),
+			slog.String("Value", value),
+			slog.Float64("Default", fallback),
+		)
+		return fallback
+	}
+
+	return parsed
+}
+
+// reads a comma-separated list from the env, dropping empty entries
+func getEnvList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if strings.TrimSpace(value) == "" {
+		return fallback
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// reads a boolean like "true" or "1" from the env, falling back when unset or invalid
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean in env, using the default",
+			slog.String("Key", key),
+			slog.String("Value", value),
+			slog.Bool("Default", fallback),
+		)
+		return fallback
+	}
+
+	return parsed
+}
+
+// reads octal file permissions like "0660" from the env, falling back when unset or invalid
+func getEnvFileMode(key string, fallback os.FileMode) os.FileMode {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		slog.Warn("Invalid file mode in env, using the default",
+			slog.String("Key", key),
+			slog.String("Value", value),
+			slog.String("Default", fallback.String()),
+		)
+		return fallback
+	}
+
+	return os.FileMode(mode)
+}
+
+// reads comma-separated "Name: value" pairs from the env, skipping malformed entries
+func getEnvHeaders(key string) map[string]string {
+	headers := make(map[string]string)
+	for _, item := range getEnvList(key, nil) {
+		name, value, ok := strings.Cut(item, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			slog.Warn("Invalid header in env, expected \"Name: value\"",
+				slog.String("Key", key),
+				slog.String("Value", item),
+			)
+			continue
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers
+}
+
+// reads a comma-separated list of integers from the env, skipping invalid entries
+func getEnvIntList(key string, fallback []int) []int {
+	items := getEnvList(key, nil)
+	if items == nil {
+		return fallback
+	}
+
+	var list []int
+	for _, item := range items {
+		parsed, err := strconv.Atoi(item)
+		if err != nil {
+			slog.Warn("Invalid integer in env list, skipping it",
+				slog.String("Key", key),
+				slog.String("Value", item),
+			)
+			continue
+		}
+		list = append(list, parsed)
+	}
+
+	return list
+}
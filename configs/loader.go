@@ -0,0 +1,48 @@
+package configs
+
+import (
+	"flag"
+	"os"
+)
+
+// configFlags maps each command-line flag onto the env var it overrides
+var configFlags = []struct {
+	name   string
+	envVar string
+	usage  string
+}{
+	{"port", "PORT", "port of the backend server, e.g. 8080 or :8080"},
+	{"host", "HOST", "interface the backend server binds to"},
+	{"env", "ENV", "env profile: development, staging or production"},
+	{"proxy-port", "PROXY_PORT", "port of the deployed sites proxy"},
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error"},
+	{"log-format", "LOG_FORMAT", "log format: text or json"},
+}
+
+// LoadConfig builds the server config with the precedence
+// flags > process env > .env.<APP_ENV> > .env > defaults, a broken env
+// file is returned as an error outside of development
+func LoadConfig() (*ServerConfig, error) {
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	values := make(map[string]*string, len(configFlags))
+	for _, f := range configFlags {
+		values[f.name] = flagSet.String(f.name, "", f.usage+" (overrides "+f.envVar+")")
+	}
+	flagSet.Parse(os.Args[1:])
+
+	// only the flags given on the command line override the env, godotenv
+	// never overrides a var that is already set so the process env wins over .env
+	flagSet.Visit(func(set *flag.Flag) {
+		for _, f := range configFlags {
+			if f.name == set.Name {
+				os.Setenv(f.envVar, *values[f.name])
+			}
+		}
+	})
+
+	err := InitServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return serverConfig, nil
+}
@@ -0,0 +1,53 @@
+package configs
+
+import (
+	"os"
+	"sync"
+)
+
+// the log file set by LOG_FILE, nil while logging to stdout
+var activeLogFile *logFile
+
+// logFile is an io.Writer over LOG_FILE that can be reopened after logrotate
+// has moved the old file away
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, file: file}, nil
+}
+
+func (f *logFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(b)
+}
+
+// ReopenLogFile closes LOG_FILE and opens it again at the same path, it does
+// nothing while logging to stdout. The old file stays in use when the path
+// can't be opened
+func ReopenLogFile() error {
+	if activeLogFile == nil {
+		return nil
+	}
+
+	f := activeLogFile
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	previous := f.file
+	f.file = file
+	f.mu.Unlock()
+
+	return previous.Close()
+}
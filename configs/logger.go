@@ -0,0 +1,84 @@
+package configs
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is shared by the installed handler so the level can change at runtime
+var logLevel = new(slog.LevelVar)
+
+// InitLogger installs the global slog logger from LOG_FORMAT (text|json) and
+// LOG_LEVEL (debug|info|warn|error), defaulting to text at info. It writes to
+// LOG_FILE when set and to stdout otherwise, LOG_SOURCE adds the file:line of
+// the call and every line carries the service, env and version
+func InitLogger(cfg *ServerConfig) error {
+	level, ok := parseLogLevel(cfg.LogLevel)
+	if !ok {
+		slog.Warn("Unrecognised LOG_LEVEL, using info", slog.String("LogLevel", cfg.LogLevel))
+	}
+	logLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: logLevel, AddSource: cfg.LogSource}
+
+	var output io.Writer = os.Stdout
+	if cfg.LogFile != "" {
+		file, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			return fmt.Errorf("failed to open LOG_FILE: %w", err)
+		}
+		activeLogFile = file
+		output = file
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	default:
+		slog.Warn("Unrecognised LOG_FORMAT, using text", slog.String("LogFormat", cfg.LogFormat))
+		handler = slog.NewTextHandler(output, options)
+	}
+
+	version, _, _, _ := BuildVersion()
+	logger := slog.New(handler).With(
+		slog.String("Service", cfg.ServiceName),
+		slog.String("Env", cfg.Env),
+		slog.String("Version", version),
+	)
+
+	slog.SetDefault(logger)
+	return nil
+}
+
+// SetLogLevel changes the level of the installed logger, an unrecognised
+// level leaves it as it is
+func SetLogLevel(level string) error {
+	parsed, ok := parseLogLevel(level)
+	if !ok {
+		return fmt.Errorf("unrecognised LOG_LEVEL %q", level)
+	}
+	logLevel.Set(parsed)
+	return nil
+}
+
+// helper function
+func parseLogLevel(level string) (slog.Level, bool) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "", "info":
+		return slog.LevelInfo, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	default:
+		return slog.LevelInfo, false
+	}
+}
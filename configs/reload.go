@@ -0,0 +1,72 @@
+package configs
+
+import "os"
+
+// restartOnly are the settings a running server can't change, the listeners
+// and their TLS are set up once at startup, as are the metric labels
+var restartOnly = []struct {
+	name  string
+	value func(c *ServerConfig) any
+}{
+	{"SERVICE_NAME", func(c *ServerConfig) any { return c.ServiceName }},
+	{"PORT", func(c *ServerConfig) any { return c.Port }},
+	{"HOST", func(c *ServerConfig) any { return c.Host }},
+	{"LISTEN_NETWORK", func(c *ServerConfig) any { return c.ListenNetwork }},
+	{"LISTEN_ADDR", func(c *ServerConfig) any { return c.ListenAddress }},
+	{"REUSEPORT", func(c *ServerConfig) any { return c.ReusePort }},
+	{"LISTEN_BACKLOG", func(c *ServerConfig) any { return c.ListenBacklog }},
+	{"PROXY_PROTOCOL", func(c *ServerConfig) any { return c.ProxyProtocol }},
+	{"HTTP2_CLEARTEXT", func(c *ServerConfig) any { return c.HTTP2Cleartext }},
+	{"PROXY_PORT", func(c *ServerConfig) any { return c.ProxyPort }},
+	{"ADMIN_PORT", func(c *ServerConfig) any { return c.AdminPort }},
+	{"ADMIN_HOST", func(c *ServerConfig) any { return c.AdminHost }},
+	{"TLS_CERT_FILE", func(c *ServerConfig) any { return c.TLSCertFile }},
+	{"TLS_KEY_FILE", func(c *ServerConfig) any { return c.TLSKeyFile }},
+	{"READ_TIMEOUT", func(c *ServerConfig) any { return c.ReadTimeout }},
+	{"READ_HEADER_TIMEOUT", func(c *ServerConfig) any { return c.ReadHeaderTimeout }},
+	{"WRITE_TIMEOUT", func(c *ServerConfig) any { return c.WriteTimeout }},
+	{"IDLE_TIMEOUT", func(c *ServerConfig) any { return c.IdleTimeout }},
+	{"MAX_HEADER_BYTES", func(c *ServerConfig) any { return c.MaxHeaderBytes }},
+}
+
+// ReloadConfig reads the env files again and builds a new config from the
+// env, the one GetServerConfig returns stays as it is. A value an env file
+// set at startup takes the file's current value, the process env and the
+// flags still win over the files
+func ReloadConfig() (*ServerConfig, error) {
+	previous := make(map[string]string, len(dotEnvKeys))
+	for key := range dotEnvKeys {
+		previous[key] = os.Getenv(key)
+		os.Unsetenv(key)
+	}
+
+	err := loadDotEnv()
+	if err != nil {
+		// a broken file leaves the env as the last good one set it
+		dotEnvKeys = make(map[string]bool, len(previous))
+		for key, value := range previous {
+			os.Setenv(key, value)
+			dotEnvKeys[key] = true
+		}
+		return nil, err
+	}
+
+	next := buildServerConfig()
+	err = next.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// RestartRequired returns the env vars next changes that only apply after a
+// restart
+func (c *ServerConfig) RestartRequired(next *ServerConfig) []string {
+	var changed []string
+	for _, setting := range restartOnly {
+		if setting.value(c) != setting.value(next) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
@@ -1,8 +1,16 @@
 package configs
 
 import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -35,50 +43,523 @@ type ServerConfig struct {
 	ArtifactsDir         string
 	RelayDomain          string
 	ProxyPort            string
+	// ADMIN_PORT moves the operational routes off the public server, empty keeps them on it
+	AdminPort   string
+	AdminHost   string
+	ReadTimeout time.Duration
+	// time a client gets to send the request headers, independent of the body
+	ReadHeaderTimeout            time.Duration
+	WriteTimeout                 time.Duration
+	IdleTimeout                  time.Duration
+	ShutdownTimeout              time.Duration
+	PreShutdownTimeout           time.Duration
+	ShutdownGracePeriod          time.Duration
+	StartupDelay                 time.Duration
+	StartupBanner                bool
+	WarmupTimeout                time.Duration
+	CORSAllowedOrigins           []string
+	CORSAllowedMethods           []string
+	CORSAllowedHeaders           []string
+	CORSAllowCredentials         bool
+	TLSCertFile                  string
+	TLSKeyFile                   string
+	UpstreamCAFile               string
+	SecurityContentTypeOptions   string
+	SecurityFrameOptions         string
+	SecurityHSTS                 string
+	SecurityCSP                  string
+	SecurityHeadersDefer         bool
+	UpstreamInsecureSkipVerify   bool
+	RelayAPI                     string
+	RelayOriginalPath            bool
+	PathTrailingSlash            string
+	PathLowercase                bool
+	UpstreamURL                  string
+	DefaultUpstream              string
+	ShadowUpstream               string
+	ShadowTimeout                time.Duration
+	ShadowMaxBodyBytes           int64
+	Upstreams                    []string
+	UpstreamCooldown             time.Duration
+	UpstreamCheckOnStart         string
+	UpstreamCheckTimeout         time.Duration
+	HealthCheckInterval          time.Duration
+	HealthCheckPath              string
+	HealthCheckRemoveAfter       time.Duration
+	HealthCheckHealthyThreshold  int
+	RelayMaxRetries              int
+	RelayRetryBackoff            time.Duration
+	RelayRetryBackoffMultiplier  float64
+	RelayRetryBackoffMax         time.Duration
+	RelayRetryJitter             string
+	RelayRedirects               string
+	RelayRetryBudgetRatio        float64
+	RelayRetryBudgetMinPerSecond float64
+	RelaySetHeaders              map[string]string
+	RelayRemoveHeaders           []string
+	RelayFailoverStatuses        []int
+	RelayMaxFailovers            int
+	RelayMaxIdleConns            int
+	RelayMaxIdleConnsPerHost     int
+	RelayIdleConnTimeout         time.Duration
+	RelayDNSCacheTTL             time.Duration
+	RelayDNSRetries              int
+	RelayMaxConnsPerHost         int
+	RoutesFile                   string
+	AccessRulesFile              string
+	BreakerThreshold             int
+	BreakerResetTimeout          time.Duration
+	WebhookAPI                   string
+	WebhookContentTypes          []string
+	// JSON Schema file WEBHOOK_API bodies must match, empty only checks they are JSON
+	WebhookJSONSchema   string
+	RelayContentTypes   []string
+	WebhookDeliveryAPI  string
+	WebhookMaxAttempts  int
+	WebhookRetryBackoff time.Duration
+	WebhookTimeout      time.Duration
+	// a dequeued delivery not finished within this is delivered again
+	WebhookVisibilityTimeout time.Duration
+	// memory or redis, the redis queue keeps the deliveries across restarts
+	QueueBackend           string
+	RedisURL               string
+	WebhookSecret          string
+	WebhookSignatureHeader string
+	WebhookSignaturePrefix string
+	RateLimitRPS           float64
+	RateLimitBurst         int
+	// memory or redis, redis shares the buckets of REDIS_URL across instances
+	RateLimitBackend      string
+	MaxConcurrentRequests int
+	LoadShedTargetLatency time.Duration
+	LoadShedMaxRate       float64
+	ServiceName           string
+	OTelServiceName       string
+	LogFormat             string
+	LogLevel              string
+	LogFile               string
+	LogSource             bool
+	AccessLogSampleRate   float64
+	TraceLogSampleRate    float64
+	AccessLogFields       []string
+	BodyLogPaths          []string
+	BodyLogMaxBytes       int
+	BodyLogRedactFields   []string
+	APIKeys               []string
+	// keys whose requests may pin an upstream with X-Relay-Upstream
+	AdminAPIKeys                 []string
+	RelayOverrideHosts           []string
+	AllowCIDRs                   []string
+	DenyCIDRs                    []string
+	TrustedProxies               []string
+	EnablePprof                  bool
+	MaintenanceMessage           string
+	RootHandlerMode              string
+	RootMessage                  string
+	RootRedirectURL              string
+	MaxBodyBytes                 int64
+	RelayMaxBodyBytes            int64
+	RelayReplayMaxBodyBytes      int64
+	RequestDecompression         []string
+	RequestDecompressionMaxBytes int64
+	RequestDecompressionStrict   bool
+	MaxHeaderBytes               int
+	MaxURLLength                 int
+	RelayCacheMaxBytes           int64
+	IdempotencyTTL               time.Duration
+	GzipMinSize                  int
+	GzipLevel                    int
+	RequestTimeout               time.Duration
+	BodyReadTimeout              time.Duration
+	ListenNetwork                string
+	ReusePort                    bool
+	ListenBacklog                int
+	ProxyProtocol                bool
+	HTTP2Cleartext               bool
+	ListenAddress                string
+	SocketMode                   os.FileMode
+
+	// HOST and PORT when they are set next to a tcp LISTEN_ADDR
+	listenConflicts []string
 }
 
+const defaultPort = ":8080"
+
 var serverConfig *ServerConfig
 
-func InitServerConfig() {
-	err := godotenv.Load()
+// dotEnvKeys are the env vars loadDotEnv set from the env files, the ones a
+// reload may change again
+var dotEnvKeys = make(map[string]bool)
+
+// InitServerConfig loads .env and builds the config, a missing .env only
+// warns while one that can't be read or parsed is an error outside of
+// development, and the config is left unset
+func InitServerConfig() error {
+	err := loadDotEnv()
 	if err != nil {
-		slog.Warn("Error loading .env file, using system environment variables")
-	}
-
-	serverConfig = &ServerConfig{
-		Port:                 os.Getenv("PORT"),
-		Host:                 os.Getenv("HOST"),
-		Env:                  os.Getenv("ENV"),
-		AppURL:               os.Getenv("APP_URL"),
-		SecretKey:            os.Getenv("JWT_SECRET"),
-		GoogleClientID:       os.Getenv("GOOGLE_CLIENT_ID"),
-		GoogleClientSecret:   os.Getenv("GOOGLE_CLIENT_SECRET"),
-		GithubClientID:       os.Getenv("GITHUB_CLIENT_ID"),
-		GithubClientSecret:   os.Getenv("GITHUB_CLIENT_SECRET"),
-		GoogleLoginAPI:       os.Getenv("GOOGLE_LOGIN_API"),
-		GoogleCallbackAPI:    os.Getenv("GOOGLE_CALLBACK_API"),
-		GithubLoginAPI:       os.Getenv("GITHUB_LOGIN_API"),
-		GithubCallbackAPI:    os.Getenv("GITHUB_CALLBACK_API"),
-		LoginAPI:             os.Getenv("LOGIN_API"),
-		SignupAPI:            os.Getenv("SIGNUP_API"),
-		LogoutAPI:            os.Getenv("LOGOUT_API"),
-		ProjectAPI:           os.Getenv("PROJECT_API"),
-		UpdateProjectAPI:     os.Getenv("UPDATE_PROJECT_API"),
-		StreamLogsAPI:        os.Getenv("STREAM_LOGS_API"),
-		TriggerDeploymentAPI: os.Getenv("TRIGGER_DEPLOYMENT_API"),
-		ListDeploymentsAPI:   os.Getenv("LIST_DEPLOYMENTS_API"),
-		GetDeploymentAPI:     os.Getenv("GET_DEPLOYMENT_API"),
-		DeleteDeploymentAPI:  os.Getenv("DELETE_DEPLOYMENT_API"),
-		DbConnectionString:   os.Getenv("DATABASE_URL"),
-		ArtifactsDir:         os.Getenv("ARTIFACTS_DIR"),
-		RelayDomain:          os.Getenv("RELAY_DOMAIN"),
-		ProxyPort:            os.Getenv("PROXY_PORT"),
+		return err
 	}
+
+	serverConfig = buildServerConfig()
+	return nil
+}
+
+// buildServerConfig reads every setting from the env, with the defaults of
+// the ENV profile
+func buildServerConfig() *ServerConfig {
+	config := &ServerConfig{
+		Port:                       normalizePort(os.Getenv("PORT")),
+		Host:                       os.Getenv("HOST"),
+		ListenNetwork:              getEnvString("LISTEN_NETWORK", "tcp"),
+		ReusePort:                  getEnvBool("REUSEPORT", false),
+		ListenBacklog:              getEnvInt("LISTEN_BACKLOG", 0),
+		ProxyProtocol:              getEnvBool("PROXY_PROTOCOL", false),
+		HTTP2Cleartext:             getEnvBool("HTTP2_CLEARTEXT", false),
+		ListenAddress:              os.Getenv("LISTEN_ADDR"),
+		SocketMode:                 getEnvFileMode("LISTEN_SOCKET_MODE", 0660),
+		Env:                        normalizeEnv(os.Getenv("ENV")),
+		AppURL:                     os.Getenv("APP_URL"),
+		SecretKey:                  os.Getenv("JWT_SECRET"),
+		GoogleClientID:             os.Getenv("GOOGLE_CLIENT_ID"),
+		GoogleClientSecret:         os.Getenv("GOOGLE_CLIENT_SECRET"),
+		GithubClientID:             os.Getenv("GITHUB_CLIENT_ID"),
+		GithubClientSecret:         os.Getenv("GITHUB_CLIENT_SECRET"),
+		GoogleLoginAPI:             os.Getenv("GOOGLE_LOGIN_API"),
+		GoogleCallbackAPI:          os.Getenv("GOOGLE_CALLBACK_API"),
+		GithubLoginAPI:             os.Getenv("GITHUB_LOGIN_API"),
+		GithubCallbackAPI:          os.Getenv("GITHUB_CALLBACK_API"),
+		LoginAPI:                   os.Getenv("LOGIN_API"),
+		SignupAPI:                  os.Getenv("SIGNUP_API"),
+		LogoutAPI:                  os.Getenv("LOGOUT_API"),
+		ProjectAPI:                 os.Getenv("PROJECT_API"),
+		UpdateProjectAPI:           os.Getenv("UPDATE_PROJECT_API"),
+		StreamLogsAPI:              os.Getenv("STREAM_LOGS_API"),
+		TriggerDeploymentAPI:       os.Getenv("TRIGGER_DEPLOYMENT_API"),
+		ListDeploymentsAPI:         os.Getenv("LIST_DEPLOYMENTS_API"),
+		GetDeploymentAPI:           os.Getenv("GET_DEPLOYMENT_API"),
+		DeleteDeploymentAPI:        os.Getenv("DELETE_DEPLOYMENT_API"),
+		DbConnectionString:         os.Getenv("DATABASE_URL"),
+		ArtifactsDir:               os.Getenv("ARTIFACTS_DIR"),
+		RelayDomain:                os.Getenv("RELAY_DOMAIN"),
+		ProxyPort:                  os.Getenv("PROXY_PORT"),
+		AdminHost:                  getEnvString("ADMIN_HOST", "127.0.0.1"),
+		TLSCertFile:                os.Getenv("TLS_CERT_FILE"),
+		UpstreamCAFile:             os.Getenv("UPSTREAM_CA_FILE"),
+		SecurityContentTypeOptions: getEnvString("SECURITY_CONTENT_TYPE_OPTIONS", "nosniff"),
+		SecurityFrameOptions:       getEnvString("SECURITY_FRAME_OPTIONS", "DENY"),
+		SecurityHSTS:               os.Getenv("SECURITY_HSTS"),
+		SecurityCSP:                os.Getenv("SECURITY_CSP"),
+		SecurityHeadersDefer:       getEnvBool("SECURITY_HEADERS_DEFER", true),
+		UpstreamInsecureSkipVerify: getEnvBool("UPSTREAM_INSECURE_SKIP_VERIFY", false),
+		TLSKeyFile:                 os.Getenv("TLS_KEY_FILE"),
+		RelayAPI:                   getEnvString("RELAY_API", "/relay"),
+		RelayOriginalPath:          getEnvBool("RELAY_ORIGINAL_PATH", false),
+		PathTrailingSlash:          getEnvString("PATH_TRAILING_SLASH", "keep"),
+		PathLowercase:              getEnvBool("PATH_LOWERCASE", false),
+		UpstreamURL:                os.Getenv("UPSTREAM_URL"),
+		DefaultUpstream:            os.Getenv("DEFAULT_UPSTREAM"),
+		ShadowUpstream:             os.Getenv("SHADOW_UPSTREAM"),
+		WebhookAPI:                 getEnvString("WEBHOOK_API", "/api/webhooks"),
+		WebhookContentTypes:        getEnvList("WEBHOOK_CONTENT_TYPES", nil),
+		WebhookJSONSchema:          getEnvString("WEBHOOK_JSON_SCHEMA", ""),
+		RelayContentTypes:          getEnvList("RELAY_CONTENT_TYPES", nil),
+		WebhookDeliveryAPI:         getEnvString("WEBHOOK_DELIVERY_API", "/api/webhooks/{deliveryID}"),
+		ServiceName:                getEnvString("SERVICE_NAME", "relay"),
+		LogFormat:                  getEnvString("LOG_FORMAT", "text"),
+		LogLevel:                   getEnvString("LOG_LEVEL", "info"),
+		LogFile:                    os.Getenv("LOG_FILE"),
+		LogSource:                  getEnvBool("LOG_SOURCE", false),
+		APIKeys:                    getEnvList("API_KEYS", nil),
+		AdminAPIKeys:               getEnvList("ADMIN_API_KEYS", nil),
+		RelayOverrideHosts:         getEnvList("RELAY_OVERRIDE_HOSTS", nil),
+		AllowCIDRs:                 getEnvList("ALLOW_CIDRS", nil),
+		DenyCIDRs:                  getEnvList("DENY_CIDRS", nil),
+		TrustedProxies:             getEnvList("TRUSTED_PROXIES", nil),
+		EnablePprof:                getEnvBool("ENABLE_PPROF", false),
+		MaintenanceMessage:         getEnvString("MAINTENANCE_MESSAGE", "Relay is down for maintenance"),
+		RootHandlerMode:            strings.ToLower(getEnvString("ROOT_HANDLER_MODE", "message")),
+		RootMessage:                getEnvString("ROOT_MESSAGE", "Relay Backend Service Running"),
+		RootRedirectURL:            os.Getenv("ROOT_REDIRECT_URL"),
+		AccessLogSampleRate:        getEnvFloat("ACCESS_LOG_SAMPLE_RATE", 1),
+		TraceLogSampleRate:         getEnvFloat("TRACE_LOG_SAMPLE_RATE", 0),
+		AccessLogFields:            getEnvList("ACCESS_LOG_FIELDS", accessLogFields),
+		BodyLogPaths:               getEnvList("BODY_LOG_PATHS", nil),
+		BodyLogMaxBytes:            getEnvInt("BODY_LOG_MAX_BYTES", 4096),
+		BodyLogRedactFields:        getEnvList("BODY_LOG_REDACT_FIELDS", []string{"password", "token", "access_token", "refresh_token", "secret"}),
+	}
+
+	// the env profile decides the defaults, the env vars override them
+	readTimeout, writeTimeout, idleTimeout := defaultTimeouts(config.Env)
+	config.ReadTimeout = getEnvDuration("READ_TIMEOUT", readTimeout)
+	config.ReadHeaderTimeout = getEnvDuration("READ_HEADER_TIMEOUT", 5*time.Second)
+	config.WriteTimeout = getEnvDuration("WRITE_TIMEOUT", writeTimeout)
+	config.IdleTimeout = getEnvDuration("IDLE_TIMEOUT", idleTimeout)
+	config.ShutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 5*time.Second)
+	config.ShutdownGracePeriod = getEnvDuration("SHUTDOWN_GRACE_PERIOD", 0)
+	config.PreShutdownTimeout = getEnvDuration("PRE_SHUTDOWN_TIMEOUT", 5*time.Second)
+	config.StartupDelay = getEnvDuration("STARTUP_DELAY", 0)
+	config.StartupBanner = getEnvBool("STARTUP_BANNER", true)
+	config.WarmupTimeout = getEnvDuration("WARMUP_TIMEOUT", 30*time.Second)
+	config.RequestTimeout = getEnvDuration("REQUEST_TIMEOUT", 30*time.Second)
+	config.BodyReadTimeout = getEnvDuration("BODY_READ_TIMEOUT", 0)
+
+	config.Upstreams = getEnvList("UPSTREAMS", nil)
+	config.UpstreamCooldown = getEnvDuration("UPSTREAM_COOLDOWN", 10*time.Second)
+	config.UpstreamCheckOnStart = strings.ToLower(getEnvString("UPSTREAM_HEALTHCHECK_ON_START", "off"))
+	config.UpstreamCheckTimeout = getEnvDuration("UPSTREAM_HEALTHCHECK_TIMEOUT", 2*time.Second)
+	config.HealthCheckInterval = getEnvDuration("HEALTHCHECK_INTERVAL", 0)
+	config.HealthCheckPath = getEnvString("HEALTHCHECK_PATH", "/healthz")
+	config.HealthCheckRemoveAfter = getEnvDuration("HEALTHCHECK_REMOVE_AFTER", 0)
+	config.HealthCheckHealthyThreshold = getEnvInt("HEALTHCHECK_HEALTHY_THRESHOLD", 1)
+	config.RelayMaxRetries = getEnvInt("RELAY_MAX_RETRIES", 2)
+	config.RelayRetryBackoff = getEnvDuration("RELAY_RETRY_BACKOFF", 100*time.Millisecond)
+	config.RelayRetryBackoffMultiplier = getEnvFloat("RELAY_RETRY_BACKOFF_MULTIPLIER", 2)
+	config.RelayRetryBackoffMax = getEnvDuration("RELAY_RETRY_BACKOFF_MAX", 2*time.Second)
+	config.RelayRetryJitter = strings.ToLower(getEnvString("RELAY_RETRY_JITTER", "full"))
+	config.RelayRedirects = strings.ToLower(getEnvString("RELAY_REDIRECTS", "pass"))
+	config.RelayRetryBudgetRatio = getEnvFloat("RELAY_RETRY_BUDGET_RATIO", 0.2)
+	config.RelayRetryBudgetMinPerSecond = getEnvFloat("RELAY_RETRY_BUDGET_MIN_PER_SECOND", 10)
+	config.RelaySetHeaders = getEnvHeaders("RELAY_SET_HEADERS")
+	config.RelayRemoveHeaders = getEnvList("RELAY_REMOVE_HEADERS", nil)
+	config.RelayFailoverStatuses = getEnvIntList("RELAY_FAILOVER_STATUSES", nil)
+	config.RelayMaxFailovers = getEnvInt("RELAY_MAX_FAILOVERS", 1)
+	config.RelayMaxIdleConns = getEnvInt("RELAY_MAX_IDLE_CONNS", 100)
+	config.RelayMaxIdleConnsPerHost = getEnvInt("RELAY_MAX_IDLE_CONNS_PER_HOST", 32)
+	config.RelayIdleConnTimeout = getEnvDuration("RELAY_IDLE_CONN_TIMEOUT", 90*time.Second)
+	config.RelayMaxConnsPerHost = getEnvInt("RELAY_MAX_CONNS_PER_HOST", 0)
+	config.RelayDNSCacheTTL = getEnvDuration("RELAY_DNS_CACHE_TTL", 30*time.Second)
+	config.RelayDNSRetries = getEnvInt("RELAY_DNS_RETRIES", 2)
+	config.RoutesFile = getEnvString("ROUTES_FILE", "")
+	if port := strings.TrimSpace(os.Getenv("ADMIN_PORT")); port != "" {
+		config.AdminPort = normalizePort(port)
+	}
+	config.AccessRulesFile = getEnvString("ACCESS_RULES_FILE", "")
+	config.BreakerThreshold = getEnvInt("CIRCUIT_BREAKER_THRESHOLD", 5)
+	config.BreakerResetTimeout = getEnvDuration("CIRCUIT_BREAKER_RESET_TIMEOUT", 30*time.Second)
+
+	config.WebhookMaxAttempts = getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5)
+	config.WebhookRetryBackoff = getEnvDuration("WEBHOOK_RETRY_BACKOFF", time.Second)
+	config.WebhookTimeout = getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	config.WebhookVisibilityTimeout = getEnvDuration("WEBHOOK_VISIBILITY_TIMEOUT", time.Minute)
+	config.QueueBackend = strings.ToLower(getEnvString("QUEUE_BACKEND", "memory"))
+	config.RedisURL = os.Getenv("REDIS_URL")
+	config.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	config.WebhookSignatureHeader = getEnvString("WEBHOOK_SIGNATURE_HEADER", "X-Hub-Signature-256")
+	config.WebhookSignaturePrefix = getEnvString("WEBHOOK_SIGNATURE_PREFIX", "sha256=")
+
+	config.MaxBodyBytes = int64(getEnvInt("MAX_BODY_BYTES", 1<<20))
+	config.RelayMaxBodyBytes = int64(getEnvInt("RELAY_MAX_BODY_BYTES", int(config.MaxBodyBytes)))
+	config.RelayReplayMaxBodyBytes = int64(getEnvInt("RELAY_REPLAY_MAX_BODY_BYTES", 1<<20))
+	// a tcp LISTEN_ADDR is the whole address, it replaces HOST and PORT
+	if config.ListenNetwork == "tcp" && strings.TrimSpace(config.ListenAddress) != "" {
+		config.ListenAddress = normalizeAddress(config.ListenAddress)
+		for _, key := range []string{"HOST", "PORT"} {
+			if strings.TrimSpace(os.Getenv(key)) != "" {
+				config.listenConflicts = append(config.listenConflicts, key)
+			}
+		}
+	}
+
+	for _, encoding := range getEnvList("REQUEST_DECOMPRESSION", nil) {
+		config.RequestDecompression = append(config.RequestDecompression, strings.ToLower(encoding))
+	}
+	config.RequestDecompressionMaxBytes = int64(getEnvInt("REQUEST_DECOMPRESSION_MAX_BYTES", int(config.MaxBodyBytes)))
+	config.RequestDecompressionStrict = getEnvBool("REQUEST_DECOMPRESSION_STRICT", false)
+	config.ShadowMaxBodyBytes = int64(getEnvInt("SHADOW_MAX_BODY_BYTES", 1<<20))
+	config.ShadowTimeout = getEnvDuration("SHADOW_TIMEOUT", 5*time.Second)
+	config.MaxHeaderBytes = getEnvInt("MAX_HEADER_BYTES", 1<<20)
+	config.MaxURLLength = getEnvInt("MAX_URL_LENGTH", 8192)
+	config.RelayCacheMaxBytes = int64(getEnvInt("RELAY_CACHE_MAX_BYTES", 0))
+	config.IdempotencyTTL = getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+	config.GzipMinSize = getEnvInt("GZIP_MIN_SIZE", 1024)
+	config.GzipLevel = getEnvInt("GZIP_LEVEL", gzip.DefaultCompression)
+
+	config.RateLimitRPS = getEnvFloat("RATE_LIMIT_RPS", 0)
+	config.RateLimitBurst = getEnvInt("RATE_LIMIT_BURST", 20)
+	config.RateLimitBackend = strings.ToLower(getEnvString("RATE_LIMIT_BACKEND", "memory"))
+	config.OTelServiceName = getEnvString("OTEL_SERVICE_NAME", config.ServiceName)
+	config.MaxConcurrentRequests = getEnvInt("MAX_CONCURRENT_REQUESTS", 0)
+	config.LoadShedTargetLatency = getEnvDuration("LOAD_SHED_TARGET_LATENCY", 0)
+	config.LoadShedMaxRate = getEnvFloat("LOAD_SHED_MAX_RATE", 0.5)
+
+	config.CORSAllowedOrigins = getEnvList("CORS_ALLOWED_ORIGINS", nil)
+	config.CORSAllowedMethods = getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+	config.CORSAllowedHeaders = getEnvList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization", "X-Request-ID"})
+	config.CORSAllowCredentials = getEnvBool("CORS_ALLOW_CREDENTIALS", false)
+	return config
 }
 
+// GetServerConfig returns the loaded config, loading it from the env files
+// and the env on first use. main loads it through LoadConfig first, so a .env
+// error has already stopped the process by the time anything else asks. The
+// lazy path never parses the command line, and an env file it can't read
+// leaves the process env and the defaults, never a nil config
 func GetServerConfig() *ServerConfig {
 	if serverConfig == nil {
-		InitServerConfig()
+		err := InitServerConfig()
+		if err != nil {
+			slog.Error("Failed to load the env files, using the process env and the defaults", slog.Any("Error", err))
+			serverConfig = buildServerConfig()
+		}
 	}
 	return serverConfig
 }
+
+// loadDotEnv layers .env.<APP_ENV> over .env and copies the result into the
+// process env without overriding what is already set there. APP_ENV comes
+// from the process env or the base .env, and ENV decides whether a broken
+// file is fatal from the process env since the file itself could not be read
+func loadDotEnv() error {
+	values, err := readDotEnv(".env")
+	if err != nil {
+		return err
+	}
+
+	appEnv := os.Getenv("APP_ENV")
+	if appEnv == "" {
+		appEnv = values["APP_ENV"]
+	}
+	if appEnv != "" {
+		overlay, err := readDotEnv(".env." + appEnv)
+		if err != nil {
+			return err
+		}
+		for key, value := range overlay {
+			values[key] = value
+		}
+	}
+
+	dotEnvKeys = make(map[string]bool, len(values))
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+			dotEnvKeys[key] = true
+		}
+	}
+	return nil
+}
+
+// helper function
+func readDotEnv(path string) (map[string]string, error) {
+	values, err := godotenv.Read(path)
+	if err == nil {
+		return values, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Env file not found, skipping it", slog.String("File", path))
+		return map[string]string{}, nil
+	}
+	if normalizeEnv(os.Getenv("ENV")) == "development" {
+		slog.Warn("Failed to load an env file, skipping it", slog.String("File", path), slog.Any("Error", err))
+		return map[string]string{}, nil
+	}
+	return nil, fmt.Errorf("failed to load %s: %w", path, err)
+}
+
+// normalizeEnv trims and lower-cases the ENV profile so " Production " is
+// production everywhere it's compared
+func normalizeEnv(env string) string {
+	return strings.ToLower(strings.TrimSpace(env))
+}
+
+// returns the read, write and idle timeouts for the env profile
+func defaultTimeouts(env string) (time.Duration, time.Duration, time.Duration) {
+	// WriteTimeout stays disabled in every profile, a relayed request may
+	// take as long as its route timeout. The streams are exempt from it
+	// either way, see StreamDeadlineMiddleware
+	switch env {
+	case "development":
+		return 10 * time.Second, 0, 60 * time.Second
+	case "staging", "production":
+		return 15 * time.Second, 0, 120 * time.Second
+	default:
+		slog.Warn("Unrecognised ENV, using the default server timeouts",
+			slog.String("Env", env),
+		)
+		return 15 * time.Second, 0, 120 * time.Second
+	}
+}
+
+// ListenAddr combines Host and Port, an empty Host keeps listening on all
+// interfaces. A set LISTEN_ADDR is used as it is instead, the host:port to
+// bind or on a unix socket the socket path
+func (c *ServerConfig) ListenAddr() string {
+	if c.ListenNetwork == "unix" || c.ListenAddress != "" {
+		return c.ListenAddress
+	}
+
+	if c.Host == "" {
+		return c.Port
+	}
+
+	_, port, err := net.SplitHostPort(c.Port)
+	if err != nil {
+		return c.Port
+	}
+
+	return net.JoinHostPort(c.Host, port)
+}
+
+// AdminAddr combines AdminHost and AdminPort
+func (c *ServerConfig) AdminAddr() string {
+	_, port, err := net.SplitHostPort(c.AdminPort)
+	if err != nil {
+		return c.AdminPort
+	}
+	return net.JoinHostPort(c.AdminHost, port)
+}
+
+// RelayUpstreams returns UPSTREAMS, or UPSTREAM_URL alone when no pool is configured
+func (c *ServerConfig) RelayUpstreams() []string {
+	if len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+	if c.UpstreamURL != "" {
+		return []string{c.UpstreamURL}
+	}
+	return nil
+}
+
+// SecurityHeaders returns the security headers to set on every response, an
+// empty setting leaves its header out
+func (c *ServerConfig) SecurityHeaders() map[string]string {
+	headers := make(map[string]string, 4)
+	for name, value := range map[string]string{
+		"X-Content-Type-Options":    c.SecurityContentTypeOptions,
+		"X-Frame-Options":           c.SecurityFrameOptions,
+		"Strict-Transport-Security": c.SecurityHSTS,
+		"Content-Security-Policy":   c.SecurityCSP,
+	} {
+		if value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// TLSEnabled reports whether the server should serve HTTPS itself
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// defaults an empty port and accepts a bare "8080" as ":8080"
+func normalizePort(port string) string {
+	port = strings.TrimSpace(port)
+	if port == "" {
+		return defaultPort
+	}
+
+	return normalizeAddress(port)
+}
+
+// normalizeAddress turns a bare port into :port, a :port or host:port is kept
+// as it is
+func normalizeAddress(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if _, err := strconv.Atoi(addr); err == nil {
+		return ":" + addr
+	}
+
+	return addr
+}
@@ -0,0 +1,114 @@
+package configs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNormalizePort(t *testing.T) {
+	tests := []struct {
+		port string
+		want string
+	}{
+		{port: "", want: ":8080"},
+		{port: "   ", want: ":8080"},
+		{port: ":8080", want: ":8080"},
+		{port: "8080", want: ":8080"},
+		{port: " 3000 ", want: ":3000"},
+		{port: "127.0.0.1:3000", want: "127.0.0.1:3000"},
+	}
+
+	for _, tt := range tests {
+		got := normalizePort(tt.port)
+		if got != tt.want {
+			t.Errorf("normalizePort(%q) = %q, want %q", tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestBuildServerConfigPort(t *testing.T) {
+	tests := []struct {
+		port string
+		want string
+	}{
+		{port: "", want: ":8080"},
+		{port: ":8080", want: ":8080"},
+		{port: "8080", want: ":8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run("PORT="+tt.port, func(t *testing.T) {
+			t.Setenv("PORT", tt.port)
+			t.Setenv("HOST", "")
+			t.Setenv("LISTEN_ADDR", "")
+
+			cfg := buildServerConfig()
+			if cfg.Port != tt.want {
+				t.Errorf("Port = %q, want %q", cfg.Port, tt.want)
+			}
+			if cfg.ListenAddr() != tt.want {
+				t.Errorf("ListenAddr() = %q, want %q", cfg.ListenAddr(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildServerConfigNormalizesEnv(t *testing.T) {
+	tests := []struct {
+		env         string
+		want        string
+		readTimeout time.Duration
+	}{
+		{env: "Production", want: "production", readTimeout: 15 * time.Second},
+		{env: "PRODUCTION", want: "production", readTimeout: 15 * time.Second},
+		{env: " development ", want: "development", readTimeout: 10 * time.Second},
+		{env: "\tDevelopment\n", want: "development", readTimeout: 10 * time.Second},
+		{env: "  StAgInG", want: "staging", readTimeout: 15 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("ENV", tt.env)
+			t.Setenv("READ_TIMEOUT", "")
+
+			cfg := buildServerConfig()
+			if cfg.Env != tt.want {
+				t.Errorf("Env = %q, want %q", cfg.Env, tt.want)
+			}
+			if !isValidEnv(cfg.Env) {
+				t.Errorf("Env %q is not a valid profile", cfg.Env)
+			}
+			if cfg.ReadTimeout != tt.readTimeout {
+				t.Errorf("ReadTimeout = %v, want the %s profile's %v", cfg.ReadTimeout, tt.want, tt.readTimeout)
+			}
+		})
+	}
+}
+
+func TestGetServerConfigLoadsLazilyWithoutFlags(t *testing.T) {
+	previous := serverConfig
+	t.Cleanup(func() { serverConfig = previous })
+	serverConfig = nil
+
+	// a .env that can't be parsed is an error outside of development
+	t.Chdir(t.TempDir())
+	err := os.WriteFile(".env", []byte("PORT=\"9090\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENV", "production")
+	t.Setenv("PORT", "7070")
+
+	// os.Args holds the test binary's -test flags, parsing them would exit
+	cfg := GetServerConfig()
+	if cfg == nil {
+		t.Fatal("GetServerConfig returned nil")
+	}
+	if cfg.Port != ":7070" || cfg.Env != "production" {
+		t.Errorf("Port %q and Env %q, want the process env's :7070 and production", cfg.Port, cfg.Env)
+	}
+	if GetServerConfig() != cfg {
+		t.Error("a second call built the config again")
+	}
+}
@@ -0,0 +1,48 @@
+package configs
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// InitTracing installs the OTLP trace exporter when OTEL_EXPORTER_OTLP_ENDPOINT
+// is set, otherwise the global no-op provider stays in place. The returned
+// function flushes pending spans on shutdown.
+func InitTracing(ctx context.Context, cfg *ServerConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		slog.Debug("OTEL_EXPORTER_OTLP_ENDPOINT not set, tracing disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// the exporter reads the endpoint and headers from the OTEL_* env vars
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(cfg.OTelServiceName),
+		)),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	slog.Info("Tracing enabled", slog.String("ServiceName", cfg.OTelServiceName))
+
+	return tracerProvider.Shutdown, nil
+}
@@ -0,0 +1,41 @@
+package configs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// UpstreamTLSConfig is the TLS config the relay dials HTTPS upstreams with,
+// nil keeps Go's defaults when neither UPSTREAM_CA_FILE nor
+// UPSTREAM_INSECURE_SKIP_VERIFY is set. The CA bundle is trusted on top of
+// the system roots
+func (c *ServerConfig) UpstreamTLSConfig() (*tls.Config, error) {
+	if c.UpstreamCAFile == "" && !c.UpstreamInsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.UpstreamInsecureSkipVerify,
+	}
+
+	if c.UpstreamCAFile != "" {
+		bundle, err := os.ReadFile(c.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UPSTREAM_CA_FILE: %w", err)
+		}
+
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("UPSTREAM_CA_FILE %s holds no PEM certificate", c.UpstreamCAFile)
+		}
+		config.RootCAs = roots
+	}
+
+	return config, nil
+}
@@ -0,0 +1,332 @@
+package configs
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var validEnvs = []string{"development", "staging", "production"}
+
+// the jitter modes of proxy.Backoff, proxy imports configs and not the other way
+var retryJitterModes = []string{"none", "full", "equal"}
+
+// SERVICE_NAME becomes a metric label and a log attribute, kept to what both
+// take as is
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,62}$`)
+
+// every field of the access log, all of them are logged by default
+var accessLogFields = []string{"method", "path", "status", "bytes", "remote_ip", "duration", "request_id", "user_agent"}
+
+// the request Content-Encodings DecompressMiddleware decodes
+var requestDecompressionEncodings = []string{"gzip", "deflate"}
+
+// Validate checks the fields the server cannot start without and reports
+// every invalid one at once
+func (c *ServerConfig) Validate() error {
+	var problems []error
+
+	if !isValidEnv(c.Env) {
+		problems = append(problems, fmt.Errorf("ENV %q must be one of %s", c.Env, strings.Join(validEnvs, ", ")))
+	}
+
+	if !serviceNamePattern.MatchString(c.ServiceName) {
+		problems = append(problems, fmt.Errorf("SERVICE_NAME %q must start with a letter and hold only letters, digits, '_', '.' and '-', up to 63 characters", c.ServiceName))
+	}
+
+	if err := validatePort(c.Port); err != nil {
+		problems = append(problems, fmt.Errorf("PORT %q: %w", c.Port, err))
+	}
+
+	if c.Host != "" && !isValidHost(c.Host) {
+		problems = append(problems, fmt.Errorf("HOST %q is not a valid hostname or IP", c.Host))
+	}
+
+	// PORT=0.0.0.0:8080 next to HOST=127.0.0.1 would bind HOST without a word
+	if portHost, _, err := net.SplitHostPort(c.Port); err == nil && c.Host != "" && portHost != "" && portHost != c.Host {
+		problems = append(problems, fmt.Errorf("PORT %q names host %s but HOST is %q, set the host in one of them or use LISTEN_ADDR", c.Port, portHost, c.Host))
+	}
+
+	if c.AdminPort != "" {
+		if err := validatePort(c.AdminPort); err != nil {
+			problems = append(problems, fmt.Errorf("ADMIN_PORT %q: %w", c.AdminPort, err))
+		}
+		if !isValidHost(c.AdminHost) {
+			problems = append(problems, fmt.Errorf("ADMIN_HOST %q is not a valid hostname or IP", c.AdminHost))
+		}
+	}
+
+	switch c.ListenNetwork {
+	case "tcp":
+		if c.ListenAddress == "" {
+			break
+		}
+		if err := validatePort(c.ListenAddress); err != nil {
+			problems = append(problems, fmt.Errorf("LISTEN_ADDR %q: %w", c.ListenAddress, err))
+		} else if host, _, _ := net.SplitHostPort(c.ListenAddress); host != "" && !isValidHost(host) {
+			problems = append(problems, fmt.Errorf("LISTEN_ADDR %q: %s is not a valid hostname or IP", c.ListenAddress, host))
+		}
+		if len(c.listenConflicts) > 0 {
+			problems = append(problems, fmt.Errorf("LISTEN_ADDR %q and %s are both set, LISTEN_ADDR replaces HOST and PORT so leave them unset", c.ListenAddress, strings.Join(c.listenConflicts, " and ")))
+		}
+	case "unix":
+		if c.ListenAddress == "" {
+			problems = append(problems, fmt.Errorf("LISTEN_ADDR must be the socket path when LISTEN_NETWORK is unix"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("LISTEN_NETWORK %q must be tcp or unix", c.ListenNetwork))
+	}
+
+	if c.ListenBacklog < 0 {
+		problems = append(problems, fmt.Errorf("LISTEN_BACKLOG %d must not be negative", c.ListenBacklog))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+
+	if _, err := c.UpstreamTLSConfig(); err != nil {
+		problems = append(problems, err)
+	}
+	// skipping verification is for development against self-signed upstreams only
+	if c.UpstreamInsecureSkipVerify && c.Env == "production" {
+		problems = append(problems, fmt.Errorf("UPSTREAM_INSECURE_SKIP_VERIFY must not be set in production"))
+	}
+
+	// the CORS spec forbids credentials on a wildcard origin
+	if c.CORSAllowCredentials && slices.Contains(c.CORSAllowedOrigins, "*") {
+		problems = append(problems, fmt.Errorf("CORS_ALLOWED_ORIGINS cannot be \"*\" when CORS_ALLOW_CREDENTIALS is true"))
+	}
+
+	if c.GzipLevel < gzip.HuffmanOnly || c.GzipLevel > gzip.BestCompression {
+		problems = append(problems, fmt.Errorf("GZIP_LEVEL %d must be between %d and %d", c.GzipLevel, gzip.HuffmanOnly, gzip.BestCompression))
+	}
+
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		problems = append(problems, fmt.Errorf("ACCESS_LOG_SAMPLE_RATE %v must be between 0 and 1", c.AccessLogSampleRate))
+	}
+
+	if c.TraceLogSampleRate < 0 || c.TraceLogSampleRate > 1 {
+		problems = append(problems, fmt.Errorf("TRACE_LOG_SAMPLE_RATE %v must be between 0 and 1", c.TraceLogSampleRate))
+	}
+
+	for _, field := range c.AccessLogFields {
+		if !slices.Contains(accessLogFields, field) {
+			problems = append(problems, fmt.Errorf("ACCESS_LOG_FIELDS %q must be one of %s", field, strings.Join(accessLogFields, ", ")))
+		}
+	}
+
+	// profiles leak memory contents and cost CPU, they never go out unguarded
+	if c.EnablePprof && len(c.APIKeys) == 0 && len(c.AllowCIDRs) == 0 {
+		problems = append(problems, fmt.Errorf("ENABLE_PPROF needs API_KEYS or ALLOW_CIDRS to guard /debug/pprof"))
+	}
+
+	switch c.RootHandlerMode {
+	case "message", "no_content":
+	case "redirect":
+		if c.RootRedirectURL == "" {
+			problems = append(problems, fmt.Errorf("ROOT_HANDLER_MODE redirect needs ROOT_REDIRECT_URL"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("ROOT_HANDLER_MODE %q must be message, no_content or redirect", c.RootHandlerMode))
+	}
+
+	switch c.QueueBackend {
+	case "memory":
+	case "redis":
+		if c.RedisURL == "" {
+			problems = append(problems, errors.New("QUEUE_BACKEND=redis requires REDIS_URL"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("QUEUE_BACKEND %q must be memory or redis", c.QueueBackend))
+	}
+
+	switch c.RateLimitBackend {
+	case "memory":
+	case "redis":
+		if c.RedisURL == "" {
+			problems = append(problems, errors.New("RATE_LIMIT_BACKEND=redis requires REDIS_URL"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("RATE_LIMIT_BACKEND %q must be memory or redis", c.RateLimitBackend))
+	}
+
+	switch c.PathTrailingSlash {
+	case "keep", "strip", "ensure":
+	default:
+		problems = append(problems, fmt.Errorf("PATH_TRAILING_SLASH %q must be keep, strip or ensure", c.PathTrailingSlash))
+	}
+
+	for _, contentType := range append(append([]string{}, c.WebhookContentTypes...), c.RelayContentTypes...) {
+		kind, subtype, ok := strings.Cut(contentType, "/")
+		if !ok || kind == "" || subtype == "" || strings.ContainsAny(contentType, "; ") {
+			problems = append(problems, fmt.Errorf("content type %q of WEBHOOK_CONTENT_TYPES or RELAY_CONTENT_TYPES must be type/subtype or type/*", contentType))
+		}
+	}
+
+	if c.RelayRetryBackoff < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_RETRY_BACKOFF %v must not be negative", c.RelayRetryBackoff))
+	}
+	if c.RelayRetryBackoffMultiplier < 1 {
+		problems = append(problems, fmt.Errorf("RELAY_RETRY_BACKOFF_MULTIPLIER %v must be at least 1", c.RelayRetryBackoffMultiplier))
+	}
+	if c.RelayRetryBackoffMax < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_RETRY_BACKOFF_MAX %v must not be negative", c.RelayRetryBackoffMax))
+	}
+	if !slices.Contains(retryJitterModes, c.RelayRetryJitter) {
+		problems = append(problems, fmt.Errorf("RELAY_RETRY_JITTER %q must be one of %v", c.RelayRetryJitter, retryJitterModes))
+	}
+
+	if c.RelayRedirects != "pass" && c.RelayRedirects != "follow" {
+		problems = append(problems, fmt.Errorf("RELAY_REDIRECTS %q must be pass or follow", c.RelayRedirects))
+	}
+
+	if c.RelayRetryBudgetRatio < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_RETRY_BUDGET_RATIO %v must not be negative", c.RelayRetryBudgetRatio))
+	}
+	if c.RelayRetryBudgetMinPerSecond < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_RETRY_BUDGET_MIN_PER_SECOND %v must not be negative", c.RelayRetryBudgetMinPerSecond))
+	}
+
+	if c.RelayReplayMaxBodyBytes < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_REPLAY_MAX_BODY_BYTES %d must not be negative", c.RelayReplayMaxBodyBytes))
+	}
+
+	for _, encoding := range c.RequestDecompression {
+		if !slices.Contains(requestDecompressionEncodings, encoding) {
+			problems = append(problems, fmt.Errorf("REQUEST_DECOMPRESSION %q must be one of %s", encoding, strings.Join(requestDecompressionEncodings, ", ")))
+		}
+	}
+
+	if len(c.RequestDecompression) > 0 && c.RequestDecompressionMaxBytes <= 0 {
+		problems = append(problems, fmt.Errorf("REQUEST_DECOMPRESSION_MAX_BYTES %d must be positive", c.RequestDecompressionMaxBytes))
+	}
+
+	if c.ShadowMaxBodyBytes < 0 {
+		problems = append(problems, fmt.Errorf("SHADOW_MAX_BODY_BYTES %d must not be negative", c.ShadowMaxBodyBytes))
+	}
+	if c.ShadowUpstream != "" && c.ShadowTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("SHADOW_TIMEOUT %v must be positive", c.ShadowTimeout))
+	}
+
+	if c.WebhookVisibilityTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("WEBHOOK_VISIBILITY_TIMEOUT %v must be positive", c.WebhookVisibilityTimeout))
+	} else if c.WebhookTimeout <= 0 || c.WebhookVisibilityTimeout <= c.WebhookTimeout {
+		// a delivery must be able to finish before it is handed out again
+		problems = append(problems, fmt.Errorf("WEBHOOK_VISIBILITY_TIMEOUT %v must be longer than WEBHOOK_TIMEOUT %v", c.WebhookVisibilityTimeout, c.WebhookTimeout))
+	}
+
+	if c.MaxHeaderBytes <= 0 {
+		problems = append(problems, fmt.Errorf("MAX_HEADER_BYTES %d must be positive", c.MaxHeaderBytes))
+	}
+	if c.MaxURLLength < 0 {
+		problems = append(problems, fmt.Errorf("MAX_URL_LENGTH %d must not be negative", c.MaxURLLength))
+	}
+
+	if c.RelayDNSRetries < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_DNS_RETRIES %d must not be negative", c.RelayDNSRetries))
+	}
+
+	if c.MaxConcurrentRequests < 0 {
+		problems = append(problems, fmt.Errorf("MAX_CONCURRENT_REQUESTS %d must not be negative", c.MaxConcurrentRequests))
+	}
+	if c.LoadShedTargetLatency < 0 {
+		problems = append(problems, fmt.Errorf("LOAD_SHED_TARGET_LATENCY %s must not be negative", c.LoadShedTargetLatency))
+	}
+	if c.LoadShedMaxRate < 0 || c.LoadShedMaxRate > 1 {
+		problems = append(problems, fmt.Errorf("LOAD_SHED_MAX_RATE %v must be between 0 and 1", c.LoadShedMaxRate))
+	}
+
+	if c.BodyLogMaxBytes < 0 {
+		problems = append(problems, fmt.Errorf("BODY_LOG_MAX_BYTES %d must not be negative", c.BodyLogMaxBytes))
+	}
+
+	switch c.UpstreamCheckOnStart {
+	case "off", "on", "strict":
+	default:
+		problems = append(problems, fmt.Errorf("UPSTREAM_HEALTHCHECK_ON_START %q must be off, on or strict", c.UpstreamCheckOnStart))
+	}
+
+	if c.BodyReadTimeout < 0 {
+		problems = append(problems, fmt.Errorf("BODY_READ_TIMEOUT %v must not be negative", c.BodyReadTimeout))
+	}
+
+	if c.HealthCheckRemoveAfter < 0 {
+		problems = append(problems, fmt.Errorf("HEALTHCHECK_REMOVE_AFTER %v must not be negative", c.HealthCheckRemoveAfter))
+	}
+
+	if c.HealthCheckHealthyThreshold < 1 {
+		problems = append(problems, fmt.Errorf("HEALTHCHECK_HEALTHY_THRESHOLD %d must be at least 1", c.HealthCheckHealthyThreshold))
+	}
+
+	if c.RelayMaxIdleConns < 0 || c.RelayMaxIdleConnsPerHost < 0 || c.RelayMaxConnsPerHost < 0 {
+		problems = append(problems, fmt.Errorf("RELAY_MAX_IDLE_CONNS, RELAY_MAX_IDLE_CONNS_PER_HOST and RELAY_MAX_CONNS_PER_HOST must not be negative"))
+	}
+
+	if _, err := ParseCIDRs(c.AllowCIDRs); err != nil {
+		problems = append(problems, fmt.Errorf("ALLOW_CIDRS: %w", err))
+	}
+	if _, err := ParseCIDRs(c.DenyCIDRs); err != nil {
+		problems = append(problems, fmt.Errorf("DENY_CIDRS: %w", err))
+	}
+	if _, err := ParseCIDRs(c.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Errorf("TRUSTED_PROXIES: %w", err))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid server config: %w", errors.Join(problems...))
+	}
+
+	return nil
+}
+
+// helper functions
+func isValidEnv(env string) bool {
+	return slices.Contains(validEnvs, env)
+}
+
+func validatePort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return fmt.Errorf("port must be a number between 0 and 65535")
+	}
+
+	return nil
+}
+
+func isValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	if len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			isAlphaNumeric := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+			if !isAlphaNumeric && ch != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,24 @@
+package configs
+
+import "runtime"
+
+// set at build time, e.g.
+// go build -ldflags "-X github.com/sash2721/Relay/configs.Version=v1.2.0 -X github.com/sash2721/Relay/configs.Commit=$(git rev-parse HEAD)"
+var (
+	Version   string
+	Commit    string
+	BuildTime string
+)
+
+// BuildVersion returns the ldflags values, "unknown" for the ones go run left empty
+func BuildVersion() (version, commit, buildTime, goVersion string) {
+	return orUnknown(Version), orUnknown(Commit), orUnknown(BuildTime), runtime.Version()
+}
+
+// helper function
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
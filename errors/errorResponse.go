@@ -0,0 +1,56 @@
+package errors
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// codes of the error envelope, clients switch on these rather than the message
+const (
+	CodeBadRequest           = "bad_request"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeURITooLong           = "uri_too_long"
+	CodeRateLimited          = "rate_limited"
+	CodeInternal             = "internal_error"
+	CodeBadGateway           = "bad_gateway"
+	CodeTimeout              = "timeout"
+	CodeServiceUnavailable   = "service_unavailable"
+)
+
+// the response header RequestIDMiddleware echoes the request ID in
+const requestIDHeader = "X-Request-ID"
+
+// ErrorResponse is the envelope WriteError answers with
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteError answers with status and the error envelope, the request ID is
+// the one RequestIDMiddleware already set on the response so clients can
+// quote it in a support ticket
+func WriteError(w http.ResponseWriter, status int, code string, message string) {
+	body, err := json.Marshal(ErrorResponse{Error: ErrorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: w.Header().Get(requestIDHeader),
+	}})
+	if err != nil {
+		body = []byte(`{"error":{"code":"internal_error","message":"Internal Server Error"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sash2721/Relay/errors"
+	"github.com/sash2721/Relay/models"
+	"github.com/sash2721/Relay/services"
+)
+
+type AdminHandler struct {
+	Readiness *services.ReadinessService
+	// Breakers lists the circuits of every relay and ResetBreaker closes the
+	// ones of an upstream host, false when no relay knows it
+	Breakers     func() map[string]map[string]models.BreakerStatus
+	ResetBreaker func(upstream string) bool
+}
+
+// HandleMaintenance switches maintenance mode on or off with
+// {"enabled": true|false} and answers with the resulting state
+func (h *AdminHandler) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req models.MaintenanceRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Enabled == nil {
+		errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, `Request body must be {"enabled": true} or {"enabled": false}`)
+		return
+	}
+
+	if *req.Enabled != h.Readiness.InMaintenance() {
+		slog.Warn("Maintenance mode switched", slog.Bool("Enabled", *req.Enabled))
+	}
+	h.Readiness.SetMaintenance(*req.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.MaintenanceResponse{Maintenance: *req.Enabled})
+}
+
+// HandleBreakers lists the state and failure count of every upstream circuit
+func (h *AdminHandler) HandleBreakers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.BreakersResponse{Breakers: h.Breakers()})
+}
+
+// HandleBreakerReset forces the circuit of the {upstream} host closed in
+// every relay that has one, 404 when none does
+func (h *AdminHandler) HandleBreakerReset(w http.ResponseWriter, r *http.Request) {
+	upstream := chi.URLParam(r, "upstream")
+	if !h.ResetBreaker(upstream) {
+		errors.WriteError(w, http.StatusNotFound, errors.CodeNotFound, "No circuit breaker for upstream "+upstream)
+		return
+	}
+
+	slog.Warn("Circuit breaker reset", slog.String("Upstream", upstream))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.BreakerResetResponse{Upstream: upstream, State: "closed"})
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sash2721/Relay/errors"
+	"github.com/sash2721/Relay/models"
+	"github.com/sash2721/Relay/proxy"
+)
+
+func TestHandleBreakerResetUnknownUpstream(t *testing.T) {
+	registry := proxy.NewBreakerRegistry(1, time.Minute)
+	registry.Get("api.internal:8080")
+	router := newBreakerRouter(registry)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/breakers/unknown.internal:8080/reset", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	var body errors.ErrorResponse
+	err := json.NewDecoder(rec.Body).Decode(&body)
+	if err != nil || body.Error.Code != errors.CodeNotFound {
+		t.Errorf("body = %+v, %v, want the %s envelope", body, err, errors.CodeNotFound)
+	}
+	// looking an upstream up never creates its breaker
+	if _, ok := registry.Lookup("unknown.internal:8080"); ok {
+		t.Error("the reset created a breaker for the unknown upstream")
+	}
+}
+
+func TestHandleBreakerResetClosesCircuit(t *testing.T) {
+	registry := proxy.NewBreakerRegistry(1, time.Minute)
+	breaker := registry.Get("api.internal:8080")
+	breaker.RecordFailure()
+	if breaker.State() != proxy.StateOpen {
+		t.Fatalf("state = %v after the failure, want open", breaker.State())
+	}
+
+	rec := httptest.NewRecorder()
+	newBreakerRouter(registry).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/breakers/api.internal:8080/reset", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var body models.BreakerResetResponse
+	err := json.NewDecoder(rec.Body).Decode(&body)
+	if err != nil || body.Upstream != "api.internal:8080" || body.State != "closed" {
+		t.Errorf("body = %+v, %v", body, err)
+	}
+	if breaker.State() != proxy.StateClosed || breaker.Failures() != 0 || !breaker.Allow() {
+		t.Errorf("after the reset the breaker is %v with %d failures", breaker.State(), breaker.Failures())
+	}
+}
+
+func TestHandleBreakerResetUnderLoad(t *testing.T) {
+	registry := proxy.NewBreakerRegistry(3, time.Millisecond)
+	breaker := registry.Get("api.internal:8080")
+	router := newBreakerRouter(registry)
+
+	stop := make(chan struct{})
+	var traffic sync.WaitGroup
+	// the relay keeps using the breaker while the resets come in
+	for worker := range 4 {
+		traffic.Go(func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !breaker.Allow() {
+					continue
+				}
+				if (i+worker)%3 == 0 {
+					breaker.RecordSuccess()
+				} else {
+					breaker.RecordFailure()
+				}
+			}
+		})
+	}
+
+	var resets sync.WaitGroup
+	for range 8 {
+		resets.Go(func() {
+			for range 50 {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/breakers/api.internal:8080/reset", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("reset = %d, want %d", rec.Code, http.StatusOK)
+					return
+				}
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/breakers", nil))
+			}
+		})
+	}
+	resets.Wait()
+	close(stop)
+	traffic.Wait()
+
+	// once the traffic stopped, one more reset leaves it closed for good
+	breaker.Reset()
+	if breaker.State() != proxy.StateClosed || breaker.Failures() != 0 {
+		t.Errorf("after the last reset the breaker is %v with %d failures", breaker.State(), breaker.Failures())
+	}
+}
+
+// helper functions
+
+// newBreakerRouter mounts the breaker endpoints over registry, resetting
+// through Lookup the way the app does for every relay
+func newBreakerRouter(registry *proxy.BreakerRegistry) http.Handler {
+	h := &AdminHandler{
+		Breakers: func() map[string]map[string]models.BreakerStatus {
+			statuses := make(map[string]models.BreakerStatus)
+			for _, host := range registry.Hosts() {
+				breaker, _ := registry.Lookup(host)
+				statuses[host] = models.BreakerStatus{State: breaker.State().String(), Failures: breaker.Failures()}
+			}
+			return map[string]map[string]models.BreakerStatus{"relay": statuses}
+		},
+		ResetBreaker: func(upstream string) bool {
+			breaker, ok := registry.Lookup(upstream)
+			if ok {
+				breaker.Reset()
+			}
+			return ok
+		},
+	}
+
+	r := chi.NewRouter()
+	r.Get("/admin/breakers", h.HandleBreakers)
+	r.Post("/admin/breakers/{upstream}/reset", h.HandleBreakerReset)
+	return r
+}
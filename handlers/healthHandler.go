@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sash2721/Relay/models"
+	"github.com/sash2721/Relay/services"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	Readiness *services.ReadinessService
+}
+
+// HandleHealthz is the liveness probe, it never touches downstream
+// dependencies so it keeps answering until the listener closes
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (h *HealthHandler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	results, err := h.Readiness.Check(ctx)
+
+	response := models.ReadinessResponse{Status: "ready"}
+	if len(results) > 0 {
+		response.Checks = make(map[string]string, len(results))
+		for name, checkErr := range results {
+			if checkErr != nil {
+				response.Checks[name] = checkErr.Error()
+			} else {
+				response.Checks[name] = "ok"
+			}
+		}
+	}
+
+	statusCode := http.StatusOK
+	if err != nil {
+		slog.Warn("Readiness check failed", slog.Any("Error", err))
+		response.Status = "not ready"
+		response.Reason = err.Error()
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleDeepHealth runs every dependency check in parallel and answers 200
+// only when all of them pass, degraded checks are reported apart from failed ones
+func (h *HealthHandler) HandleDeepHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	results := h.Readiness.CheckDeep(ctx)
+
+	response := models.DeepHealthResponse{
+		Status: "ok",
+		Checks: make(map[string]models.DependencyCheck, len(results)),
+	}
+	for name, result := range results {
+		check := models.DependencyCheck{
+			Status:    "ok",
+			LatencyMs: float64(result.Latency.Microseconds()) / 1000,
+		}
+		switch {
+		case result.Err == nil:
+		case services.IsDegraded(result.Err):
+			check.Status = "degraded"
+			check.Error = result.Err.Error()
+			if response.Status == "ok" {
+				response.Status = "degraded"
+			}
+		default:
+			check.Status = "fail"
+			check.Error = result.Err.Error()
+			response.Status = "fail"
+		}
+		response.Checks[name] = check
+	}
+
+	statusCode := http.StatusOK
+	if response.Status != "ok" {
+		slog.Warn("Deep health check did not pass", slog.String("Status", response.Status))
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
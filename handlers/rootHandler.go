@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// modes of ROOT_HANDLER_MODE
+const (
+	RootModeMessage   = "message"
+	RootModeNoContent = "no_content"
+	RootModeRedirect  = "redirect"
+)
+
+// NewRootHandler answers the service banner according to mode: message as
+// JSON, an empty 204 for deployments that shouldn't announce themselves, or a
+// 302 to redirectURL
+func NewRootHandler(mode string, message string, redirectURL string) http.HandlerFunc {
+	switch mode {
+	case RootModeNoContent:
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case RootModeRedirect:
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, redirectURL, http.StatusFound)
+		}
+	}
+
+	body, _ := json.Marshal(map[string]string{"message": message})
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sash2721/Relay/errors"
+)
+
+// methods tried when listing Allow on a 405
+var routableMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// HandleNotFound replaces chi's plain text 404
+func HandleNotFound(w http.ResponseWriter, r *http.Request) {
+	errors.WriteError(w, http.StatusNotFound, errors.CodeNotFound, "Not found")
+}
+
+// HandleMethodNotAllowed replaces chi's plain text 405, Allow lists the
+// methods the path does answer to
+func HandleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if allowed := allowedMethods(r); len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	errors.WriteError(w, http.StatusMethodNotAllowed, errors.CodeMethodNotAllowed, "Method not allowed")
+}
+
+// helper functions
+func allowedMethods(r *http.Request) []string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return nil
+	}
+
+	path := r.URL.Path
+	if r.URL.RawPath != "" {
+		path = r.URL.RawPath
+	}
+
+	var allowed []string
+	for _, method := range routableMethods {
+		if rctx.Routes.Match(chi.NewRouteContext(), method, path) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sash2721/Relay/models"
+)
+
+// StatsHandler answers /stats with the snapshot Snapshot takes
+type StatsHandler struct {
+	Snapshot func() models.StatsResponse
+}
+
+func (h *StatsHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.Snapshot())
+}
@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/models"
+)
+
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	var response models.VersionResponse
+	response.Version, response.Commit, response.BuildTime, response.GoVersion = configs.BuildVersion()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sash2721/Relay/models"
+	"github.com/sash2721/Relay/services"
+)
+
+type WebhookHandler struct {
+	Service *services.WebhookService
+}
+
+func (s *WebhookHandler) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateWebhookRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.Error("Error while decoding the webhook request body",
+			slog.Any("Error", err),
+		)
+		http.Error(w, `{"message":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	responseJson, err, errJson, responseCode := s.Service.EnqueueWebhook(req.TargetURL, req.Payload)
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(responseCode)
+		w.Write(errJson)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(responseCode)
+	w.Write(responseJson)
+}
+
+func (s *WebhookHandler) HandleGetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	deliveryID := chi.URLParam(r, "deliveryID")
+
+	responseJson, err, errJson, responseCode := s.Service.GetDelivery(deliveryID)
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(responseCode)
+		w.Write(errJson)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(responseCode)
+	w.Write(responseJson)
+}
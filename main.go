@@ -2,178 +2,85 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sash2721/Relay/app"
 	"github.com/sash2721/Relay/configs"
-	"github.com/sash2721/Relay/db"
-	"github.com/sash2721/Relay/handlers"
 	"github.com/sash2721/Relay/middlewares"
 	"github.com/sash2721/Relay/proxy"
-	"github.com/sash2721/Relay/repositories"
-	"github.com/sash2721/Relay/services"
+	"github.com/sash2721/Relay/server"
 )
 
 func main() {
-	slog.Info("Relay Starts!🚀")
-
-	configs.InitServerConfig()
-	configs.InitProviders()
-
-	r := chi.NewRouter()
-
-	// common middlewares for all routes here
-	r.Use(middlewares.LoggingMiddleware)
-
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{ "message": "Relay Backend Service Running" }`))
-	})
-
-	serverConfig := configs.GetServerConfig()
-
-	// creating db connection and running the migrations
-	err := db.Connect(serverConfig.DbConnectionString)
+	serverConfig, err := configs.LoadConfig()
 	if err != nil {
-		slog.Error("DB connection not established!", slog.Any("Error", err))
+		slog.Error("Failed to load the configuration, refusing to start", slog.Any("Error", err))
 		os.Exit(1)
 	}
-	defer db.Close()
 
-	err = db.RunMigrations()
+	err = configs.InitLogger(serverConfig)
 	if err != nil {
-		slog.Error(
-			"Failed to run the migrations",
-			slog.Any("Error:", err),
-		)
+		slog.Error("Failed to set up logging", slog.Any("Error", err))
 		os.Exit(1)
 	}
 
-	// initialising the log streamer
-	logStreamer := services.NewLogStreamer()
-
-	// start cleanup job
-	services.StartCleanupJob()
-
-	// creating repositories
-	authRepository := repositories.NewAuthRepository(db.Pool)
-	projectRepository := repositories.NewProjectRepository(db.Pool)
-	deploymentRepository := repositories.NewDeploymentRepository(db.Pool)
-
-	// creating services
-	authService := services.NewAuthService(authRepository)
-	projectService := services.NewProjectService(projectRepository)
-	builderService := services.NewBuilderService(logStreamer)
-	deploymentService := services.NewDeploymentService(deploymentRepository, projectRepository, builderService, logStreamer)
-
-	// creating handlers and injecting services into them
-	authHandler := handlers.AuthHandler{Service: authService}
-	projectHandler := handlers.ProjectHandler{Service: projectService}
-	logStreamHandler := handlers.LogStreamHandler{LogStreamer: logStreamer}
-	deploymentHandler := handlers.DeploymentHandler{Service: deploymentService}
-
-	// public routes
-	r.Post(serverConfig.LoginAPI, authHandler.HandleLogin)
-	r.Post(serverConfig.SignupAPI, authHandler.HandleSignup)
-	r.Get(serverConfig.GoogleLoginAPI, authHandler.HandleGoogleLogin)
-	r.Get(serverConfig.GoogleCallbackAPI, authHandler.HandleGoogleCallback)
-	r.Get(serverConfig.GithubLoginAPI, authHandler.HandleGithubLogin)
-	r.Get(serverConfig.GithubCallbackAPI, authHandler.HandleGithubCallback)
-	r.Get(serverConfig.LogoutAPI, handlers.HandleLogout)
-
-	// protected routes
-	r.Group(func(r chi.Router) {
-		r.Use(middlewares.AuthZMiddleware)
-		r.Use(middlewares.AuthNMiddleware)
-
-		// add protected routes here
-		// project handler
-		r.Post(serverConfig.ProjectAPI, projectHandler.HandleCreateProject)
-		r.Get(serverConfig.ProjectAPI, projectHandler.HandleListProjects)
-		r.Get(serverConfig.UpdateProjectAPI, projectHandler.HandleGetProject)
-		r.Delete(serverConfig.UpdateProjectAPI, projectHandler.HandleDeleteProject)
-
-		// log streamer
-		r.Get(serverConfig.StreamLogsAPI, logStreamHandler.HandlerLogStream)
-
-		// deployment handler
-		// adding rate limit to the trigger deployment
-		r.Post(serverConfig.TriggerDeploymentAPI,
-			middlewares.RateLimitMiddleware(
-				http.HandlerFunc(deploymentHandler.HandleTriggerDeployment),
-			).ServeHTTP,
-		)
-		r.Get(serverConfig.GetDeploymentAPI, deploymentHandler.HandleGetDeployment)
-		r.Get(serverConfig.ListDeploymentsAPI, deploymentHandler.HandleListDeployments)
-		r.Delete(serverConfig.DeleteDeploymentAPI, deploymentHandler.HandleDeleteDeployment)
-	})
-
-	// Serve frontend static files
-	frontendDir := "./frontend/dist"
-	fs := http.FileServer(http.Dir(frontendDir))
-	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		// Try to serve the file directly
-		path := frontendDir + r.URL.Path
-		if _, err := os.Stat(path); err == nil {
-			fs.ServeHTTP(w, r)
-			return
-		}
-		// SPA fallback — serve index.html for client-side routing
-		http.ServeFile(w, r, frontendDir+"/index.html")
-	})
+	// the collectors live on the process-wide registry served at /metrics,
+	// labelled with SERVICE_NAME so several deployments can share a backend
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"service": serverConfig.ServiceName}, prometheus.DefaultRegisterer)
+	err = middlewares.RegisterMetrics(registerer)
+	if err != nil {
+		slog.Error("Failed to register the HTTP metrics", slog.Any("Error", err))
+		os.Exit(1)
+	}
+	err = proxy.RegisterMetrics(registerer)
+	if err != nil {
+		slog.Error("Failed to register the upstream metrics", slog.Any("Error", err))
+		os.Exit(1)
+	}
+	err = server.RegisterMetrics(registerer)
+	if err != nil {
+		slog.Error("Failed to register the shutdown metrics", slog.Any("Error", err))
+		os.Exit(1)
+	}
 
-	server := &http.Server{
-		Addr:         serverConfig.Port,
-		Handler:      r,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 0,
-		IdleTimeout:  60 * time.Second,
+	relay, err := app.New(serverConfig)
+	if err != nil {
+		slog.Error("Failed to start, refusing to serve", slog.Any("Error", err))
+		os.Exit(1)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	forceExitOnSecondSignal()
 
-	go func() {
-		fmt.Printf("Relay Backend Server listening on PORT%s\n", server.Addr)
-		err := server.ListenAndServe()
-
-		if err != nil && err != http.ErrServerClosed {
-			slog.Error("Error while starting the Server:",
-				slog.Any("Error:", err),
-			)
-		}
-	}()
-
-	proxyServer := &http.Server{
-		Addr:    serverConfig.ProxyPort,
-		Handler: proxy.NewProxyHandler(deploymentRepository),
+	// orchestrators read a non-zero exit as an unclean shutdown
+	err = relay.Run(ctx)
+	if err != nil {
+		slog.Error("Server stopped uncleanly", slog.Any("Error", err))
+		stop()
+		os.Exit(1)
 	}
 
-	go func() {
-		slog.Info("Proxy server listening", slog.String("port", serverConfig.ProxyPort))
-		proxyServer.ListenAndServe()
-	}()
-
-	<-ctx.Done()
-
-	slog.Info("Shutdown Signal received, shutting down the backend server gracefully!")
+	slog.Info("Server Exited!")
+}
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// helper functions
 
-	err = server.Shutdown(shutdownCtx)
-	if err != nil {
-		slog.Error("Server forced to shutdown:",
-			slog.Any("Error", err),
-		)
-	}
+// forceExitOnSecondSignal leaves the first SIGINT or SIGTERM to start the
+// graceful shutdown, a second one exits right away without waiting for the
+// drain, for when the shutdown hangs
+func forceExitOnSecondSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	proxyServer.Shutdown(shutdownCtx)
-
-	slog.Info("Server Exited!")
+	go func() {
+		<-signals
+		received := <-signals
+		slog.Error("Second signal received, forcing exit without finishing the shutdown", slog.String("Signal", received.String()))
+		os.Exit(1)
+	}()
 }
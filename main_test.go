@@ -0,0 +1,90 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// the env var that makes the test binary play a server whose shutdown hangs
+const hangingShutdownEnv = "RELAY_TEST_HANGING_SHUTDOWN"
+
+func TestSecondSignalForcesExit(t *testing.T) {
+	if os.Getenv(hangingShutdownEnv) == "1" {
+		runHangingShutdown()
+		return
+	}
+
+	var stderr strings.Builder
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSecondSignalForcesExit$")
+	cmd.Env = append(os.Environ(), hangingShutdownEnv+"=1")
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	lines := bufio.NewScanner(stdout)
+
+	waitFor := func(line string) {
+		t.Helper()
+		for lines.Scan() {
+			if lines.Text() == line {
+				return
+			}
+		}
+		t.Fatalf("the server exited before printing %q: %s", line, stderr.String())
+	}
+
+	waitFor("serving")
+	cmd.Process.Signal(syscall.SIGTERM)
+	waitFor("shutting down")
+
+	// the first signal started a shutdown that never ends, the second one
+	// has to end the process anyway
+	cmd.Process.Signal(syscall.SIGTERM)
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			t.Errorf("the server exited with %v, want exit status 1", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server was still running 5s after the second signal")
+	}
+	if !strings.Contains(stderr.String(), "Second signal received, forcing exit") {
+		t.Errorf("the forced exit was not logged: %s", stderr.String())
+	}
+}
+
+// helper functions
+
+// runHangingShutdown wires the signals like main and then never finishes
+// its shutdown
+func runHangingShutdown() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	forceExitOnSecondSignal()
+	fmt.Println("serving")
+
+	<-ctx.Done()
+	fmt.Println("shutting down")
+	time.Sleep(time.Hour)
+}
@@ -0,0 +1,215 @@
+package middlewares
+
+import (
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+	"github.com/sash2721/Relay/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// AccessRule limits the requests under Path to Methods and to the tokens
+// carrying one of Roles, an empty list leaves that part open. Path matches
+// segment by segment with the wildcards of path.Match, a * segment standing
+// for any one segment, and a trailing /* for everything below like a chi
+// catch-all. It is tried against the chi route pattern the request matches
+// as well as its path, so /api/projects/{projectID} names the route itself
+type AccessRule struct {
+	Path    string   `yaml:"path"`
+	Methods []string `yaml:"methods"`
+	Roles   []string `yaml:"roles"`
+}
+
+type accessRulesFile struct {
+	Rules []AccessRule `yaml:"rules"`
+}
+
+// AccessRules enforces the rules of ACCESS_RULES_FILE, the first rule whose
+// path matches decides and a request no rule matches passes on
+type AccessRules struct {
+	rules []AccessRule
+}
+
+// LoadAccessRules reads the rules at path and reports every invalid rule at once
+func LoadAccessRules(path string) (*AccessRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the access rules file: %w", err)
+	}
+	defer file.Close()
+
+	var parsed accessRulesFile
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&parsed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access rules file %s: %w", path, err)
+	}
+
+	err = validateAccessRules(parsed.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access rules file %s: %w", path, err)
+	}
+
+	return &AccessRules{rules: parsed.Rules}, nil
+}
+
+// Middleware answers 405 with an Allow header for a method the rule doesn't
+// list and 403 for a token without one of its roles, a HEAD counts as a GET.
+// pattern returns the chi route pattern the request will match, empty for
+// none. Rules are a no-op while nil
+func (a *AccessRules) Middleware(pattern func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil || len(a.rules) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routePattern := pattern(r)
+			rule, ok := a.match(routePattern, r.URL.Path)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !rule.allowsMethod(r.Method) {
+				slog.Warn("Method not allowed by access rule",
+					slog.String("Method", r.Method),
+					slog.String("Path", r.URL.Path),
+					slog.String("Rule", rule.Path),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				w.Header().Set("Allow", strings.Join(rule.Methods, ", "))
+				errors.WriteError(w, http.StatusMethodNotAllowed, errors.CodeMethodNotAllowed, "Method not allowed")
+				return
+			}
+
+			if len(rule.Roles) > 0 {
+				role := tokenRole(r)
+				if !slices.Contains(rule.Roles, role) {
+					slog.Warn("Role not allowed by access rule",
+						slog.String("Method", r.Method),
+						slog.String("Path", r.URL.Path),
+						slog.String("Rule", rule.Path),
+						slog.String("Role", role),
+						slog.String("RequestID", RequestIDFromContext(r.Context())),
+					)
+					errors.WriteError(w, http.StatusForbidden, errors.CodeForbidden, "Insufficient permissions to access the resource")
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// helper functions
+
+func (a *AccessRules) match(routePattern string, requestPath string) (AccessRule, bool) {
+	for _, rule := range a.rules {
+		if (routePattern != "" && matchRulePath(rule.Path, routePattern)) || matchRulePath(rule.Path, requestPath) {
+			return rule, true
+		}
+	}
+	return AccessRule{}, false
+}
+
+func (rule AccessRule) allowsMethod(method string) bool {
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	return slices.Contains(rule.Methods, method)
+}
+
+// matchRulePath compares pattern to target one segment at a time
+func matchRulePath(pattern string, target string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	targetSegments := strings.Split(strings.Trim(target, "/"), "/")
+
+	for i, segment := range patternSegments {
+		// a trailing * takes whatever is left, nothing included
+		if segment == "*" && i == len(patternSegments)-1 {
+			return true
+		}
+		if i >= len(targetSegments) {
+			return false
+		}
+		ok, _ := path.Match(segment, targetSegments[i])
+		if !ok {
+			return false
+		}
+	}
+	return len(patternSegments) == len(targetSegments)
+}
+
+// tokenRole is the role of the request's login token, the same one AuthZ
+// checks, and empty without a valid token
+func tokenRole(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	// EventSource can't set headers, the SSE routes take it as a query param
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return ""
+	}
+
+	claims, err, _, _ := utils.ValidateToken(token)
+	if err != nil || claims == nil {
+		return ""
+	}
+	return claims.Role
+}
+
+// validateAccessRules upper-cases the methods so get and GET are the same rule
+func validateAccessRules(rules []AccessRule) error {
+	var problems []error
+
+	for i := range rules {
+		rule := &rules[i]
+		name := fmt.Sprintf("rule %d (%s)", i+1, rule.Path)
+
+		if !strings.HasPrefix(rule.Path, "/") {
+			problems = append(problems, fmt.Errorf("%s: path must start with /", name))
+		}
+		for _, segment := range strings.Split(rule.Path, "/") {
+			_, err := path.Match(segment, "")
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s: invalid wildcard in %q", name, segment))
+			}
+		}
+
+		if len(rule.Methods) == 0 && len(rule.Roles) == 0 {
+			problems = append(problems, fmt.Errorf("%s: at least one method or role is required", name))
+		}
+		for j, method := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(strings.TrimSpace(method))
+			if !slices.Contains(accessRuleMethods, rule.Methods[j]) {
+				problems = append(problems, fmt.Errorf("%s: unknown method %q", name, method))
+			}
+		}
+		for _, role := range rule.Roles {
+			if strings.TrimSpace(role) == "" {
+				problems = append(problems, fmt.Errorf("%s: roles must not be empty", name))
+			}
+		}
+	}
+
+	return stderrors.Join(problems...)
+}
+
+var accessRuleMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace,
+}
@@ -0,0 +1,101 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+const (
+	APIKeyHeader = "X-API-Key"
+
+	apiKeyKey contextKey = "apiKey"
+)
+
+// APIKeyMiddleware requires a key from keys in the X-API-Key header or as an
+// Authorization bearer token, paths in publicPaths skip the check, it is a
+// no-op when no key is configured
+func APIKeyMiddleware(keys []string, publicPaths ...string) func(http.Handler) http.Handler {
+	validKeys := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if key != "" {
+			validKeys = append(validKeys, []byte(key))
+		}
+	}
+
+	public := make(map[string]bool, len(publicPaths))
+	for _, path := range publicPaths {
+		public[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(validKeys) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if public[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := apiKeyFromRequest(r)
+			if key == "" {
+				slog.Warn("API key missing",
+					slog.String("Path", r.URL.Path),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				errors.WriteError(w, http.StatusUnauthorized, errors.CodeUnauthenticated, "API key required")
+				return
+			}
+
+			if !matchAPIKey(validKeys, key) {
+				slog.Warn("Invalid API key",
+					slog.String("Path", r.URL.Path),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				errors.WriteError(w, http.StatusForbidden, errors.CodeForbidden, "Invalid API key")
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), apiKeyKey, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// helper functions
+
+// apiKeyFromContext returns the key APIKeyMiddleware accepted, "" when the
+// request went through without one
+func apiKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(apiKeyKey).(string)
+	return key
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// matchAPIKey compares against every key so the time taken does not reveal
+// which key, if any, matched
+func matchAPIKey(validKeys [][]byte, key string) bool {
+	candidate := []byte(key)
+	matched := 0
+	for _, validKey := range validKeys {
+		matched |= subtle.ConstantTimeCompare(validKey, candidate)
+	}
+	return matched == 1
+}
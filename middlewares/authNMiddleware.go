@@ -23,9 +23,7 @@ func AuthNMiddleware(next http.Handler) http.Handler {
 			slog.Warn("Authorization header missing in AuthN check",
 				slog.String("Path", r.URL.Path),
 			)
-			errJson, badRequestError := errors.NewBadRequestError("Invalid Request, auth token not present", nil)
-			w.WriteHeader(badRequestError.Code)
-			w.Write(errJson)
+			errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, "Invalid Request, auth token not present")
 			return
 		}
 
@@ -40,11 +38,7 @@ func AuthNMiddleware(next http.Handler) http.Handler {
 				slog.String("Role", userRole),
 				slog.String("Path", requestPath),
 			)
-			errJson, unauthorizedError := errors.NewUnauthorizedError(
-				"Insufficient permissions to access the resource", nil,
-			)
-			w.WriteHeader(unauthorizedError.Code)
-			w.Write(errJson)
+			errors.WriteError(w, http.StatusForbidden, errors.CodeForbidden, "Insufficient permissions to access the resource")
 			return
 		}
 
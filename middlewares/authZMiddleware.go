@@ -25,30 +25,26 @@ func AuthZMiddleware(next http.Handler) http.Handler {
 			slog.Warn("Authorization header missing",
 				slog.String("Path", r.URL.Path),
 			)
-			errJson, badRequestError := errors.NewBadRequestError("Invalid Request, auth token not present", nil)
-			w.WriteHeader(badRequestError.Code)
-			w.Write(errJson)
+			errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, "Invalid Request, auth token not present")
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authzToken, "Bearer ")
 
-		userInfo, err, errJson, errorCode := utils.ValidateToken(tokenString)
+		userInfo, err, _, errorCode := utils.ValidateToken(tokenString)
 
 		if err != nil {
 			if errorCode == http.StatusInternalServerError {
 				slog.Error("Token validation failed due to internal error",
 					slog.String("Path", r.URL.Path),
 				)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write(errJson)
+				errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternal, "Internal Server Error")
 				return
 			} else if errorCode == http.StatusBadRequest {
 				slog.Warn("Invalid token provided",
 					slog.String("Path", r.URL.Path),
 				)
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write(errJson)
+				errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, "Invalid or expired token")
 				return
 			}
 		}
@@ -0,0 +1,69 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// BodyLimiter caps request bodies at a default limit, with larger or smaller
+// limits for the path prefixes of routes that need them
+type BodyLimiter struct {
+	limit     int64
+	overrides map[string]int64
+}
+
+func NewBodyLimiter(limit int64) *BodyLimiter {
+	return &BodyLimiter{
+		limit:     limit,
+		overrides: make(map[string]int64),
+	}
+}
+
+// Override sets the limit for every path under prefix, the longest matching
+// prefix wins, it must be called before the server starts
+func (l *BodyLimiter) Override(prefix string, limit int64) {
+	l.overrides[prefix] = limit
+}
+
+// Middleware rejects a request that declares a larger Content-Length with 413
+// straight away, reading past the limit fails with *http.MaxBytesError
+func (l *BodyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := l.limitFor(r.URL.Path)
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			slog.Warn("Request body too large",
+				slog.String("Path", r.URL.Path),
+				slog.Int64("ContentLength", r.ContentLength),
+				slog.Int64("Limit", limit),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+			)
+			w.Header().Set("Connection", "close")
+			errors.WriteError(w, http.StatusRequestEntityTooLarge, errors.CodePayloadTooLarge, "Request body too large")
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// helper function
+func (l *BodyLimiter) limitFor(path string) int64 {
+	limit := l.limit
+	longest := -1
+	for prefix, prefixLimit := range l.overrides {
+		if len(prefix) > longest && strings.HasPrefix(path, prefix) {
+			limit = prefixLimit
+			longest = len(prefix)
+		}
+	}
+	return limit
+}
@@ -0,0 +1,196 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+const redacted = "[REDACTED]"
+
+// BodyLoggingMiddleware logs the request and response bodies of the paths
+// under cfg.BodyLogPaths, only while the log level is debug. The bodies are
+// captured as they stream through, up to cfg.BodyLogMaxBytes each, so the
+// handler and the client still get all of it. JSON fields named in
+// cfg.BodyLogRedactFields are masked before logging
+func BodyLoggingMiddleware(cfg *configs.ServerConfig) func(http.Handler) http.Handler {
+	prefixes := cfg.BodyLogPaths
+	maxBytes := cfg.BodyLogMaxBytes
+	redact := make(map[string]bool, len(cfg.BodyLogRedactFields))
+	for _, field := range cfg.BodyLogRedactFields {
+		redact[strings.ToLower(field)] = true
+	}
+	redactPattern := redactFieldsPattern(cfg.BodyLogRedactFields)
+
+	return func(next http.Handler) http.Handler {
+		if len(prefixes) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// checked per request, the level can change at runtime
+			if !slog.Default().Enabled(r.Context(), slog.LevelDebug) || !matchesPrefix(r.URL.Path, prefixes) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var requestBody *capture
+			if r.Body != nil && r.Body != http.NoBody {
+				requestBody = &capture{limit: maxBytes}
+				r.Body = &captureReader{ReadCloser: r.Body, capture: requestBody}
+			}
+			cw := &captureWriter{ResponseWriter: w, capture: capture{limit: maxBytes}, statusCode: http.StatusOK}
+
+			next.ServeHTTP(cw, r)
+
+			attrs := []slog.Attr{
+				slog.String("Method", r.Method),
+				slog.String("Path", r.URL.Path),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+				slog.Int("StatusCode", cw.statusCode),
+			}
+			if requestBody != nil {
+				attrs = append(attrs, slog.String("RequestBody", requestBody.format(r.Header, redact, redactPattern)))
+			}
+			attrs = append(attrs, slog.String("ResponseBody", cw.capture.format(w.Header(), redact, redactPattern)))
+
+			slog.LogAttrs(context.Background(), slog.LevelDebug, "Request bodies", attrs...)
+		})
+	}
+}
+
+// capture keeps the first limit bytes of a body and counts the rest
+type capture struct {
+	limit int
+	body  []byte
+	total int
+}
+
+func (c *capture) add(b []byte) {
+	c.total += len(b)
+	if room := c.limit - len(c.body); room > 0 {
+		c.body = append(c.body, b[:min(room, len(b))]...)
+	}
+}
+
+type captureReader struct {
+	io.ReadCloser
+	capture *capture
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.capture.add(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	capture     capture
+	statusCode  int
+	wroteHeader bool
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if !cw.wroteHeader && code >= http.StatusOK {
+		cw.wroteHeader = true
+		cw.statusCode = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	n, err := cw.ResponseWriter.Write(b)
+	cw.capture.add(b[:n])
+	return n, err
+}
+
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// helper functions
+
+func matchesPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// format renders the captured body for the log line, JSON is redacted field
+// by field and a truncated or invalid document falls back to the pattern
+func (c *capture) format(header http.Header, redact map[string]bool, pattern *regexp.Regexp) string {
+	if c.total == 0 {
+		return ""
+	}
+	if header.Get("Content-Encoding") != "" || !utf8.Valid(c.body) {
+		return "<" + strconv.Itoa(c.total) + " bytes, not logged>"
+	}
+
+	body := string(c.body)
+	if strings.Contains(header.Get("Content-Type"), "json") && len(redact) > 0 {
+		var document any
+		if c.total == len(c.body) && json.Unmarshal(c.body, &document) == nil {
+			if masked, err := json.Marshal(redactJSON(document, redact)); err == nil {
+				body = string(masked)
+			}
+		} else if pattern != nil {
+			body = pattern.ReplaceAllString(body, `${1}"`+redacted+`"`)
+		}
+	}
+
+	if c.total > len(c.body) {
+		body += "... (" + strconv.Itoa(c.total) + " bytes)"
+	}
+	return body
+}
+
+func redactJSON(value any, redact map[string]bool) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if redact[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(field, redact)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactJSON(item, redact)
+		}
+	}
+	return value
+}
+
+// matches "field": "string value" for the redacted fields, used when the body
+// can't be parsed
+func redactFieldsPattern(fields []string) *regexp.Regexp {
+	if len(fields) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = regexp.QuoteMeta(field)
+	}
+	return regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+}
@@ -0,0 +1,78 @@
+package middlewares
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BodyReadTimeoutMiddleware gives the request body its own read deadline,
+// timeout from the moment the handler chain reaches it instead of the
+// server's READ_TIMEOUT, so an upload route can take longer than the rest.
+// The deadline is cleared once the body is read to the end or closed, the
+// response is never cut off by it. The streams StreamDeadlineMiddleware lifts
+// the deadlines off are left alone, as is everything while timeout is 0
+func BodyReadTimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody || r.Header.Get("Upgrade") != "" || acceptsEventStream(r) || isGRPC(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			controller := http.NewResponseController(w)
+			err := controller.SetReadDeadline(time.Now().Add(timeout))
+			if err != nil {
+				slog.Debug("Failed to set the body read deadline",
+					slog.String("Path", r.URL.Path),
+					slog.Any("Error", err),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body := &deadlineBody{ReadCloser: r.Body, controller: controller}
+			r.Body = body
+			next.ServeHTTP(w, r)
+			// the controller is off limits once the handler returned, a body
+			// closed later by the transport leaves the deadline to the server
+			body.once.Do(func() {})
+		})
+	}
+}
+
+// deadlineBody clears the read deadline once the body is done, the server's
+// background read would otherwise cancel the request context when it passes
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	once       sync.Once
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.clear()
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.clear()
+	return b.ReadCloser.Close()
+}
+
+// helper functions
+
+func (b *deadlineBody) clear() {
+	b.once.Do(func() {
+		b.controller.SetReadDeadline(time.Time{})
+	})
+}
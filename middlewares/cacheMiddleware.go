@@ -0,0 +1,327 @@
+package middlewares
+
+import (
+	"container/list"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache keeps GET responses in memory for as long as the upstream's
+// Cache-Control max-age allows, evicting the least recently used entry once
+// the bodies outgrow maxBytes
+type ResponseCache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+	entries   map[string]*list.Element
+	lru       *list.List
+	// the Vary header names last seen for a method+URL, dropped with the
+	// last of its variants
+	vary map[string]*cacheVary
+}
+
+type cacheVary struct {
+	names    []string
+	variants int
+}
+
+type cacheEntry struct {
+	baseKey    string
+	key        string
+	statusCode int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+}
+
+func NewResponseCache(maxBytes int64) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		vary:     make(map[string]*cacheVary),
+	}
+}
+
+// Middleware serves cached GET responses with X-Cache: HIT and stores
+// cacheable ones with X-Cache: MISS, a nil cache or a zero size disables it
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	if c == nil || c.maxBytes <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		baseKey := r.Method + " " + r.URL.RequestURI()
+		if entry, ok := c.get(baseKey, r); ok {
+			header := w.Header()
+			for key, values := range entry.header {
+				header[key] = values
+			}
+			header.Set("X-Cache", "HIT")
+			header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+			w.WriteHeader(entry.statusCode)
+			w.Write(entry.body)
+			return
+		}
+
+		// headers the outer middlewares set belong to this request, not the entry
+		outerHeader := w.Header().Clone()
+
+		cw := &cacheWriter{ResponseWriter: w, limit: c.maxBytes, statusCode: http.StatusOK}
+		next.ServeHTTP(cw, r)
+
+		if cw.overflow {
+			return
+		}
+		ttl, ok := cacheTTL(r, cw.statusCode, w.Header())
+		if !ok {
+			return
+		}
+		c.put(baseKey, r, &cacheEntry{
+			statusCode: cw.statusCode,
+			header:     cacheableHeader(outerHeader, w.Header()),
+			body:       cw.body,
+			stored:     time.Now(),
+			expires:    time.Now().Add(ttl),
+		})
+	})
+}
+
+// cacheWriter passes the response through and keeps a copy of the body
+// while it fits in the cache
+type cacheWriter struct {
+	http.ResponseWriter
+	limit       int64
+	statusCode  int
+	wroteHeader bool
+	body        []byte
+	overflow    bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if code < http.StatusOK || cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	cw.statusCode = code
+	// an event stream never ends, there is nothing to cache
+	if strings.HasPrefix(cw.ResponseWriter.Header().Get("Content-Type"), "text/event-stream") {
+		cw.overflow = true
+	}
+	cw.ResponseWriter.Header().Set("X-Cache", "MISS")
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if int64(len(cw.body)+len(b)) > cw.limit {
+			cw.overflow = true
+			cw.body = nil
+		} else {
+			cw.body = append(cw.body, b...)
+		}
+	}
+
+	n, err := cw.ResponseWriter.Write(b)
+	if err != nil {
+		// a body the client didn't get in full is not cached either
+		cw.overflow = true
+	}
+	return n, err
+}
+
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// helper functions
+
+func (c *ResponseCache) get(baseKey string, r *http.Request) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vary, ok := c.vary[baseKey]
+	if !ok {
+		return nil, false
+	}
+	element, ok := c.entries[variantKey(baseKey, vary.names, r)]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+func (c *ResponseCache) put(baseKey string, r *http.Request, entry *cacheEntry) {
+	names := varyNames(entry.header)
+	entry.baseKey = baseKey
+	entry.key = variantKey(baseKey, names, r)
+	size := entrySize(entry)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.removeLocked(element)
+	}
+	vary, ok := c.vary[baseKey]
+	if !ok {
+		vary = &cacheVary{}
+		c.vary[baseKey] = vary
+	}
+	vary.names = names
+	vary.variants++
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.usedBytes += size
+
+	for c.usedBytes > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *ResponseCache) removeLocked(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.usedBytes -= entrySize(entry)
+
+	// memory stays within maxBytes however many URLs were ever cached
+	if vary := c.vary[entry.baseKey]; vary != nil {
+		vary.variants--
+		if vary.variants <= 0 {
+			delete(c.vary, entry.baseKey)
+		}
+	}
+}
+
+// cacheTTL returns how long the response may be served from the cache, never
+// for errors, cookies, private or no-store responses or Vary: *. The cache
+// key ignores credentials, so an answer to a request carrying them is only
+// kept when public
+func cacheTTL(r *http.Request, statusCode int, header http.Header) (time.Duration, bool) {
+	if statusCode < 200 || statusCode > 299 {
+		return 0, false
+	}
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return 0, false
+	}
+
+	var maxAge, sharedMaxAge time.Duration = -1, -1
+	public := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "public":
+			public = true
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sharedMaxAge = parseSeconds(value)
+		}
+	}
+
+	// an authenticated answer is only shared when the upstream says so
+	if (r.Header.Get("Authorization") != "" || r.Header.Get(APIKeyHeader) != "") && !public {
+		return 0, false
+	}
+
+	if sharedMaxAge > 0 {
+		return sharedMaxAge, true
+	}
+	if maxAge > 0 {
+		return maxAge, true
+	}
+	return 0, false
+}
+
+func parseSeconds(value string) time.Duration {
+	seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheableHeader copies the headers the handler set, outer holds the ones
+// that were already there before it ran
+func cacheableHeader(outer http.Header, header http.Header) http.Header {
+	cached := make(http.Header, len(header))
+	for key, values := range header {
+		if slices.Equal(outer[key], values) {
+			continue
+		}
+		cached[key] = slices.Clone(values)
+	}
+	cached.Del("X-Cache")
+	cached.Del("Age")
+	return cached
+}
+
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func variantKey(baseKey string, names []string, r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(baseKey)
+	for _, name := range names {
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(": ")
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+func entrySize(entry *cacheEntry) int64 {
+	size := int64(len(entry.key) + len(entry.body))
+	for key, values := range entry.header {
+		size += int64(len(key))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
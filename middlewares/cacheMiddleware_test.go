@@ -0,0 +1,131 @@
+package middlewares
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseCacheEvictionKeepsAccountingConsistent(t *testing.T) {
+	cache := NewResponseCache(4 << 10)
+	handler := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, fmt.Sprintf("%0512d", 0))
+	}))
+
+	// far more URLs and variants than fit, each one evicting an older entry
+	for i := range 200 {
+		for _, language := range []string{"en", "de"} {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/items/%d", i), nil)
+			req.Header.Set("Accept-Language", language)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		checkCacheAccounting(t, cache)
+	}
+
+	// a URL whose variants were all evicted keeps no Vary entry
+	if _, ok := cache.vary["GET /items/0"]; ok {
+		t.Errorf("the evicted /items/0 still has a Vary entry, %d for %d responses", len(cache.vary), len(cache.entries))
+	}
+}
+
+func TestResponseCacheExpiryDropsVary(t *testing.T) {
+	cache := NewResponseCache(1 << 20)
+	handler := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "cached")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/report", nil))
+
+	// the entry expires and is dropped on the next lookup
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		entry.expires = entry.stored
+	}
+	if _, ok := cache.get("GET /report", httptest.NewRequest(http.MethodGet, "/report", nil)); ok {
+		t.Fatal("an expired entry was served")
+	}
+	checkCacheAccounting(t, cache)
+	if len(cache.vary) != 0 || cache.usedBytes != 0 {
+		t.Errorf("after the expiry %d Vary entries and %d bytes are left", len(cache.vary), cache.usedBytes)
+	}
+}
+
+func TestResponseCacheSkipsCredentials(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		cacheControl string
+		shared       bool
+	}{
+		{name: "anonymous", cacheControl: "max-age=60", shared: true},
+		{name: "authorization", header: "Authorization", cacheControl: "max-age=60"},
+		{name: "api key", header: APIKeyHeader, cacheControl: "max-age=60"},
+		{name: "api key public", header: APIKeyHeader, cacheControl: "public, max-age=60", shared: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewResponseCache(1 << 20)
+			handler := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				io.WriteString(w, "private to "+r.Header.Get(tt.header))
+			}))
+
+			request := func(credential string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/account", nil)
+				if tt.header != "" {
+					req.Header.Set(tt.header, credential)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return rec
+			}
+
+			request("client-a")
+			rec := request("client-b")
+			if got := rec.Header().Get("X-Cache") == "HIT"; got != tt.shared {
+				t.Errorf("second client X-Cache = %q, want shared %v", rec.Header().Get("X-Cache"), tt.shared)
+			}
+			if !tt.shared && rec.Body.String() != "private to client-b" {
+				t.Errorf("client B got %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+// helper functions
+
+// checkCacheAccounting compares usedBytes and the Vary counts to the entries
+// actually held
+func checkCacheAccounting(t *testing.T, cache *ResponseCache) {
+	t.Helper()
+	var used int64
+	variants := make(map[string]int)
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		used += entrySize(entry)
+		variants[entry.baseKey]++
+	}
+
+	if used != cache.usedBytes {
+		t.Fatalf("usedBytes = %d, the entries hold %d", cache.usedBytes, used)
+	}
+	if cache.usedBytes > cache.maxBytes {
+		t.Fatalf("usedBytes = %d over maxBytes %d", cache.usedBytes, cache.maxBytes)
+	}
+	if len(cache.entries) != cache.lru.Len() {
+		t.Fatalf("%d entries indexed, %d in the LRU list", len(cache.entries), cache.lru.Len())
+	}
+	if len(cache.vary) != len(variants) {
+		t.Fatalf("%d Vary entries for %d cached URLs", len(cache.vary), len(variants))
+	}
+	for baseKey, vary := range cache.vary {
+		if vary.variants != variants[baseKey] {
+			t.Fatalf("Vary of %s counts %d variants, %d are cached", baseKey, vary.variants, variants[baseKey])
+		}
+	}
+}
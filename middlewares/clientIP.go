@@ -0,0 +1,86 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// peers whose X-Forwarded-For and X-Real-IP headers are believed, empty
+// means the headers are always ignored
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// SetTrustedProxies replaces the proxies ClientIP takes forwarding headers from
+func SetTrustedProxies(prefixes []netip.Prefix) {
+	trustedProxies.Store(&prefixes)
+}
+
+// ClientIP returns the address of the client that sent r. X-Forwarded-For
+// and X-Real-IP are only honored when the immediate peer is a trusted proxy,
+// anyone else gets RemoteAddr so the headers can't be spoofed
+func ClientIP(r *http.Request) net.IP {
+	addr := clientAddr(r)
+	if !addr.IsValid() {
+		return nil
+	}
+	return net.IP(addr.AsSlice())
+}
+
+// helper functions
+
+func clientAddr(r *http.Request) netip.Addr {
+	peer, err := netip.ParseAddr(remoteIP(r))
+	if err != nil {
+		return netip.Addr{}
+	}
+	peer = peer.Unmap()
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	// walk the chain from the nearest hop, the first untrusted address is the
+	// client, the hops left of it could have been written by anyone
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap()
+	}
+	return peer
+}
+
+// forwardedFor parses every X-Forwarded-For hop, a value that is not an IP
+// drops everything left of it
+func forwardedFor(r *http.Request) []netip.Addr {
+	var hops []netip.Addr
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(value, ",") {
+			hop, err := netip.ParseAddr(strings.TrimSpace(part))
+			if err != nil {
+				hops = hops[:0]
+				continue
+			}
+			hops = append(hops, hop.Unmap())
+		}
+	}
+	return hops
+}
+
+func isTrustedProxy(ip netip.Addr) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	for _, prefix := range *prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
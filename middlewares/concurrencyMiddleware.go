@@ -0,0 +1,63 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sash2721/Relay/errors"
+)
+
+var concurrentRequests = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "http_concurrent_requests",
+		Help: "Requests holding a MAX_CONCURRENT_REQUESTS slot.",
+	},
+)
+
+// probes must keep answering while the server is saturated or draining
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// ConcurrencyLimitMiddleware caps the requests served at once at limit,
+// anything over it gets a 503 with Retry-After straight away instead of
+// queueing. A limit of 0 or less disables it
+func ConcurrencyLimitMiddleware(limit int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		slots := make(chan struct{}, limit)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if probePaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				slog.Warn("Concurrency limit reached, rejecting request",
+					slog.String("Method", r.Method),
+					slog.String("Path", r.URL.Path),
+					slog.Int("Limit", limit),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				w.Header().Set("Retry-After", "1")
+				errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeServiceUnavailable, "Server is at capacity, please retry")
+				return
+			}
+
+			concurrentRequests.Inc()
+			defer func() {
+				concurrentRequests.Dec()
+				<-slots
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package middlewares
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// ContentTypeMiddleware answers 415 to a request whose body isn't one of the
+// allowed media types. Parameters such as charset are ignored, application/*
+// allows every application type and */* anything. Requests without a body
+// pass, it is a no-op when nothing is allowed
+func ContentTypeMiddleware(allowed []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil && MatchMediaType(allowed, mediaType) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			slog.Warn("Unsupported request content type",
+				slog.String("Path", r.URL.Path),
+				slog.String("ContentType", r.Header.Get("Content-Type")),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+			)
+			w.Header().Set("Accept", strings.Join(allowed, ", "))
+			errors.WriteError(w, http.StatusUnsupportedMediaType, errors.CodeUnsupportedMediaType,
+				"Content-Type must be one of "+strings.Join(allowed, ", "))
+		})
+	}
+}
+
+// MatchMediaType reports whether mediaType, without parameters, is covered by
+// one of patterns, compared case-insensitively with type/* wildcards
+func MatchMediaType(patterns []string, mediaType string) bool {
+	kind, _, _ := strings.Cut(mediaType, "/")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "*/*" || pattern == mediaType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.TrimSuffix(pattern, "/*") == kind:
+			return true
+		}
+	}
+	return false
+}
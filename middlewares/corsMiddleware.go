@@ -0,0 +1,71 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+const corsMaxAge = "600"
+
+// CORSMiddleware answers preflight requests and sets the Access-Control-*
+// headers for the configured origins, it is a no-op when no origin is set
+func CORSMiddleware(cfg *configs.ServerConfig) func(http.Handler) http.Handler {
+	allowedOrigins := make(map[string]bool, len(cfg.CORSAllowedOrigins))
+	allowAnyOrigin := false
+	for _, origin := range cfg.CORSAllowedOrigins {
+		if origin == "*" {
+			allowAnyOrigin = true
+			continue
+		}
+		allowedOrigins[origin] = true
+	}
+
+	allowedMethods := strings.Join(cfg.CORSAllowedMethods, ", ")
+	allowedHeaders := strings.Join(cfg.CORSAllowedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		if len(cfg.CORSAllowedOrigins) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+
+			if !allowAnyOrigin && !allowedOrigins[origin] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if allowAnyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if cfg.CORSAllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if !isPreflight {
+				w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
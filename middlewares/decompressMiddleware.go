@@ -0,0 +1,103 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// DecompressMiddleware decodes the request bodies sent with a
+// Content-Encoding in encodings, gzip and deflate, so the handlers read them
+// plain. The decoded body is capped at maxBytes, reading past it fails with
+// *http.MaxBytesError like the body limit, so a small zip bomb never expands
+// in memory. Any other encoding passes through untouched, or gets 415 when
+// strict. It is a no-op while encodings is empty
+func DecompressMiddleware(encodings []string, maxBytes int64, strict bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(encodings) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !slices.Contains(encodings, encoding) {
+				if !strict {
+					next.ServeHTTP(w, r)
+					return
+				}
+				slog.Warn("Unsupported request content encoding",
+					slog.String("Path", r.URL.Path),
+					slog.String("ContentEncoding", r.Header.Get("Content-Encoding")),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				w.Header().Set("Accept-Encoding", strings.Join(encodings, ", "))
+				errors.WriteError(w, http.StatusUnsupportedMediaType, errors.CodeUnsupportedMediaType,
+					"Content-Encoding must be one of "+strings.Join(encodings, ", "))
+				return
+			}
+
+			decoded, err := decodeBody(encoding, r.Body)
+			if err != nil {
+				slog.Warn("Failed to decode the request body",
+					slog.String("Path", r.URL.Path),
+					slog.String("ContentEncoding", encoding),
+					slog.Any("Error", err),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, "Request body is not valid "+encoding)
+				return
+			}
+
+			var body io.ReadCloser = &decodedBody{Reader: decoded, compressed: r.Body}
+			if maxBytes > 0 {
+				body = http.MaxBytesReader(w, body, maxBytes)
+			}
+			r.Body = body
+			// the length on the wire says nothing about the decoded one
+			r.ContentLength = -1
+			r.Header.Del("Content-Length")
+			r.Header.Del("Content-Encoding")
+			r.GetBody = nil
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decodedBody reads the decoded bytes and closes the body they came from
+type decodedBody struct {
+	io.Reader
+	compressed io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	if closer, ok := b.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return b.compressed.Close()
+}
+
+// helper functions
+
+// decodeBody reads the header of a gzip or zlib stream right away, so a body
+// that isn't one at all is told apart from one that is cut short later
+func decodeBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	default:
+		// HTTP's deflate is the zlib format
+		return zlib.NewReader(body)
+	}
+}
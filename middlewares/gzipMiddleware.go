@@ -0,0 +1,219 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// content types that are already compressed or are streamed event by event
+var uncompressedTypePrefixes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/pdf",
+	"application/octet-stream",
+	"text/event-stream",
+}
+
+// GzipMiddleware compresses responses of at least minSize bytes for clients
+// that accept gzip, level is one of the compress/gzip levels
+func GzipMiddleware(minSize int, level int) func(http.Handler) http.Handler {
+	pool := &sync.Pool{
+		New: func() any {
+			gz, _ := gzip.NewWriterLevel(nil, level)
+			return gz
+		},
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a HEAD answer has no body to compress, its Content-Length stays
+			// the one of the plain body
+			if !acceptsGzip(r) || r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipResponseWriter{
+				ResponseWriter: w,
+				pool:           pool,
+				minSize:        minSize,
+				statusCode:     http.StatusOK,
+			}
+			defer gw.Close()
+
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// gzipResponseWriter buffers the start of the body until it knows whether the
+// response is worth compressing, the status and headers are held back with it
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	pool        *sync.Pool
+	minSize     int
+	statusCode  int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	// informational responses such as 101 go out as they are
+	if code < http.StatusOK {
+		gw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	gw.statusCode = code
+
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		gw.decide(false)
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	if !gw.decided {
+		if !gw.compressible() {
+			gw.decide(false)
+		} else {
+			gw.buf = append(gw.buf, b...)
+			if len(gw.buf) >= gw.minSize {
+				if err := gw.decide(true); err != nil {
+					return 0, err
+				}
+			}
+			return len(b), nil
+		}
+	}
+
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// Flush sends what is buffered so far, a response still under minSize is
+// sent uncompressed
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.decide(gw.compressible() && len(gw.buf) >= gw.minSize)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes out a response that never reached minSize and finishes the
+// gzip stream
+func (gw *gzipResponseWriter) Close() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gw.gz.Reset(nil)
+		gw.pool.Put(gw.gz)
+		gw.gz = nil
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// helper functions
+
+// decide writes the held back header, switching to gzip when compress is set,
+// and then the buffered body
+func (gw *gzipResponseWriter) decide(compress bool) error {
+	gw.decided = true
+	header := gw.ResponseWriter.Header()
+
+	// sniff before compressing, net/http would otherwise sniff the gzip bytes
+	if header.Get("Content-Type") == "" && len(gw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+
+	compress = compress && gw.compressible()
+	if gw.compressible() {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gw.gz = gw.pool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+
+	gw.ResponseWriter.WriteHeader(gw.statusCode)
+
+	if len(gw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buf)
+	}
+	gw.buf = nil
+	return err
+}
+
+func (gw *gzipResponseWriter) compressible() bool {
+	header := gw.ResponseWriter.Header()
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if gw.statusCode == http.StatusNoContent || gw.statusCode == http.StatusNotModified {
+		return false
+	}
+
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	for _, prefix := range uncompressedTypePrefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+
+		// gzip;q=0 means the client refuses it
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// responses bigger than this are not kept, a retry of one is forwarded again
+const maxIdempotentBodyBytes = 1 << 20
+
+// ErrIdempotencyInFlight is returned by Reserve while another request holds the key
+var ErrIdempotencyInFlight = stderrors.New("a request with this idempotency key is in flight")
+
+// StoredResponse is the response replayed for a repeated idempotency key
+type StoredResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// IdempotencyStore keeps the idempotency keys, memory by default, the
+// interface leaves room for a shared store such as Redis
+type IdempotencyStore interface {
+	// Reserve claims key for ttl, it returns the stored response when the key
+	// already completed and ErrIdempotencyInFlight while it is still running
+	Reserve(ctx context.Context, key string, ttl time.Duration) (*StoredResponse, error)
+	// Complete stores the response of a reserved key for ttl
+	Complete(ctx context.Context, key string, response *StoredResponse, ttl time.Duration) error
+	// Release drops a reserved key so the next request with it is forwarded
+	Release(ctx context.Context, key string) error
+}
+
+// Idempotency replays the response of a POST or PATCH for a repeated
+// Idempotency-Key instead of forwarding it again
+type Idempotency struct {
+	store IdempotencyStore
+	ttl   time.Duration
+}
+
+func NewIdempotency(store IdempotencyStore, ttl time.Duration) *Idempotency {
+	return &Idempotency{store: store, ttl: ttl}
+}
+
+// Middleware answers a key that is still running with a 409 and replays a
+// completed one with X-Idempotent-Replay: true. 5xx answers, oversized ones,
+// event streams and requests the client gave up on are not stored so the
+// client can retry them, a nil Idempotency disables it
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	if i == nil || i.store == nil || i.ttl <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := idempotencyStoreKey(r, idempotencyKey)
+		stored, err := i.store.Reserve(r.Context(), key, i.ttl)
+		switch {
+		case stderrors.Is(err, ErrIdempotencyInFlight):
+			errors.WriteError(w, http.StatusConflict, errors.CodeConflict, "A request with this Idempotency-Key is still in progress")
+			return
+		case err != nil:
+			// a store outage shouldn't take the relay down with it
+			slog.Error("Idempotency store failed, forwarding without it",
+				slog.Any("Error", err),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+			)
+			next.ServeHTTP(w, r)
+			return
+		case stored != nil:
+			header := w.Header()
+			for name, values := range stored.Header {
+				header[name] = values
+			}
+			header.Set("X-Idempotent-Replay", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		// the client's context may be gone by now, the store calls must still run
+		ctx := context.WithoutCancel(r.Context())
+		// the key is released unless the response was stored, a handler that
+		// panics must not hold it for the whole ttl
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := i.store.Release(ctx, key); err != nil {
+				slog.Error("Failed to release the idempotency key", slog.Any("Error", err))
+			}
+		}()
+
+		outerHeader := w.Header().Clone()
+		iw := &idempotencyWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(iw, r)
+
+		if iw.discard || iw.statusCode >= http.StatusInternalServerError || r.Context().Err() != nil {
+			return
+		}
+		err = i.store.Complete(ctx, key, &StoredResponse{
+			StatusCode: iw.statusCode,
+			Header:     cacheableHeader(outerHeader, w.Header()),
+			Body:       iw.body,
+		}, i.ttl)
+		if err != nil {
+			slog.Error("Failed to record the idempotency key", slog.Any("Error", err))
+			return
+		}
+		completed = true
+	})
+}
+
+// idempotencyWriter passes the response through and keeps a copy to replay
+type idempotencyWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        []byte
+	discard     bool
+}
+
+func (iw *idempotencyWriter) WriteHeader(code int) {
+	if code < http.StatusOK || iw.wroteHeader {
+		iw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	iw.wroteHeader = true
+	iw.statusCode = code
+	if strings.HasPrefix(iw.ResponseWriter.Header().Get("Content-Type"), "text/event-stream") {
+		iw.discard = true
+	}
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if !iw.discard {
+		if len(iw.body)+len(b) > maxIdempotentBodyBytes {
+			iw.discard = true
+			iw.body = nil
+		} else {
+			iw.body = append(iw.body, b...)
+		}
+	}
+
+	n, err := iw.ResponseWriter.Write(b)
+	if err != nil {
+		iw.discard = true
+	}
+	return n, err
+}
+
+func (iw *idempotencyWriter) Flush() {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (iw *idempotencyWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// MemoryIdempotencyStore keeps the keys of this instance in memory
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastPrune time.Time
+}
+
+// a nil response marks a key that is still in flight
+type idempotencyEntry struct {
+	response *StoredResponse
+	expires  time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries:   make(map[string]*idempotencyEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key string, ttl time.Duration) (*StoredResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > time.Minute {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expires) {
+		if entry.response == nil {
+			return nil, ErrIdempotencyInFlight
+		}
+		return entry.response, nil
+	}
+
+	s.entries[key] = &idempotencyEntry{expires: now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, response *StoredResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &idempotencyEntry{response: response, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// helper functions
+
+// keys are scoped to who sent the request and the endpoint, so two clients
+// picking the same key never see each other's responses. The identity is the
+// JWT subject or the API key the auth middleware accepted, the client IP,
+// resolved through TRUSTED_PROXIES only, when the route has no auth. No
+// header the client sends changes the scope on its own
+func idempotencyStoreKey(r *http.Request, idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(requestIdentity(r) + "\n" + r.Method + " " + r.URL.Path + "\n" + idempotencyKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func requestIdentity(r *http.Request) string {
+	if userID, _ := r.Context().Value("userID").(string); userID != "" {
+		return "user:" + userID
+	}
+	if key := apiKeyFromContext(r.Context()); key != "" {
+		return "key:" + key
+	}
+	return "ip:" + clientAddr(r).String()
+}
@@ -0,0 +1,112 @@
+package middlewares
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyReleasesKeyWhenHandlerPanics(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	var calls atomic.Int32
+	handler := NewIdempotency(store, 24*time.Hour).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("the handler's panic did not reach the caller")
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), newIdempotentRequest("order-1", ""))
+	}()
+
+	// the retry is forwarded instead of getting 409 for the rest of the day
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newIdempotentRequest("order-1", ""))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("retry after the panic = %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	// and once it completed, the next one is a replay
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newIdempotentRequest("order-1", ""))
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Idempotent-Replay") != "true" {
+		t.Errorf("third request = %d replay %q, want the stored 201", rec.Code, rec.Header().Get("X-Idempotent-Replay"))
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("the handler ran %d times, want 2", got)
+	}
+}
+
+func TestIdempotencyScopesKeysByIdentity(t *testing.T) {
+	var calls atomic.Int32
+	handler := APIKeyMiddleware([]string{"key-a", "key-b"})(
+		NewIdempotency(NewMemoryIdempotencyStore(), time.Hour).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "order "+strconv.Itoa(int(calls.Add(1))))
+		})),
+	)
+
+	send := func(apiKey string, remoteAddr string) string {
+		t.Helper()
+		req := newIdempotentRequest("order-1", apiKey)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	first := send("key-a", "203.0.113.7:4000")
+	// the same client from another address replays its response
+	if got := send("key-a", "198.51.100.20:5000"); got != first {
+		t.Errorf("key-a from a new IP got %q, want the replayed %q", got, first)
+	}
+	// another client behind the same NAT picking the same key does not
+	if got := send("key-b", "203.0.113.7:4000"); got == first {
+		t.Errorf("key-b was served key-a's response %q", got)
+	}
+}
+
+func TestRequestIdentity(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	if got := requestIdentity(req); got != "ip:203.0.113.7" {
+		t.Errorf("unauthenticated identity = %q, want the client IP", got)
+	}
+
+	// an API key header nothing verified doesn't pick the scope
+	req.Header.Set(APIKeyHeader, "key-a")
+	if got := requestIdentity(req); got != "ip:203.0.113.7" {
+		t.Errorf("unverified API key identity = %q, want the client IP", got)
+	}
+
+	withKey := req.WithContext(context.WithValue(req.Context(), apiKeyKey, "key-a"))
+	if got := requestIdentity(withKey); got != "key:key-a" {
+		t.Errorf("API key identity = %q", got)
+	}
+
+	withUser := withKey.WithContext(context.WithValue(withKey.Context(), "userID", "user-42"))
+	if got := requestIdentity(withUser); got != "user:user-42" {
+		t.Errorf("JWT identity = %q, want the subject", got)
+	}
+}
+
+// helper functions
+
+func newIdempotentRequest(idempotencyKey string, apiKey string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	if apiKey != "" {
+		req.Header.Set(APIKeyHeader, apiKey)
+	}
+	return req
+}
@@ -0,0 +1,69 @@
+package middlewares
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type InFlightRequest struct {
+	Method  string
+	Path    string
+	Started time.Time
+}
+
+// InFlightTracker keeps the requests currently being served so shutdown can
+// report the ones it had to cut off
+type InFlightTracker struct {
+	mu       sync.Mutex
+	nextID   atomic.Uint64
+	requests map[uint64]InFlightRequest
+}
+
+func NewInFlightTracker() *InFlightTracker {
+	return &InFlightTracker{
+		requests: make(map[uint64]InFlightRequest),
+	}
+}
+
+func (t *InFlightTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := t.nextID.Add(1)
+
+		t.mu.Lock()
+		t.requests[id] = InFlightRequest{
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Started: time.Now(),
+		}
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			delete(t.requests, id)
+			t.mu.Unlock()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Snapshot returns a copy of the requests in flight right now
+func (t *InFlightTracker) Snapshot() []InFlightRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]InFlightRequest, 0, len(t.requests))
+	for _, req := range t.requests {
+		snapshot = append(snapshot, req)
+	}
+	return snapshot
+}
+
+func (t *InFlightTracker) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.requests)
+}
@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/errors"
+)
+
+// IPFilter allows or denies requests by the client IP, a deny match always
+// wins and an empty allowlist lets every other address through
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPFilter parses allow and deny as CIDRs, a bare IP is taken as a single host
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+	allowPrefixes, err := configs.ParseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyPrefixes, err := configs.ParseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPFilter{allow: allowPrefixes, deny: denyPrefixes}, nil
+}
+
+// Allowed reports whether ip passes the deny and allow lists
+func (f *IPFilter) Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware answers 403 for disallowed addresses, a nil or empty filter lets
+// everything through
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	if f == nil || (len(f.allow) == 0 && len(f.deny) == 0) {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientAddr(r)
+		if !ip.IsValid() || !f.Allowed(ip) {
+			slog.Warn("Request from a disallowed IP",
+				slog.String("ClientIP", ip.String()),
+				slog.String("Path", r.URL.Path),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+			)
+			errors.WriteError(w, http.StatusForbidden, errors.CodeForbidden, "Access from this address is not allowed")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
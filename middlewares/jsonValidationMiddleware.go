@@ -0,0 +1,281 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// JSONSchema is the subset of JSON Schema the validator understands: type,
+// properties, required, additionalProperties, items, enum, minLength,
+// maxLength, minimum and maximum. Any other keyword is ignored
+type JSONSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+	Enum                 []any                  `json:"enum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+// the values of the type keyword
+var schemaTypes = []string{"", "object", "array", "string", "number", "integer", "boolean", "null"}
+
+// ParseJSONSchema reads a schema document and rejects types it can't check
+func ParseJSONSchema(raw []byte) (*JSONSchema, error) {
+	var schema JSONSchema
+	err := json.Unmarshal(raw, &schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	err = schema.check("$")
+	if err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// JSONValidator holds the schemas routes validate their bodies against, by
+// name. A route opts in with Middleware, a nil validator validates nothing
+type JSONValidator struct {
+	mu      sync.RWMutex
+	schemas map[string]*JSONSchema
+}
+
+func NewJSONValidator() *JSONValidator {
+	return &JSONValidator{schemas: make(map[string]*JSONSchema)}
+}
+
+// Register sets the schema of name, replacing the previous one
+func (v *JSONValidator) Register(name string, schema *JSONSchema) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.schemas[name] = schema
+}
+
+// Middleware answers 400 to a body that isn't JSON, or doesn't match the
+// schema registered as name when there is one, before the handler runs.
+// The body is buffered and handed on unchanged, requests without one pass
+func (v *JSONValidator) Middleware(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if v == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				var maxBytesError *http.MaxBytesError
+				if stderrors.As(err, &maxBytesError) {
+					errors.WriteError(w, http.StatusRequestEntityTooLarge, errors.CodePayloadTooLarge, "Request body too large")
+					return
+				}
+				errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, "Failed to read the request body")
+				return
+			}
+
+			err = v.validate(name, body)
+			if err != nil {
+				slog.Warn("Invalid JSON request body",
+					slog.String("Path", r.URL.Path),
+					slog.String("Schema", name),
+					slog.Any("Error", err),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, err.Error())
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+			r.ContentLength = int64(len(body))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// helper functions
+
+func (v *JSONValidator) validate(name string, body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value any
+	err := decoder.Decode(&value)
+	if err == nil && decoder.More() {
+		err = stderrors.New("unexpected data after the top-level value")
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid JSON body: %w", err)
+	}
+
+	v.mu.RLock()
+	schema := v.schemas[name]
+	v.mu.RUnlock()
+	if schema == nil {
+		return nil
+	}
+
+	err = schema.validate("$", value)
+	if err != nil {
+		return fmt.Errorf("Request body does not match the schema: %w", err)
+	}
+	return nil
+}
+
+// check walks the schema once at registration so validate never meets an
+// unknown type
+func (s *JSONSchema) check(path string) error {
+	if !slices.Contains(schemaTypes, s.Type) {
+		return fmt.Errorf("%s: unsupported schema type %q", path, s.Type)
+	}
+	for property, schema := range s.Properties {
+		if schema == nil {
+			return fmt.Errorf("%s.%s: schema must be an object", path, property)
+		}
+		err := schema.check(path + "." + property)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+// validate reports the first mismatch along with the path of the value, such
+// as $.items[2].name
+func (s *JSONSchema) validate(path string, value any) error {
+	if !s.matchesType(value) {
+		return fmt.Errorf("%s: must be of type %s", path, s.Type)
+	}
+	if len(s.Enum) > 0 && !s.inEnum(value) {
+		return fmt.Errorf("%s: must be one of the enum values", path)
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		for _, property := range s.Required {
+			if _, ok := value[property]; !ok {
+				return fmt.Errorf("%s.%s: is required", path, property)
+			}
+		}
+
+		// sorted so the same body always reports the same property
+		properties := make([]string, 0, len(value))
+		for property := range value {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+
+		for _, property := range properties {
+			schema, ok := s.Properties[property]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s: is not allowed", path, property)
+				}
+				continue
+			}
+			err := schema.validate(path+"."+property, value[property])
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range value {
+			err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)
+			if err != nil {
+				return err
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, *s.MaxLength)
+		}
+	case json.Number:
+		number, _ := value.Float64()
+		if s.Minimum != nil && number < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			return fmt.Errorf("%s: must be at most %v", path, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func (s *JSONSchema) matchesType(value any) bool {
+	switch s.Type {
+	case "":
+		return true
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := number.Int64()
+		return err == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// inEnum compares by the JSON encoding, so 1 and 1.0 are different values
+func (s *JSONSchema) inEnum(value any) bool {
+	encoded, _ := json.Marshal(value)
+	for _, allowed := range s.Enum {
+		candidate, _ := json.Marshal(allowed)
+		if bytes.Equal(encoded, candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package middlewares
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sash2721/Relay/errors"
+)
+
+const (
+	// the p99 is taken over the requests that finished this recently
+	loadShedWindow = 10 * time.Second
+	// and worked out again at most this often
+	loadShedInterval = time.Second
+	// the latest requests kept for it, older ones drop out once it is full
+	loadShedSamples = 1024
+	// fewer requests than this in the window never shed, too few for a p99
+	loadShedMinSamples = 20
+)
+
+var (
+	requestsShed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "Requests rejected with 503 because the p99 latency was over LOAD_SHED_TARGET_LATENCY.",
+		},
+	)
+
+	loadShedProbability = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_load_shed_probability",
+			Help: "Share of new requests currently shed, 0 while the p99 latency is on target.",
+		},
+	)
+)
+
+// LoadShedder rejects a share of the new requests with 503 while the p99
+// latency of the recent ones is over target, so the ones it lets in still
+// finish in time instead of every request timing out. The share grows with
+// how far the p99 is over target, by one percent of maxRate for every percent
+// over it, and is capped at maxRate
+type LoadShedder struct {
+	target  time.Duration
+	maxRate float64
+
+	mu          sync.Mutex
+	samples     []latencySample
+	next        int
+	probability float64
+	computedAt  time.Time
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+func NewLoadShedder(target time.Duration, maxRate float64) *LoadShedder {
+	return &LoadShedder{target: target, maxRate: maxRate}
+}
+
+// Middleware sheds nothing while target is 0. The probes, the health
+// endpoints and /admin are never shed, and neither the streams nor the
+// upgraded connections count towards the latency, they stay open for as long
+// as the client wants
+func (s *LoadShedder) Middleware(next http.Handler) http.Handler {
+	if s == nil || s.target <= 0 || s.maxRate <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthPath(r.URL.Path) || strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Upgrade") != "" || acceptsEventStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		probability := s.currentProbability()
+		if probability > 0 && rand.Float64() < probability {
+			requestsShed.Inc()
+			slog.Debug("Shedding request, latency over target",
+				slog.String("Method", r.Method),
+				slog.String("Path", r.URL.Path),
+				slog.Float64("Probability", probability),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+			)
+			w.Header().Set("Retry-After", "1")
+			errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeServiceUnavailable, "Server is overloaded, please retry")
+			return
+		}
+
+		started := time.Now()
+		next.ServeHTTP(w, r)
+		s.record(started, time.Since(started))
+	})
+}
+
+// helper functions
+
+func isHealthPath(path string) bool {
+	return probePaths[path] || path == "/health" || path == "/healthz/deep"
+}
+
+func (s *LoadShedder) record(started time.Time, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sample := latencySample{at: started.Add(duration), duration: duration}
+	if len(s.samples) < loadShedSamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % loadShedSamples
+}
+
+// currentProbability works the shed share out again once loadShedInterval
+// has passed, every request in between uses the last one
+func (s *LoadShedder) currentProbability() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.computedAt) < loadShedInterval {
+		return s.probability
+	}
+	s.computedAt = now
+
+	durations := make([]time.Duration, 0, len(s.samples))
+	for _, sample := range s.samples {
+		if now.Sub(sample.at) <= loadShedWindow {
+			durations = append(durations, sample.duration)
+		}
+	}
+
+	probability := 0.0
+	var p99 time.Duration
+	if len(durations) >= loadShedMinSamples {
+		slices.Sort(durations)
+		p99 = durations[(len(durations)*99-1)/100]
+		if p99 > s.target {
+			probability = min(s.maxRate, s.maxRate*float64(p99-s.target)/float64(s.target))
+		}
+	}
+
+	switch {
+	case probability > 0 && s.probability == 0:
+		slog.Warn("Latency over target, shedding load",
+			slog.Duration("P99", p99),
+			slog.Duration("Target", s.target),
+			slog.Float64("Probability", probability),
+		)
+	case probability == 0 && s.probability > 0:
+		slog.Info("Latency back on target, no longer shedding load", slog.Duration("Target", s.target))
+	}
+	s.probability = probability
+	loadShedProbability.Set(probability)
+	return probability
+}
@@ -1,14 +1,21 @@
 package middlewares
 
 import (
+	"context"
+	"hash/fnv"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"time"
+
+	"github.com/sash2721/Relay/configs"
 )
 
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -16,42 +23,134 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += n
+	return n, err
+}
+
 func (rw *responseWriter) Flush() {
 	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
 		f.Flush()
 	}
 }
 
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+// lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// probe endpoints are hit every few seconds, logging them only adds noise
+var unloggedPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// LoggingMiddleware runs right after RequestIDMiddleware so the latency covers
+// every other middleware as well as the handler. Responses below 400 are
+// sampled at cfg.AccessLogSampleRate by request ID, so a retried request with
+// the same X-Request-ID is logged or skipped consistently, 4xx and 5xx are
+// always logged. cfg.AccessLogFields picks the attributes of the log line
+func LoggingMiddleware(cfg *configs.ServerConfig) func(http.Handler) http.Handler {
+	fields := make(map[string]bool, len(cfg.AccessLogFields))
+	for _, field := range cfg.AccessLogFields {
+		fields[field] = true
+	}
+	sampleRate := cfg.AccessLogSampleRate
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if unloggedPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+
+			// Capturing the requestId from the context safely
+			var requestId string = "unknown"
+			if id := RequestIDFromContext(r.Context()); id != "" {
+				requestId = id
+			}
 
-		// Capturing the requestId from the context safely
-		var requestId string = "unknown"
-		if id, ok := r.Context().Value("requestID").(string); ok {
-			requestId = id
-		}
+			// Wrap the ResponseWriter
+			wrapped := &responseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
 
-		// Wrap the ResponseWriter
-		wrapped := &responseWriter{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
-		}
+			slog.Debug("Incoming Request",
+				slog.String("Method", r.Method),
+				slog.String("Path", r.URL.Path),
+				slog.String("RequestID", requestId),
+			)
 
-		slog.Info("Incoming Request",
-			slog.String("Method", r.Method),
-			slog.String("Path", r.URL.Path),
-			slog.String("RequestID", requestId),
-		)
+			next.ServeHTTP(wrapped, r)
 
-		next.ServeHTTP(wrapped, r)
+			duration := time.Since(start)
 
-		duration := time.Since(start)
+			level := slog.LevelInfo
+			if wrapped.statusCode >= http.StatusInternalServerError {
+				level = slog.LevelError
+			} else if wrapped.statusCode >= http.StatusBadRequest {
+				level = slog.LevelWarn
+			} else if !sampled(requestId, sampleRate) {
+				return
+			}
 
-		slog.Info("Completed Request",
-			slog.Int("StatusCode", wrapped.statusCode),
-			slog.Duration("Duration", duration),
-			slog.String("RequestID", requestId),
-		)
-	})
+			attrs := make([]slog.Attr, 0, len(fields))
+			if fields["method"] {
+				attrs = append(attrs, slog.String("Method", r.Method))
+			}
+			if fields["path"] {
+				attrs = append(attrs, slog.String("Path", r.URL.Path))
+			}
+			if fields["status"] {
+				attrs = append(attrs, slog.Int("StatusCode", wrapped.statusCode))
+			}
+			if fields["bytes"] {
+				attrs = append(attrs, slog.Int("Bytes", wrapped.bytesWritten))
+			}
+			if fields["remote_ip"] {
+				attrs = append(attrs, slog.String("RemoteIP", remoteIP(r)))
+			}
+			if fields["duration"] {
+				attrs = append(attrs, slog.Duration("Duration", duration))
+			}
+			if fields["request_id"] {
+				attrs = append(attrs, slog.String("RequestID", requestId))
+			}
+			if fields["user_agent"] {
+				attrs = append(attrs, slog.String("UserAgent", r.UserAgent()))
+			}
+
+			slog.LogAttrs(context.Background(), level, "Completed Request", attrs...)
+		})
+	}
+}
+
+// helper functions
+
+// sampled hashes the request ID into [0, 1) so the same ID always gets the
+// same answer for a given rate
+func sampled(requestID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(requestID))
+	return float64(hash.Sum64())/float64(math.MaxUint64) < rate
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
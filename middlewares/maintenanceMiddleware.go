@@ -0,0 +1,24 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// MaintenanceMiddleware answers every request with a 503 carrying message
+// while inMaintenance reports true. The probes and the /admin endpoints still
+// get through, so maintenance mode can be switched off again
+func MaintenanceMiddleware(inMaintenance func() bool, message string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !inMaintenance() || probePaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/admin/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeServiceUnavailable, message)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total HTTP requests by method, route pattern and status code.",
+		},
+		[]string{"method", "path", "status"},
+	)
+
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by method and route pattern.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method", "path"},
+	)
+
+	httpRequestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		},
+	)
+)
+
+// plain copies of http_requests_total and http_requests_in_flight, cheap to
+// read for /stats
+var (
+	requestsTotal    atomic.Uint64
+	requestsInFlight atomic.Int64
+)
+
+// RequestCounts returns the requests served since startup and the ones being
+// served right now
+func RequestCounts() (uint64, int64) {
+	return requestsTotal.Load(), requestsInFlight.Load()
+}
+
+// RegisterMetrics registers the HTTP metrics on the given registerer
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{httpRequestsTotal, httpRequestDuration, httpRequestsInFlight, concurrentRequests, requestsShed, loadShedProbability} {
+		err := registerer.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetricsMiddleware labels requests by the matched chi route pattern rather
+// than the raw URL so path parameters don't blow up the cardinality
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		httpRequestsInFlight.Inc()
+		requestsInFlight.Add(1)
+		defer func() {
+			httpRequestsInFlight.Dec()
+			requestsInFlight.Add(-1)
+		}()
+
+		wrapped := &responseWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+
+		next.ServeHTTP(wrapped, r)
+
+		path := "unmatched"
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil {
+			if pattern := routeContext.RoutePattern(); pattern != "" {
+				path = pattern
+			}
+		}
+
+		httpRequestsTotal.WithLabelValues(r.Method, path, strconv.Itoa(wrapped.statusCode)).Inc()
+		requestsTotal.Add(1)
+		httpRequestDuration.WithLabelValues(r.Method, path).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,135 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// trailing slash modes of PATH_TRAILING_SLASH
+const (
+	TrailingSlashKeep   = "keep"
+	TrailingSlashStrip  = "strip"
+	TrailingSlashEnsure = "ensure"
+)
+
+const originalPathKey contextKey = "originalPath"
+
+type originalPath struct {
+	path    string
+	rawPath string
+}
+
+// PathNormalizeMiddleware rewrites the path before any route is matched, so
+// /Api/Foo/ and /api/foo land on the same route. trailingSlash strips or
+// ensures the trailing slash, lowercase folds the ASCII letters. The path the
+// client sent is kept for RestoreOriginalPath
+func PathNormalizeMiddleware(trailingSlash string, lowercase bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !lowercase && (trailingSlash == "" || trailingSlash == TrailingSlashKeep) {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			normalized := normalizePath(r.URL.Path, trailingSlash, lowercase)
+			normalizedRaw := r.URL.RawPath
+			if normalizedRaw != "" {
+				normalizedRaw = normalizePath(normalizedRaw, trailingSlash, lowercase)
+			}
+			if normalized == r.URL.Path && normalizedRaw == r.URL.RawPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), originalPathKey, originalPath{path: r.URL.Path, rawPath: r.URL.RawPath})
+			r2 := r.WithContext(ctx)
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = normalized
+			r2.URL.RawPath = normalizedRaw
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// RestoreOriginalPath puts back the path the client sent before the relay
+// forwards it, when enabled. The prefix the request matched keeps the casing
+// of the route so stripping or rewriting it still works, the rest of the path
+// goes out as sent
+func RestoreOriginalPath(enabled bool, prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			original, ok := r.Context().Value(originalPathKey).(originalPath)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = restorePrefix(original.path, prefix)
+			r2.URL.RawPath = ""
+			if original.rawPath != "" {
+				r2.URL.RawPath = restorePrefix(original.rawPath, prefix)
+			}
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// helper functions
+
+func normalizePath(p string, trailingSlash string, lowercase bool) string {
+	if lowercase {
+		p = asciiLower(p)
+	}
+	if p == "/" || p == "" {
+		return p
+	}
+
+	switch trailingSlash {
+	case TrailingSlashStrip:
+		p = strings.TrimRight(p, "/")
+		if p == "" {
+			p = "/"
+		}
+	case TrailingSlashEnsure:
+		// a file name such as /app.js keeps its form so static assets resolve
+		if !strings.HasSuffix(p, "/") && !strings.Contains(path.Base(p), ".") {
+			p += "/"
+		}
+	}
+	return p
+}
+
+// asciiLower only folds A-Z, so the path keeps its length and a prefix can be
+// cut off the original by the length of the normalized one
+func asciiLower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+func restorePrefix(original string, prefix string) string {
+	if len(original) < len(prefix) || !strings.EqualFold(original[:len(prefix)], prefix) {
+		return original
+	}
+	return prefix + original[len(prefix):]
+}
@@ -1,9 +1,17 @@
 package middlewares
 
 import (
+	"context"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sash2721/Relay/errors"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -20,9 +28,7 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 
 		if ok && time.Since(lastDeploymentTime) < 2*time.Minute {
 			rateLimitMu.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusTooManyRequests)
-			w.Write([]byte(`{"code":429,"message":"Too many requests. Please wait 2 minutes between deployments."}`))
+			errors.WriteError(w, http.StatusTooManyRequests, errors.CodeRateLimited, "Too many requests. Please wait 2 minutes between deployments.")
 			return
 		}
 
@@ -32,3 +38,162 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+const (
+	clientLimiterIdleTTL  = 10 * time.Minute
+	clientLimiterPruneGap = time.Minute
+	// a slow store falls back to the local bucket instead of holding requests
+	rateLimitStoreTimeout = 100 * time.Millisecond
+	rateLimitStoreRetry   = time.Second
+)
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ClientRateLimiter is a token bucket per client IP. It runs ahead of any
+// API key check, so a key the client sends can't choose its bucket
+type ClientRateLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	limit     rate.Limit
+	burst     int
+	lastPrune time.Time
+	store     RateLimitStore
+	// set while store fails, so the fallback is logged once
+	storeDown    atomic.Bool
+	storeRetryAt atomic.Int64
+}
+
+// RateLimitStore keeps token buckets shared by every instance
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, refilled at rps up to
+	// burst, and returns how long to wait when it was empty
+	Take(ctx context.Context, key string, rps float64, burst int) (time.Duration, error)
+}
+
+func NewClientRateLimiter(rps float64, burst int) *ClientRateLimiter {
+	return &ClientRateLimiter{
+		clients:   make(map[string]*clientLimiter),
+		limit:     rate.Limit(rps),
+		burst:     burst,
+		lastPrune: time.Now(),
+	}
+}
+
+// SetLimit changes the rate and burst of every client at once, a rate of 0
+// lets every request through
+func (l *ClientRateLimiter) SetLimit(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = rate.Limit(rps)
+	l.burst = burst
+	for _, client := range l.clients {
+		client.limiter.SetLimit(l.limit)
+		client.limiter.SetBurst(l.burst)
+	}
+}
+
+// UseStore shares the buckets through store, such as RedisRateLimitStore, so
+// the limit holds across instances. While store fails the buckets of this
+// instance take over, the limit fails open rather than refusing everything
+func (l *ClientRateLimiter) UseStore(store RateLimitStore) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+}
+
+func (l *ClientRateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// an orchestrator polling the probes never uses up a client's bucket
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		delay, enabled := l.take(r.Context(), rateLimitKey(r))
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			errors.WriteError(w, http.StatusTooManyRequests, errors.CodeRateLimited, "Too many requests, please slow down.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// helper functions
+
+// take removes a token from the bucket of key and returns how long the client
+// has to wait when it was empty, false while the limit is off
+func (l *ClientRateLimiter) take(ctx context.Context, key string) (time.Duration, bool) {
+	l.mu.Lock()
+	limit, burst, store := l.limit, l.burst, l.store
+	l.mu.Unlock()
+
+	if limit <= 0 {
+		return 0, false
+	}
+
+	if store != nil && time.Now().UnixNano() >= l.storeRetryAt.Load() {
+		storeCtx, cancel := context.WithTimeout(ctx, rateLimitStoreTimeout)
+		delay, err := store.Take(storeCtx, key, float64(limit), burst)
+		cancel()
+		if err == nil {
+			if l.storeDown.Swap(false) {
+				slog.Info("Shared rate limit store is back, limiting across instances again")
+			}
+			return delay, true
+		}
+		// a store that is down isn't asked again for a while, so requests
+		// don't all wait out the timeout
+		l.storeRetryAt.Store(time.Now().Add(rateLimitStoreRetry).UnixNano())
+		if !l.storeDown.Swap(true) {
+			slog.Warn("Shared rate limit store unavailable, limiting per instance until it is back", slog.Any("Error", err))
+		}
+	}
+
+	reservation := l.limiterFor(key).Reserve()
+	delay := reservation.Delay()
+	if delay > 0 {
+		reservation.Cancel()
+	}
+	return delay, true
+}
+
+func (l *ClientRateLimiter) limiterFor(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// drop idle buckets so memory doesn't grow with every client ever seen
+	if now.Sub(l.lastPrune) > clientLimiterPruneGap {
+		for clientKey, client := range l.clients {
+			if now.Sub(client.lastSeen) > clientLimiterIdleTTL {
+				delete(l.clients, clientKey)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+
+	return client.limiter
+}
+
+func rateLimitKey(r *http.Request) string {
+	return "ip:" + clientAddr(r).String()
+}
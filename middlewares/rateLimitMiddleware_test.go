@@ -0,0 +1,52 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+func TestClientRateLimiterExemptsProbes(t *testing.T) {
+	limiter := NewClientRateLimiter(1, 1)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// the one token goes to the first API call
+	if rec := serveFrom(handler, "/api/deployments"); rec.Code != http.StatusOK {
+		t.Fatalf("first call = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// the same client polling the probes never gets limited
+	for _, path := range []string{"/healthz", "/readyz", "/healthz", "/readyz"} {
+		if rec := serveFrom(handler, path); rec.Code != http.StatusOK {
+			t.Errorf("%s = %d with the bucket empty, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+
+	rec := serveFrom(handler, "/api/deployments")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second call = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("the 429 has no Retry-After")
+	}
+	var body errors.ErrorResponse
+	err := json.NewDecoder(rec.Body).Decode(&body)
+	if err != nil || body.Error.Code != errors.CodeRateLimited {
+		t.Errorf("body = %+v, %v, want the %s envelope", body, err, errors.CodeRateLimited)
+	}
+}
+
+// helper functions
+
+func serveFrom(handler http.Handler, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "198.51.100.7:51234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// RecoveryMiddleware turns a handler panic into a 500 instead of dropping the
+// connection, it sits inside LoggingMiddleware so the 500 still gets logged
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// http.ErrAbortHandler is how handlers abort a response on purpose
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			slog.Error("Recovered from a panic in the handler",
+				slog.Any("Panic", recovered),
+				slog.String("Method", r.Method),
+				slog.String("Path", r.URL.Path),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+				slog.String("Stack", string(debug.Stack())),
+			)
+
+			errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternal, "Internal Server Error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisRateLimitPrefix = "relay:ratelimit:"
+
+// takeToken refills the bucket for the time since its last use on the clock
+// of redis, so instances with skewed clocks still agree, then takes a token.
+// It returns 1 and 0 when a token was left, 0 and the wait in ms otherwise.
+// An untouched bucket expires once it would be full again
+var takeToken = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// RedisRateLimitStore keeps the token buckets in redis so every instance
+// draws from the same ones, RATE_LIMIT_BACKEND=redis
+type RedisRateLimitStore struct {
+	client *redis.Client
+}
+
+// NewRedisRateLimitStore doesn't wait for redis to answer, the limiter falls
+// back to local buckets until it does
+func NewRedisRateLimitStore(url string) (*RedisRateLimitStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return &RedisRateLimitStore{client: redis.NewClient(options)}, nil
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, rps float64, burst int) (time.Duration, error) {
+	result, err := takeToken.Run(ctx, s.client, []string{redisRateLimitKey(key)}, rps, burst).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != 2 {
+		return 0, fmt.Errorf("unexpected rate limit script result %v", result)
+	}
+	if result[0] == 1 {
+		return 0, nil
+	}
+	return time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (s *RedisRateLimitStore) Close() error {
+	return s.client.Close()
+}
+
+// helper functions
+
+// only a hash of the client key goes to redis
+func redisRateLimitKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return redisRateLimitPrefix + hex.EncodeToString(sum[:])
+}
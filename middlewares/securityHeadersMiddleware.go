@@ -0,0 +1,64 @@
+package middlewares
+
+import (
+	"net/http"
+)
+
+// SecurityHeadersMiddleware sets headers on every response as it goes out,
+// relayed ones included since the upstream headers are copied in by then.
+// With deferToUpstream a header the handler or upstream already set is left
+// as it is, otherwise it is overwritten. It is a no-op without headers
+func SecurityHeadersMiddleware(headers map[string]string, deferToUpstream bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(headers) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&securityHeadersWriter{ResponseWriter: w, headers: headers, deferToUpstream: deferToUpstream}, r)
+		})
+	}
+}
+
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers         map[string]string
+	deferToUpstream bool
+	wroteHeader     bool
+}
+
+func (sw *securityHeadersWriter) WriteHeader(code int) {
+	// informational responses leave the final header still to come
+	if !sw.wroteHeader && code >= http.StatusOK {
+		sw.wroteHeader = true
+		header := sw.ResponseWriter.Header()
+		for name, value := range sw.headers {
+			if sw.deferToUpstream && header.Get(name) != "" {
+				continue
+			}
+			header.Set(name, value)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *securityHeadersWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *securityHeadersWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (sw *securityHeadersWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
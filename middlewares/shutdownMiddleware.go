@@ -0,0 +1,25 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// ShutdownMiddleware answers new requests with a 503 and Connection: close
+// once shuttingDown reports true, so load balancers move the client elsewhere
+// while the requests already past it finish. The probes still get through,
+// /readyz reports the shutdown on its own
+func ShutdownMiddleware(shuttingDown func() bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !shuttingDown() || probePaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Connection", "close")
+			errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeServiceUnavailable, "Server is shutting down")
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// SignatureMiddleware requires an HMAC-SHA256 of the raw body keyed with
+// secret in header, hex encoded after prefix (GitHub's X-Hub-Signature-256
+// sends "sha256=<hex>"). The body is read once and handed on unchanged, it is
+// a no-op without a secret
+func SignatureMiddleware(secret, header, prefix string) func(http.Handler) http.Handler {
+	key := []byte(secret)
+
+	return func(next http.Handler) http.Handler {
+		if len(key) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body []byte
+			if r.Body != nil {
+				var err error
+				body, err = io.ReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					var maxBytesError *http.MaxBytesError
+					if stderrors.As(err, &maxBytesError) {
+						errors.WriteError(w, http.StatusRequestEntityTooLarge, errors.CodePayloadTooLarge, "Request body too large")
+						return
+					}
+					errors.WriteError(w, http.StatusBadRequest, errors.CodeBadRequest, "Failed to read the request body")
+					return
+				}
+			}
+
+			if !validSignature(key, prefix, r.Header.Get(header), body) {
+				slog.Warn("Invalid request signature",
+					slog.String("Path", r.URL.Path),
+					slog.String("Header", header),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				errors.WriteError(w, http.StatusUnauthorized, errors.CodeUnauthenticated, "Invalid request signature")
+				return
+			}
+
+			// downstream gets the same bytes, and a replayable body for retries
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+			r.ContentLength = int64(len(body))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// helper functions
+
+// validSignature compares the MACs in constant time, a missing prefix or
+// malformed hex is a mismatch
+func validSignature(key []byte, prefix, signature string, body []byte) bool {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(signature), prefix)
+	if !ok {
+		return false
+	}
+	received, err := hex.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), received)
+}
@@ -0,0 +1,85 @@
+package middlewares
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// StreamDeadlineMiddleware lifts the server's READ_TIMEOUT and WRITE_TIMEOUT
+// deadlines off the connections that stay open on purpose, so the timeouts
+// can be strict for everything else. An upgrade, event stream (Accept:
+// text/event-stream) or gRPC request has them lifted before the handler runs, any
+// other response as soon as it turns out to be text/event-stream. The
+// websocket relay clears them once more after the hijack, the hijacked
+// connection is its own from there
+func StreamDeadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || acceptsEventStream(r) || isGRPC(r) {
+			liftDeadlines(w, r)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&streamDeadlineWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+type streamDeadlineWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (sw *streamDeadlineWriter) WriteHeader(code int) {
+	// informational responses leave the final header still to come
+	if !sw.wroteHeader && code >= http.StatusOK {
+		sw.wroteHeader = true
+		mediaType, _, _ := mime.ParseMediaType(sw.ResponseWriter.Header().Get("Content-Type"))
+		if mediaType == "text/event-stream" {
+			liftDeadlines(sw.ResponseWriter, sw.r)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *streamDeadlineWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *streamDeadlineWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (sw *streamDeadlineWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// helper functions
+
+// liftDeadlines clears both deadlines, the read one too since the server's
+// background read would otherwise cancel the request context once it passes
+func liftDeadlines(w http.ResponseWriter, r *http.Request) {
+	controller := http.NewResponseController(w)
+	err := controller.SetWriteDeadline(time.Time{})
+	if err == nil {
+		err = controller.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		slog.Debug("Failed to lift the server deadlines off a stream",
+			slog.String("Path", r.URL.Path),
+			slog.Any("Error", err),
+			slog.String("RequestID", RequestIDFromContext(r.Context())),
+		)
+	}
+}
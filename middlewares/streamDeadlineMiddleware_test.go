@@ -0,0 +1,71 @@
+package middlewares
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamOutlivesWriteTimeout(t *testing.T) {
+	const writeTimeout = 200 * time.Millisecond
+	const events = 10
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(2 * writeTimeout)
+			io.WriteString(w, "too late")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(writeTimeout / 4)
+		}
+	})
+	server := httptest.NewUnstartedServer(StreamDeadlineMiddleware(handler))
+	server.Config.WriteTimeout = writeTimeout
+	server.Start()
+	defer server.Close()
+
+	t.Run("event stream", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// the events span 2.5 times the write timeout
+		started := time.Now()
+		got := 0
+		lines := bufio.NewScanner(resp.Body)
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), "data: ") {
+				got++
+			}
+		}
+		if got != events {
+			t.Errorf("got %d events in %v, want %d", got, time.Since(started), events)
+		}
+	})
+
+	t.Run("plain response", func(t *testing.T) {
+		// everything but the streams keeps the strict timeout
+		resp, err := http.Get(server.URL + "/slow")
+		if err == nil {
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if readErr == nil && string(body) == "too late" {
+				t.Error("a plain response outlived the write timeout")
+			}
+		}
+	})
+}
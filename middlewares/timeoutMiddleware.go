@@ -0,0 +1,259 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// RequestTimeoutMiddleware puts a deadline of timeout on the request context
+// and answers 503 when the handler has not started its response by then,
+// the handler keeps its context so outbound calls are cancelled with it.
+// Long-lived routes such as the SSE log stream must not sit behind it,
+// upgrade and event stream (Accept: text/event-stream) requests pass through
+// untouched, as do gRPC calls, which carry their own grpc-timeout
+func RequestTimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// an upgraded connection such as a websocket lives on past the
+			// handshake, an event stream stays open for as long as it has events
+			// and a gRPC stream for as long as the call
+			if r.Header.Get("Upgrade") != "" || acceptsEventStream(r) || isGRPC(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			tw := &timeoutWriter{ResponseWriter: w, ctx: ctx, header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						// keep the stack of the handler goroutine, it is lost once re-raised
+						if p != http.ErrAbortHandler {
+							p = fmt.Sprintf("%v\n%s", p, debug.Stack())
+						}
+						tw.recordPanic(r, p, panicked)
+					}
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if !tw.wroteHeader {
+					if tw.deadlineExceeded() {
+						writeTimeoutResponse(w, r, timeout)
+						return
+					}
+					// a handler that never wrote still has its headers to send
+					tw.writeHeaderLocked(http.StatusOK)
+				}
+				tw.copyTrailersLocked()
+			case p := <-panicked:
+				// re-raised here so RecoveryMiddleware sees it
+				panic(p)
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				tw.timedOut = true
+				if tw.deadlineExceeded() && !tw.wroteHeader {
+					writeTimeoutResponse(w, r, timeout)
+				}
+				// a panic recorded before the timeout is still the middleware's
+				// to re-raise, any later one is logged by recordPanic
+				select {
+				case p := <-panicked:
+					panic(p)
+				default:
+				}
+			}
+		})
+	}
+}
+
+// ReloadableTimeout is a RequestTimeoutMiddleware whose timeout can change
+// while serving, a request keeps the timeout it started with
+type ReloadableTimeout struct {
+	timeout atomic.Int64
+}
+
+func NewReloadableTimeout(timeout time.Duration) *ReloadableTimeout {
+	t := &ReloadableTimeout{}
+	t.Set(timeout)
+	return t
+}
+
+func (t *ReloadableTimeout) Set(timeout time.Duration) {
+	t.timeout.Store(int64(timeout))
+}
+
+func (t *ReloadableTimeout) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestTimeoutMiddleware(time.Duration(t.timeout.Load()))(next).ServeHTTP(w, r)
+	})
+}
+
+// timeoutWriter keeps its own header map and guards every write, the handler
+// goroutine may still be running once the middleware has returned
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	mu          sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.deadlineExceeded() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.deadlineExceeded() {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// helper functions
+
+// recordPanic hands the handler's panic to the middleware while it is still
+// waiting, a panic after the middleware gave up on the handler has nobody to
+// re-raise it to and is logged instead
+func (tw *timeoutWriter) recordPanic(r *http.Request, p any, panicked chan<- any) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if !tw.timedOut {
+		panicked <- p
+		return
+	}
+	if p == http.ErrAbortHandler {
+		return
+	}
+	slog.Error("Handler panicked after the request timed out",
+		slog.String("Method", r.Method),
+		slog.String("Path", r.URL.Path),
+		slog.Any("Panic", p),
+		slog.String("RequestID", RequestIDFromContext(r.Context())),
+	)
+}
+
+// copyTrailersLocked copies the trailers the handler set into its own header
+// map, the declared ones and the http.TrailerPrefix ones, to the real header
+// once the handler returned, the server sends them from there
+func (tw *timeoutWriter) copyTrailersLocked() {
+	header := tw.ResponseWriter.Header()
+	for _, declared := range tw.header.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values, ok := tw.header[key]; ok {
+				header[key] = values
+			}
+		}
+	}
+	for key, values := range tw.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			header[key] = values
+		}
+	}
+}
+
+// once the deadline passed the response belongs to the middleware, even when
+// the handler saw the cancellation before the middleware did
+func (tw *timeoutWriter) deadlineExceeded() bool {
+	return tw.ctx.Err() == context.DeadlineExceeded
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.timedOut || tw.wroteHeader || tw.deadlineExceeded() {
+		return
+	}
+
+	// informational responses leave the final header still to come
+	if code >= http.StatusOK {
+		tw.wroteHeader = true
+	}
+
+	header := tw.ResponseWriter.Header()
+	for key, values := range tw.header {
+		header[key] = values
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGRPC reports whether r is a gRPC call, any of the application/grpc types
+func isGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+func writeTimeoutResponse(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	slog.Warn("Request timed out",
+		slog.String("Method", r.Method),
+		slog.String("Path", r.URL.Path),
+		slog.Duration("Timeout", timeout),
+		slog.String("RequestID", RequestIDFromContext(r.Context())),
+	)
+	errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeTimeout, "Request timed out")
+}
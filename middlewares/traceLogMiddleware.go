@@ -0,0 +1,31 @@
+package middlewares
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sash2721/Relay/proxy"
+)
+
+// TraceLogMiddleware samples rate of the requests by request ID for the
+// relay's trace log, a timing breakdown of every upstream call logged
+// without an OTel collector. It picks the same requests as the access log
+// sampling at the same rate, and is a no-op while rate is 0
+func TraceLogMiddleware(rate float64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if rate <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := RequestIDFromContext(r.Context())
+			if !sampled(requestID, rate) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := proxy.WithTraceLog(r.Context(), time.Now(), requestID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sash2721/Relay/errors"
+	"github.com/sash2721/Relay/proxy"
+)
+
+// UpstreamOverrideMiddleware lets a request carrying one of adminKeys pin
+// itself to the upstream URL in X-Relay-Upstream, for debugging and canaries.
+// The URL's host must be in allowedHosts, as host:port or just the host name
+// for any port, so the header can't make Relay call anything else. Every
+// other request with the header gets 403, and the header never goes upstream
+func UpstreamOverrideMiddleware(adminKeys []string, allowedHosts []string) func(http.Handler) http.Handler {
+	validKeys := make([][]byte, 0, len(adminKeys))
+	for _, key := range adminKeys {
+		if key != "" {
+			validKeys = append(validKeys, []byte(key))
+		}
+	}
+
+	allowed := make(map[string]bool, len(allowedHosts))
+	for _, host := range allowedHosts {
+		allowed[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			override := r.Header.Get(proxy.UpstreamOverrideHeader)
+			if override == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Header.Del(proxy.UpstreamOverrideHeader)
+
+			reject := func(reason string) {
+				slog.Warn("Upstream override rejected",
+					slog.String("Path", r.URL.Path),
+					slog.String("Override", override),
+					slog.String("Reason", reason),
+					slog.String("ClientIP", clientAddr(r).String()),
+					slog.String("RequestID", RequestIDFromContext(r.Context())),
+				)
+				errors.WriteError(w, http.StatusForbidden, errors.CodeForbidden, "Upstream override not allowed")
+			}
+
+			if len(validKeys) == 0 || len(allowed) == 0 {
+				reject("upstream override is disabled")
+				return
+			}
+			if key := apiKeyFromRequest(r); key == "" || !matchAPIKey(validKeys, key) {
+				reject("not an admin API key")
+				return
+			}
+
+			target, err := url.Parse(override)
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				reject("not an http or https URL")
+				return
+			}
+			host := strings.ToLower(target.Host)
+			if !allowed[host] && !allowed[strings.ToLower(target.Hostname())] {
+				reject("host not in RELAY_OVERRIDE_HOSTS")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(proxy.WithUpstreamOverride(r.Context(), target)))
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// URLLengthMiddleware answers 414 to a request whose target, the path with
+// its query as the client sent it, is longer than maxLength bytes. The
+// header size limit doesn't cover it, MaxHeaderBytes counts the request line
+// and the headers together. It is a no-op while maxLength is 0
+func URLLengthMiddleware(maxLength int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if maxLength <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			length := len(r.RequestURI)
+			if length == 0 {
+				length = len(r.URL.RequestURI())
+			}
+			if length <= maxLength {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			slog.Warn("Request URL too long",
+				slog.String("Method", r.Method),
+				slog.String("Path", r.URL.Path),
+				slog.Int("Length", length),
+				slog.Int("MaxLength", maxLength),
+				slog.String("RequestID", RequestIDFromContext(r.Context())),
+			)
+			errors.WriteError(w, http.StatusRequestURITooLong, errors.CodeURITooLong, "Request URL too long")
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package models
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Reason string            `json:"reason,omitempty"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// DependencyCheck is one check of the deep health report, Status is ok,
+// degraded or fail
+type DependencyCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type DeepHealthResponse struct {
+	Status string                     `json:"status"`
+	Checks map[string]DependencyCheck `json:"checks"`
+}
+
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type MaintenanceResponse struct {
+	Maintenance bool `json:"maintenance"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// StatsResponse is the /stats snapshot, Upstreams maps every relay onto its
+// upstream hosts
+type StatsResponse struct {
+	StartedAt        time.Time                           `json:"startedAt"`
+	UptimeSeconds    float64                             `json:"uptimeSeconds"`
+	RequestsTotal    uint64                              `json:"requestsTotal"`
+	RequestsInFlight int64                               `json:"requestsInFlight"`
+	Upstreams        map[string]map[string]UpstreamStats `json:"upstreams"`
+	QueueDepth       int                                 `json:"queueDepth"`
+	QueueError       string                              `json:"queueError,omitempty"`
+}
+
+// UpstreamStats is one upstream host, Available when the balancer would pick
+// it right now, InPool unless the health checks removed it and Breaker the
+// state of its circuit when breakers are on
+type UpstreamStats struct {
+	Available bool   `json:"available"`
+	InPool    bool   `json:"inPool"`
+	Breaker   string `json:"breaker,omitempty"`
+}
+
+// BreakersResponse is GET /admin/breakers, every relay mapped onto the
+// circuits of its upstream hosts
+type BreakersResponse struct {
+	Breakers map[string]map[string]BreakerStatus `json:"breakers"`
+}
+
+type BreakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+type BreakerResetResponse struct {
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+}
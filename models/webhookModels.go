@@ -0,0 +1,50 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DeliveryStatusPending    = "pending"
+	DeliveryStatusDelivering = "delivering"
+	DeliveryStatusDelivered  = "delivered"
+	DeliveryStatusDead       = "dead"
+)
+
+type CreateWebhookRequest struct {
+	TargetURL string          `json:"targetUrl"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type WebhookDelivery struct {
+	Id            string          `json:"id"`
+	TargetURL     string          `json:"targetUrl"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+	// LeaseId names the one Dequeue handing the delivery out, only that
+	// worker may finish it and only before LeaseExpiresAt
+	LeaseId        string    `json:"leaseId,omitempty"`
+	LeaseExpiresAt time.Time `json:"leaseExpiresAt"`
+}
+
+type WebhookAcceptedResponse struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type WebhookDeliveryResponse struct {
+	Id            string    `json:"id"`
+	TargetURL     string    `json:"targetUrl"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
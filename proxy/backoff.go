@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// jitter modes of a Backoff
+const (
+	// JitterNone waits the whole delay, every client retrying in step
+	JitterNone = "none"
+	// JitterFull waits anywhere between 0 and the delay
+	JitterFull = "full"
+	// JitterEqual waits half the delay plus up to the other half at random
+	JitterEqual = "equal"
+)
+
+// an uncapped backoff stops growing here, about 146 years, leaving room for
+// the jitter arithmetic
+const maxBackoffDelay = time.Duration(math.MaxInt64 / 2)
+
+// Backoff is an exponential backoff, the first retry waits around Base and
+// every one after it Multiplier times longer, up to Max. A Multiplier below 1
+// is taken as 2 and a zero Max leaves the delay uncapped. An unknown Jitter
+// is full jitter
+type Backoff struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     string
+}
+
+// Next is the wait before retry attempt, 1 for the first retry
+func (b Backoff) Next(attempt int) time.Duration {
+	if b.Base <= 0 || attempt < 1 {
+		return 0
+	}
+
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	// worked out in float64 so a long run of attempts saturates rather than
+	// overflowing into a negative delay
+	delay := float64(b.Base) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	ceiling := maxBackoffDelay
+	if delay < float64(maxBackoffDelay) {
+		ceiling = time.Duration(delay)
+	}
+
+	switch b.Jitter {
+	case JitterNone:
+		return ceiling
+	case JitterEqual:
+		half := ceiling / 2
+		return half + rand.N(ceiling-half+1)
+	default:
+		return rand.N(ceiling + 1)
+	}
+}
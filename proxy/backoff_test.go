@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffNextStaysWithinBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+	}{
+		{name: "none", backoff: Backoff{Base: 100 * time.Millisecond, Multiplier: 2, Max: 3 * time.Second, Jitter: JitterNone}},
+		{name: "full", backoff: Backoff{Base: 100 * time.Millisecond, Multiplier: 2, Max: 3 * time.Second, Jitter: JitterFull}},
+		{name: "equal", backoff: Backoff{Base: 100 * time.Millisecond, Multiplier: 2, Max: 3 * time.Second, Jitter: JitterEqual}},
+		{name: "unknown jitter", backoff: Backoff{Base: 100 * time.Millisecond, Multiplier: 1.5, Max: time.Second, Jitter: "sometimes"}},
+		{name: "uncapped", backoff: Backoff{Base: time.Millisecond, Multiplier: 3, Jitter: JitterFull}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for attempt := 1; attempt <= 200; attempt++ {
+				ceiling := expectedCeiling(tt.backoff, attempt)
+				floor := time.Duration(0)
+				switch tt.backoff.Jitter {
+				case JitterNone:
+					floor = ceiling
+				case JitterEqual:
+					floor = ceiling / 2
+				}
+
+				for range 50 {
+					delay := tt.backoff.Next(attempt)
+					if delay < floor || delay > ceiling {
+						t.Fatalf("Next(%d) = %v, want within [%v, %v]", attempt, delay, floor, ceiling)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffNextEdgeCases(t *testing.T) {
+	if delay := (Backoff{}).Next(3); delay != 0 {
+		t.Errorf("a zero Base waited %v", delay)
+	}
+	if delay := (Backoff{Base: time.Second, Jitter: JitterNone}).Next(0); delay != 0 {
+		t.Errorf("attempt 0 waited %v", delay)
+	}
+	// a Multiplier below 1 doubles
+	if delay := (Backoff{Base: time.Second, Multiplier: 0.5, Jitter: JitterNone}).Next(3); delay != 4*time.Second {
+		t.Errorf("Next(3) = %v with Multiplier 0.5, want 4s", delay)
+	}
+	// a huge attempt saturates instead of overflowing
+	if delay := (Backoff{Base: time.Second, Multiplier: 10, Jitter: JitterNone}).Next(math.MaxInt32); delay <= 0 {
+		t.Errorf("Next(MaxInt32) = %v, want a positive delay", delay)
+	}
+}
+
+// helper functions
+
+// expectedCeiling is Base * Multiplier^(attempt-1) capped at Max
+func expectedCeiling(b Backoff, attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(b.Base) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		return b.Max
+	}
+	if delay >= float64(maxBackoffDelay) {
+		return maxBackoffDelay
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoHealthyUpstream = errors.New("no healthy upstream available")
+
+type Upstream struct {
+	URL *url.URL
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+}
+
+// Healthy reports whether the upstream is outside its failure cooldown
+func (u *Upstream) Healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !now.Before(u.unhealthyUntil)
+}
+
+// Strategy picks one upstream out of the healthy candidates, candidates is
+// never empty
+type Strategy interface {
+	Pick(candidates []*Upstream) *Upstream
+}
+
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (s *RoundRobin) Pick(candidates []*Upstream) *Upstream {
+	index := s.next.Add(1) - 1
+	return candidates[index%uint64(len(candidates))]
+}
+
+// Balancer hands out upstreams per request, skipping the ones that recently
+// failed to connect until their cooldown has passed and the ones the health
+// poller removed from the pool
+type Balancer struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	cooldown  time.Duration
+	breakers  *BreakerRegistry
+	// set by HealthPoller.Watch
+	health *HealthPoller
+}
+
+func NewBalancer(upstreams []string, strategy Strategy, cooldown time.Duration) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("at least one upstream is required")
+	}
+
+	balancer := &Balancer{
+		strategy: strategy,
+		cooldown: cooldown,
+	}
+
+	for _, upstream := range upstreams {
+		target, err := parseUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+		balancer.upstreams = append(balancer.upstreams, &Upstream{URL: target})
+	}
+
+	return balancer, nil
+}
+
+// Next returns the upstream for the next request, or ErrNoHealthyUpstream
+// when every upstream is cooling down
+func (b *Balancer) Next() (*Upstream, error) {
+	return b.NextExcept(nil)
+}
+
+// NextExcept is Next without the upstreams in tried, a request failing over
+// uses it so it never lands on the same upstream twice
+func (b *Balancer) NextExcept(tried []*Upstream) (*Upstream, error) {
+	now := time.Now()
+
+	candidates := make([]*Upstream, 0, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		if slices.Contains(tried, upstream) || !b.available(upstream, now) {
+			continue
+		}
+		candidates = append(candidates, upstream)
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	return b.strategy.Pick(candidates), nil
+}
+
+// UseCircuitBreakers makes Next skip upstreams whose circuit is open
+func (b *Balancer) UseCircuitBreakers(breakers *BreakerRegistry) {
+	b.breakers = breakers
+}
+
+func (b *Balancer) CircuitBreakers() *BreakerRegistry {
+	return b.breakers
+}
+
+// MarkFailed takes the upstream out of rotation for the cooldown window
+func (b *Balancer) MarkFailed(upstream *Upstream) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.unhealthyUntil = time.Now().Add(b.cooldown)
+}
+
+// Unreachable dials every upstream in parallel and returns the hosts that
+// could not be reached before ctx is done, the cooldowns are left alone
+func (b *Balancer) Unreachable(ctx context.Context) []string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var unreachable []string
+
+	dialer := &net.Dialer{}
+	for _, upstream := range b.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := dialer.DialContext(ctx, "tcp", upstreamAddress(upstream))
+			if err != nil {
+				mu.Lock()
+				unreachable = append(unreachable, upstream.URL.Host)
+				mu.Unlock()
+				return
+			}
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(unreachable)
+	return unreachable
+}
+
+func (b *Balancer) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+// Available maps every upstream host onto whether Next would hand it out
+// right now
+func (b *Balancer) Available() map[string]bool {
+	now := time.Now()
+	available := make(map[string]bool, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		available[upstream.URL.Host] = b.available(upstream, now)
+	}
+	return available
+}
+
+// Members maps every upstream host onto whether it is in the pool, left out
+// only by the health poller after failing its checks for long enough
+func (b *Balancer) Members() map[string]bool {
+	members := make(map[string]bool, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		members[upstream.URL.Host] = b.health == nil || b.health.Healthy(upstream.URL.Host)
+	}
+	return members
+}
+
+// helper functions
+
+// available is outside its cooldown, its circuit not open and not removed
+// from the pool by the health poller
+func (b *Balancer) available(upstream *Upstream, now time.Time) bool {
+	if !upstream.Healthy(now) {
+		return false
+	}
+	if b.breakers != nil && !b.breakers.Get(upstream.URL.Host).Ready() {
+		return false
+	}
+	if b.health != nil && !b.health.Healthy(upstream.URL.Host) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	StateClosed BreakerState = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker opens after threshold consecutive failures, fast-fails for
+// resetTimeout and then lets a single half-open probe through
+type CircuitBreaker struct {
+	mu            sync.Mutex
+	state         BreakerState
+	failures      int
+	openedAt      time.Time
+	probeInFlight bool
+	threshold     int
+	resetTimeout  time.Duration
+	// the upstream the state gauge is labelled with, empty skips the gauge
+	host string
+}
+
+func NewCircuitBreaker(threshold int, resetTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:    threshold,
+		resetTimeout: resetTimeout,
+	}
+}
+
+// Ready reports whether a request could be let through, without claiming
+// the half-open probe
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case StateOpen:
+		return time.Since(cb.openedAt) >= cb.resetTimeout
+	case StateHalfOpen:
+		return !cb.probeInFlight
+	default:
+		return true
+	}
+}
+
+// Allow lets the request through, moving an expired open circuit to
+// half-open and claiming its single probe
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case StateOpen:
+		if time.Since(cb.openedAt) < cb.resetTimeout {
+			return false
+		}
+		cb.setState(StateHalfOpen)
+		cb.probeInFlight = true
+		return true
+	case StateHalfOpen:
+		if cb.probeInFlight {
+			return false
+		}
+		cb.probeInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.setState(StateClosed)
+	cb.failures = 0
+	cb.probeInFlight = false
+}
+
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.probeInFlight = false
+
+	if cb.state == StateHalfOpen || cb.failures >= cb.threshold {
+		cb.setState(StateOpen)
+		cb.openedAt = time.Now()
+	}
+}
+
+// setState expects cb.mu to be held
+func (cb *CircuitBreaker) setState(state BreakerState) {
+	cb.state = state
+	if cb.host != "" {
+		upstreamCircuitState.WithLabelValues(cb.host).Set(float64(state))
+	}
+}
+
+// Reset forces the circuit closed with no failures counted, for an upstream
+// that came back before the cooldown ran out
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.setState(StateClosed)
+	cb.failures = 0
+	cb.probeInFlight = false
+}
+
+// frees a half-open probe that ended without a verdict
+func (cb *CircuitBreaker) releaseProbe() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probeInFlight = false
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+func (cb *CircuitBreaker) Failures() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.failures
+}
+
+// BreakerRegistry keeps one circuit breaker per upstream host
+type BreakerRegistry struct {
+	mu           sync.Mutex
+	breakers     map[string]*CircuitBreaker
+	threshold    int
+	resetTimeout time.Duration
+}
+
+func NewBreakerRegistry(threshold int, resetTimeout time.Duration) *BreakerRegistry {
+	return &BreakerRegistry{
+		breakers:     make(map[string]*CircuitBreaker),
+		threshold:    threshold,
+		resetTimeout: resetTimeout,
+	}
+}
+
+func (r *BreakerRegistry) Get(host string) *CircuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breaker, ok := r.breakers[host]
+	if !ok {
+		breaker = NewCircuitBreaker(r.threshold, r.resetTimeout)
+		breaker.host = host
+		breaker.setState(StateClosed)
+		r.breakers[host] = breaker
+	}
+	return breaker
+}
+
+// Lookup returns the breaker of host without creating one
+func (r *BreakerRegistry) Lookup(host string) (*CircuitBreaker, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breaker, ok := r.breakers[host]
+	return breaker, ok
+}
+
+// Hosts returns every upstream host with a breaker
+func (r *BreakerRegistry) Hosts() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hosts := make([]string, 0, len(r.breakers))
+	for host := range r.breakers {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// States returns the current state of every known upstream circuit
+func (r *BreakerRegistry) States() map[string]BreakerState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	states := make(map[string]BreakerState, len(r.breakers))
+	for host, breaker := range r.breakers {
+		states[host] = breaker.State()
+	}
+	return states
+}
+
+// breakerTransport records every upstream outcome on the host's breaker,
+// transport errors and 5xx responses count as failures
+type breakerTransport struct {
+	base     http.RoundTripper
+	breakers *BreakerRegistry
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+
+	breaker := t.breakers.Get(req.URL.Host)
+
+	// a client that went away or sent too much says nothing about the upstream
+	if req.Context().Err() != nil || isBodyTooLarge(err) {
+		breaker.releaseProbe()
+		return resp, err
+	}
+
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		breaker.RecordFailure()
+	} else {
+		breaker.RecordSuccess()
+	}
+
+	return resp, err
+}
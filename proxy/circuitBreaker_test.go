@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const (
+		allow    = "allow"
+		fail     = "fail"
+		succeed  = "succeed"
+		release  = "release"
+		cooldown = "cooldown"
+	)
+	type step struct {
+		op        string
+		wantAllow bool
+		wantState BreakerState
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			name:      "opens after threshold failures in a row",
+			threshold: 3,
+			steps: []step{
+				{op: fail, wantState: StateClosed},
+				{op: fail, wantState: StateClosed},
+				{op: fail, wantState: StateOpen},
+				{op: allow, wantAllow: false, wantState: StateOpen},
+			},
+		},
+		{
+			name:      "a success resets the count",
+			threshold: 2,
+			steps: []step{
+				{op: fail, wantState: StateClosed},
+				{op: succeed, wantState: StateClosed},
+				{op: fail, wantState: StateClosed},
+				{op: allow, wantAllow: true, wantState: StateClosed},
+			},
+		},
+		{
+			name:      "a passing probe closes it",
+			threshold: 1,
+			steps: []step{
+				{op: fail, wantState: StateOpen},
+				{op: cooldown, wantState: StateOpen},
+				{op: allow, wantAllow: true, wantState: StateHalfOpen},
+				{op: succeed, wantState: StateClosed},
+				{op: allow, wantAllow: true, wantState: StateClosed},
+				{op: allow, wantAllow: true, wantState: StateClosed},
+			},
+		},
+		{
+			name:      "a failing probe opens it again",
+			threshold: 3,
+			steps: []step{
+				{op: fail, wantState: StateClosed},
+				{op: fail, wantState: StateClosed},
+				{op: fail, wantState: StateOpen},
+				{op: cooldown, wantState: StateOpen},
+				{op: allow, wantAllow: true, wantState: StateHalfOpen},
+				// one failure is enough while half-open
+				{op: fail, wantState: StateOpen},
+				{op: allow, wantAllow: false, wantState: StateOpen},
+			},
+		},
+		{
+			name:      "a single probe at a time",
+			threshold: 1,
+			steps: []step{
+				{op: fail, wantState: StateOpen},
+				{op: cooldown, wantState: StateOpen},
+				{op: allow, wantAllow: true, wantState: StateHalfOpen},
+				{op: allow, wantAllow: false, wantState: StateHalfOpen},
+				{op: allow, wantAllow: false, wantState: StateHalfOpen},
+				// a probe without a verdict frees the slot for the next one
+				{op: release, wantState: StateHalfOpen},
+				{op: allow, wantAllow: true, wantState: StateHalfOpen},
+				{op: allow, wantAllow: false, wantState: StateHalfOpen},
+				{op: succeed, wantState: StateClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreaker(tt.threshold, time.Minute)
+			for i, s := range tt.steps {
+				switch s.op {
+				case allow:
+					if got := cb.Allow(); got != s.wantAllow {
+						t.Fatalf("step %d: Allow = %v, want %v", i+1, got, s.wantAllow)
+					}
+				case fail:
+					cb.RecordFailure()
+				case succeed:
+					cb.RecordSuccess()
+				case release:
+					cb.releaseProbe()
+				case cooldown:
+					// the reset timeout ran out without waiting for it
+					cb.openedAt = time.Now().Add(-cb.resetTimeout)
+					if !cb.Ready() {
+						t.Fatalf("step %d: not Ready after the reset timeout", i+1)
+					}
+				}
+				if state := cb.State(); state != s.wantState {
+					t.Fatalf("step %d (%s): state = %v, want %v", i+1, s.op, state, s.wantState)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	stderrors "errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// pause between lookups retried after a temporary DNS failure
+const dnsRetryDelay = 50 * time.Millisecond
+
+// DNSCache resolves upstream hosts for the relay transports, keeps each answer
+// for ttl and retries temporary resolver failures a few times. When a lookup
+// still fails the last answer is used past its ttl, so a blip in resolution
+// doesn't fail requests to a host that was resolvable moments ago
+type DNSCache struct {
+	ttl      time.Duration
+	retries  int
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewDNSCache caches answers for ttl, a ttl of 0 or less resolves every dial
+// afresh but still retries temporary failures retries times
+func NewDNSCache(ttl time.Duration, retries int) *DNSCache {
+	return &DNSCache{
+		ttl:      ttl,
+		retries:  retries,
+		resolver: net.DefaultResolver,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+// DialContext dials through dialer with the host resolved by the cache,
+// trying every address of the host in turn. A nil cache dials directly
+func (c *DNSCache) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c == nil {
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var dialErr error
+		for _, ip := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, dialErr
+	}
+}
+
+// helper functions
+
+func (c *DNSCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, cached := c.entries[host]
+	c.mu.Unlock()
+	if cached && c.ttl > 0 && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.resolve(ctx, host)
+	if err != nil {
+		if cached && isTemporaryDNSError(err) {
+			slog.Warn("DNS lookup failed, using the last answer",
+				slog.String("Host", host),
+				slog.Any("Error", err),
+			)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+		c.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// resolve retries only the temporary failures, a host that doesn't exist
+// fails straight away
+func (c *DNSCache) resolve(ctx context.Context, host string) ([]string, error) {
+	for attempt := 0; ; attempt++ {
+		addrs, err := c.resolver.LookupHost(ctx, host)
+		if err == nil || attempt >= c.retries || !isTemporaryDNSError(err) {
+			return addrs, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(dnsRetryDelay):
+		}
+	}
+}
+
+func isTemporaryDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	if !stderrors.As(err, &dnsErr) {
+		return false
+	}
+	return dnsErr.IsTemporary || dnsErr.IsTimeout
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// expectsContinue reports whether the client holds the body back until it
+// gets a 100 Continue, the relay then leaves the body unread until the
+// upstream asks for it
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// continueWriter drops the 100 Continue relayed from the upstream. The
+// transport only sends the body once the upstream answered 100, and the
+// server answers the client with its own 100 as soon as that first read of
+// the body happens, so relaying the upstream's as well would send the client
+// two. A final status without a 100 first leaves the body unread and the
+// client is never told to send it
+type continueWriter struct {
+	http.ResponseWriter
+}
+
+func (cw *continueWriter) WriteHeader(code int) {
+	if code == http.StatusContinue {
+		return
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *continueWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lets http.ResponseController reach the underlying writer
+func (cw *continueWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRelayExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/too-large" {
+			// answered before the first read, the server never sends a 100
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, strconv.Itoa(len(body)))
+	}))
+	defer upstream.Close()
+
+	front := httptest.NewServer(newTestRelay(t, upstream.URL, RelayOptions{}))
+	defer front.Close()
+
+	const body = "the upload held back for the 100"
+
+	t.Run("continue", func(t *testing.T) {
+		conn, reader := sendExpectContinue(t, front.Listener.Addr().String(), "/upload", len(body))
+		defer conn.Close()
+
+		interim := readResponse(t, reader)
+		if interim.StatusCode != http.StatusContinue {
+			t.Fatalf("got %d before the body was sent, want 100", interim.StatusCode)
+		}
+
+		io.WriteString(conn, body)
+		final := readResponse(t, reader)
+		got, _ := io.ReadAll(final.Body)
+		final.Body.Close()
+		if final.StatusCode != http.StatusOK {
+			t.Fatalf("final status = %d, want %d", final.StatusCode, http.StatusOK)
+		}
+		if string(got) != strconv.Itoa(len(body)) {
+			t.Errorf("the upstream read %s bytes, want %d", got, len(body))
+		}
+	})
+
+	t.Run("final status", func(t *testing.T) {
+		conn, reader := sendExpectContinue(t, front.Listener.Addr().String(), "/too-large", len(body))
+		defer conn.Close()
+
+		// the upstream's refusal comes back in place of a 100, the body is never sent
+		final := readResponse(t, reader)
+		final.Body.Close()
+		if final.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d, want the upstream's %d", final.StatusCode, http.StatusRequestEntityTooLarge)
+		}
+	})
+}
+
+// helper functions
+
+// sendExpectContinue sends the headers of a POST of length bytes and holds
+// the body back like a client waiting for 100 Continue
+func sendExpectContinue(t *testing.T, addr string, path string, length int) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: relay\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", path, length)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodPost})
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	return resp
+}
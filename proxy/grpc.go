@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the gRPC status codes Relay answers with itself, the upstream's own travel
+// in its grpc-status trailer untouched
+const (
+	grpcCanceled          = 1
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+)
+
+// IsGRPC reports whether r is a gRPC call, application/grpc or one of its
+// +proto and +json subtypes. A gRPC call is a stream both ways, it is never
+// buffered for a failover or a shadow copy
+func IsGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// writeGRPCError answers a gRPC call as a trailers-only response, status 200
+// with grpc-status and grpc-message in the headers, the only error a gRPC
+// client reads. Reports false for any other request, left to the caller
+func writeGRPCError(w http.ResponseWriter, r *http.Request, code int, message string) bool {
+	if !IsGRPC(r) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// helper functions
+
+// handleGRPCError is handleError for a gRPC call, the same cases answered
+// with the matching gRPC status
+func (h *RelayHandler) handleGRPCError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case isBodyTooLarge(err):
+		writeGRPCError(w, r, grpcResourceExhausted, "Request body too large")
+	case r.Context().Err() == context.DeadlineExceeded:
+		writeGRPCError(w, r, grpcDeadlineExceeded, "Request timed out")
+	case r.Context().Err() == context.Canceled:
+		slog.Info("Client disconnected, relayed gRPC call cancelled",
+			slog.String("Path", r.URL.Path),
+			slog.String("Upstream", r.URL.Host),
+		)
+		writeGRPCError(w, r, grpcCanceled, "Call cancelled by the client")
+	default:
+		slog.Error("Failed to relay the gRPC call upstream",
+			slog.String("Path", r.URL.Path),
+			slog.String("Upstream", r.URL.Host),
+			slog.Any("Error", err),
+		)
+		if upstream, _ := r.Context().Value(upstreamContextKey{}).(*Upstream); upstream != nil {
+			h.balancer.MarkFailed(upstream)
+		}
+		writeGRPCError(w, r, grpcUnavailable, "Upstream is unreachable")
+	}
+}
+
+// encodeGRPCMessage percent-encodes message the way grpc-message expects,
+// every byte outside printable ASCII and % itself
+func encodeGRPCMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+			continue
+		}
+		encoded.WriteByte(c)
+	}
+	return encoded.String()
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestRelayGRPCHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("relay.Echo", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(upstream, healthServer)
+	go upstream.Serve(listener)
+	defer upstream.Stop()
+
+	client := grpcClientThroughRelay(t, "http://"+listener.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "relay.Echo"})
+	if err != nil {
+		t.Fatalf("Check through the relay: %v", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("status = %v, want SERVING", resp.GetStatus())
+	}
+
+	// the upstream's error status comes back in its trailers untouched
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "relay.Missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Check of an unknown service = %v, want NotFound", err)
+	}
+}
+
+func TestRelayGRPCUnreachableUpstream(t *testing.T) {
+	// a port nothing listens on any more
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	client := grpcClientThroughRelay(t, "http://"+addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the relay answers with a gRPC status a client can read, not an HTTP 502
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Check with the upstream down = %v, want Unavailable", err)
+	}
+}
+
+// helper functions
+
+// grpcClientThroughRelay is a health client calling upstream through a gRPC
+// route, the relay served over h2c like with HTTP2_CLEARTEXT
+func grpcClientThroughRelay(t *testing.T, upstream string) healthpb.HealthClient {
+	t.Helper()
+	relay, err := NewRouteRelay(&configs.ServerConfig{}, Route{Upstreams: []string{upstream}, GRPC: true}, nil)
+	if err != nil {
+		t.Fatalf("NewRouteRelay: %v", err)
+	}
+
+	front := httptest.NewUnstartedServer(relay)
+	front.Config.Protocols = new(http.Protocols)
+	front.Config.Protocols.SetHTTP1(true)
+	front.Config.Protocols.SetUnencryptedHTTP2(true)
+	front.Start()
+	t.Cleanup(front.Close)
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(front.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderRules rewrites the headers of a relayed request. Remove runs before
+// Set, so a header both removed and set is replaced by the configured value.
+// The reverse proxy strips the standard hop-by-hop headers (Connection,
+// Keep-Alive, TE, Trailer, Transfer-Encoding, ...) itself, Proxy-* headers
+// meant for Relay are always stripped on top
+type HeaderRules struct {
+	Set    map[string]string
+	Remove []string
+}
+
+// Apply rewrites header in place
+func (rules HeaderRules) Apply(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "Proxy-") {
+			header.Del(name)
+		}
+	}
+
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+
+	for name, value := range rules.Set {
+		header.Set(name, value)
+	}
+}
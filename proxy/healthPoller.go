@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a dead upstream is polled less and less often, up to this many intervals apart
+const maxHealthBackoffFactor = 16
+
+// HealthPoller polls every watched upstream in the background and keeps a
+// shared pool membership the balancers read, so a dead target is skipped
+// before any request has to fail on it. Upstreams are keyed by their
+// configured host, a pool reloaded with the same hosts keeps their state
+type HealthPoller struct {
+	interval time.Duration
+	path     string
+	client   *http.Client
+	// an upstream leaves the pool once it has failed every check for
+	// removeAfter and comes back after rejoinAfter passes in a row, so one
+	// flapping between the two doesn't go in and out on every poll
+	removeAfter time.Duration
+	rejoinAfter int
+
+	mu      sync.Mutex
+	ctx     context.Context
+	targets map[string]*url.URL
+	health  map[string]*hostHealth
+	wg      sync.WaitGroup
+}
+
+// hostHealth is the run of checks an upstream is on
+type hostHealth struct {
+	removed      bool
+	failingSince time.Time
+	passes       int
+}
+
+// NewHealthPoller polls through transport, nil uses http.DefaultTransport
+func NewHealthPoller(interval time.Duration, path string, timeout time.Duration, transport http.RoundTripper) *HealthPoller {
+	return &HealthPoller{
+		interval: interval,
+		path:     "/" + strings.TrimPrefix(path, "/"),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		rejoinAfter: 1,
+		targets:     make(map[string]*url.URL),
+		health:      make(map[string]*hostHealth),
+	}
+}
+
+// UseThresholds delays the pool changes, an upstream is removed once it has
+// failed its checks for removeAfter, 0 on the first failure, and re-added
+// after rejoinAfter checks in a row pass, below 1 on the first pass
+func (p *HealthPoller) UseThresholds(removeAfter time.Duration, rejoinAfter int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeAfter = removeAfter
+	p.rejoinAfter = max(rejoinAfter, 1)
+}
+
+// Watch polls the balancer's upstreams and makes it skip the ones that are
+// down, a nil poller leaves the balancer alone
+func (p *HealthPoller) Watch(balancer *Balancer) {
+	if p == nil {
+		return
+	}
+	balancer.health = p
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, upstream := range balancer.upstreams {
+		host := upstream.URL.Host
+		if _, ok := p.targets[host]; ok {
+			continue
+		}
+		p.targets[host] = upstream.URL
+		if p.ctx != nil {
+			p.startLocked(host, upstream.URL)
+		}
+	}
+}
+
+// Start polls every upstream watched so far, and the ones watched later,
+// until ctx is done
+func (p *HealthPoller) Start(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ctx = ctx
+	for host, target := range p.targets {
+		p.startLocked(host, target)
+	}
+}
+
+// Wait blocks until every poll loop returned after the Start ctx is done
+func (p *HealthPoller) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Healthy reports whether host is in the pool, an upstream not polled yet
+// counts as healthy
+func (p *HealthPoller) Healthy(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health, ok := p.health[host]
+	return !ok || !health.removed
+}
+
+// helper functions
+
+func (p *HealthPoller) startLocked(host string, target *url.URL) {
+	ctx := p.ctx
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.poll(ctx, host, target)
+	}()
+}
+
+func (p *HealthPoller) poll(ctx context.Context, host string, target *url.URL) {
+	failures := 0
+	for {
+		healthy := p.check(ctx, target)
+		if ctx.Err() != nil {
+			return
+		}
+		removed := p.record(host, healthy)
+
+		// one still in the pool is polled on the interval so it leaves on time
+		wait := p.interval
+		if healthy || !removed {
+			failures = 0
+		} else {
+			failures++
+			wait = p.interval << min(failures-1, 4)
+			wait = min(wait, p.interval*maxHealthBackoffFactor)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// any answer below 400 from the health path counts as up
+func (p *HealthPoller) check(ctx context.Context, target *url.URL) bool {
+	probe := *target
+	probe.Path = strings.TrimSuffix(target.Path, "/") + p.path
+	probe.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusBadRequest
+}
+
+// record adds the check to the run of host and reports whether it is out of
+// the pool after it
+func (p *HealthPoller) record(host string, healthy bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health, ok := p.health[host]
+	if !ok {
+		health = &hostHealth{}
+		p.health[host] = health
+	}
+
+	now := time.Now()
+	if healthy {
+		health.failingSince = time.Time{}
+		if !health.removed {
+			return false
+		}
+		health.passes++
+		if health.passes < p.rejoinAfter {
+			return true
+		}
+		health.removed = false
+		health.passes = 0
+		slog.Info("Upstream passed its health checks, added back to the pool",
+			slog.String("Upstream", host),
+			slog.Int("Passes", p.rejoinAfter),
+		)
+		return false
+	}
+
+	health.passes = 0
+	if health.removed {
+		return true
+	}
+	if health.failingSince.IsZero() {
+		health.failingSince = now
+	}
+	failingFor := now.Sub(health.failingSince)
+	if failingFor < p.removeAfter {
+		slog.Debug("Upstream failed its health check, still in the pool",
+			slog.String("Upstream", host),
+			slog.String("Path", p.path),
+			slog.Duration("FailingFor", failingFor),
+		)
+		return false
+	}
+	health.removed = true
+	slog.Warn("Upstream failed its health checks, removed from the pool",
+		slog.String("Upstream", host),
+		slog.String("Path", p.path),
+		slog.Duration("FailingFor", failingFor),
+	)
+	return true
+}
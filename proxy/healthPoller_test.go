@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthPollerRecordHysteresis(t *testing.T) {
+	type check struct {
+		healthy bool
+		// how much longer the failing run has been going before this check
+		elapsed     time.Duration
+		wantRemoved bool
+	}
+	tests := []struct {
+		name        string
+		removeAfter time.Duration
+		rejoinAfter int
+		checks      []check
+	}{
+		{
+			name: "no thresholds",
+			checks: []check{
+				{healthy: false, wantRemoved: true},
+				{healthy: false, wantRemoved: true},
+				{healthy: true, wantRemoved: false},
+			},
+		},
+		{
+			name:        "removed once failing for removeAfter",
+			removeAfter: 30 * time.Second,
+			rejoinAfter: 1,
+			checks: []check{
+				{healthy: false, wantRemoved: false},
+				{healthy: false, elapsed: 10 * time.Second, wantRemoved: false},
+				{healthy: false, elapsed: 20 * time.Second, wantRemoved: true},
+				{healthy: true, wantRemoved: false},
+			},
+		},
+		{
+			name:        "a pass restarts the failing run",
+			removeAfter: 30 * time.Second,
+			rejoinAfter: 1,
+			checks: []check{
+				{healthy: false, wantRemoved: false},
+				{healthy: false, elapsed: 25 * time.Second, wantRemoved: false},
+				{healthy: true, wantRemoved: false},
+				{healthy: false, wantRemoved: false},
+				{healthy: false, elapsed: 25 * time.Second, wantRemoved: false},
+				{healthy: false, elapsed: 5 * time.Second, wantRemoved: true},
+			},
+		},
+		{
+			name:        "rejoins after rejoinAfter passes in a row",
+			rejoinAfter: 3,
+			checks: []check{
+				{healthy: false, wantRemoved: true},
+				{healthy: true, wantRemoved: true},
+				{healthy: true, wantRemoved: true},
+				{healthy: true, wantRemoved: false},
+				{healthy: true, wantRemoved: false},
+			},
+		},
+		{
+			name:        "a failure restarts the passing run",
+			removeAfter: time.Minute,
+			rejoinAfter: 2,
+			checks: []check{
+				{healthy: false, wantRemoved: false},
+				{healthy: false, elapsed: time.Minute, wantRemoved: true},
+				{healthy: true, wantRemoved: true},
+				// flapping keeps it out, however long ago it was removed
+				{healthy: false, wantRemoved: true},
+				{healthy: true, wantRemoved: true},
+				{healthy: true, wantRemoved: false},
+				// back in the pool, removeAfter applies again
+				{healthy: false, wantRemoved: false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const host = "api.internal:8080"
+			poller := NewHealthPoller(time.Second, "/healthz", time.Second, nil)
+			poller.UseThresholds(tt.removeAfter, tt.rejoinAfter)
+			if !poller.Healthy(host) {
+				t.Fatal("an upstream not polled yet is not healthy")
+			}
+
+			for i, check := range tt.checks {
+				if health, ok := poller.health[host]; ok && !health.failingSince.IsZero() {
+					health.failingSince = health.failingSince.Add(-check.elapsed)
+				}
+				removed := poller.record(host, check.healthy)
+				if removed != check.wantRemoved {
+					t.Fatalf("check %d (healthy %v) removed = %v, want %v", i+1, check.healthy, removed, check.wantRemoved)
+				}
+				if poller.Healthy(host) == removed {
+					t.Fatalf("check %d: Healthy = %v while removed = %v", i+1, poller.Healthy(host), removed)
+				}
+			}
+		})
+	}
+}
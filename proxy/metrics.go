@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upstreams are labelled by the configured host:port, never the address it
+// resolved to, so the series stay bounded by the size of the pools
+var (
+	upstreamRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_upstream_requests_total",
+			Help: "Relayed requests by upstream and status code, status is \"error\" when no response came back.",
+		},
+		[]string{"upstream", "status"},
+	)
+
+	upstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "relay_upstream_request_duration_seconds",
+			Help:    "Time until the upstream answered with its response headers.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"upstream"},
+	)
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_upstream_errors_total",
+			Help: "Relayed requests that failed to connect or got a 5xx from the upstream.",
+		},
+		[]string{"upstream"},
+	)
+
+	upstreamRetriesRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relay_upstream_retries_rejected_total",
+			Help: "Retries not sent because the upstream's retry budget was spent.",
+		},
+		[]string{"upstream"},
+	)
+
+	upstreamCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "relay_upstream_circuit_state",
+			Help: "Circuit breaker state by upstream, 0 closed, 1 open, 2 half-open.",
+		},
+		[]string{"upstream"},
+	)
+)
+
+// RegisterMetrics registers the upstream metrics on the given registerer
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{upstreamRequestsTotal, upstreamRequestDuration, upstreamErrorsTotal, upstreamRetriesRejected, upstreamCircuitState, shadowRequestsTotal} {
+		err := registerer.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsTransport records every attempt, so a retried request shows up once
+// per upstream call
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	// a client that went away says nothing about the upstream
+	if req.Context().Err() != nil {
+		return resp, err
+	}
+
+	upstream := req.URL.Host
+	upstreamRequestDuration.WithLabelValues(upstream).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamRequestsTotal.WithLabelValues(upstream, status).Inc()
+
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		upstreamErrorsTotal.WithLabelValues(upstream).Inc()
+	}
+
+	return resp, err
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// redirects past this many in a row go back to the client as they are
+const maxFollowedRedirects = 10
+
+type publicOriginContextKey struct{}
+
+// redirectTransport follows the upstream's redirects server side, the client
+// only sees the response at the end. Only a redirect back to the same upstream
+// host is followed, one anywhere else goes back to the client so a relay never
+// calls out to wherever an upstream points it. A 307 or 308 keeps the method
+// and body, which is only possible for a body small enough to buffer
+type redirectTransport struct {
+	base http.RoundTripper
+	// bodies over this many bytes stream through and their 307s and 308s
+	// aren't followed
+	maxBodyBytes int64
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, err := makeBodyReplayable(req, t.maxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for redirects := 0; ; redirects++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if redirects >= maxFollowedRedirects {
+			return resp, nil
+		}
+
+		next, ok := redirectRequest(req, resp)
+		if !ok {
+			return resp, nil
+		}
+
+		slog.Debug("Following an upstream redirect",
+			slog.String("Method", req.Method),
+			slog.String("Upstream", req.URL.Host),
+			slog.Int("StatusCode", resp.StatusCode),
+			slog.String("Location", next.URL.String()),
+		)
+		// drained so the connection goes back to the pool
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// helper functions
+
+// redirectRequest builds the request following resp, false when resp is not
+// a redirect the transport may follow
+func redirectRequest(req *http.Request, resp *http.Response) (*http.Request, bool) {
+	keepMethod := false
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		keepMethod = true
+	default:
+		return nil, false
+	}
+
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" || location.Host != req.URL.Host {
+		return nil, false
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return nil, false
+	}
+
+	next := req.Clone(req.Context())
+	next.URL = location
+	next.Host = ""
+
+	if keepMethod {
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, false
+			}
+			next.Body, err = req.GetBody()
+			if err != nil {
+				return nil, false
+			}
+		}
+		return next, true
+	}
+
+	// like a browser, a 301 or 302 of a POST and any 303 but a HEAD's turn
+	// into a GET without the body
+	if resp.StatusCode == http.StatusSeeOther && req.Method != http.MethodHead ||
+		req.Method == http.MethodPost {
+		next.Method = http.MethodGet
+	}
+	if next.Method != req.Method {
+		next.Body = http.NoBody
+		next.ContentLength = 0
+		next.GetBody = nil
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	} else if req.GetBody != nil {
+		next.Body, _ = req.GetBody()
+	}
+	return next, true
+}
+
+// withPublicOrigin keeps the scheme and host the client called the relay on,
+// for rewriteLocation
+func withPublicOrigin(ctx context.Context, r *http.Request) context.Context {
+	origin := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		origin.Scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" {
+		// a TLS terminating proxy in front of Relay
+		origin.Scheme = "https"
+	}
+	return context.WithValue(ctx, publicOriginContextKey{}, origin)
+}
+
+// rewriteLocation points an absolute Location at one of the upstreams to the
+// host the client called the relay on instead, so the client follows it
+// through the relay and never learns the internal URL. The path is left as
+// the upstream sent it
+func (h *RelayHandler) rewriteLocation(resp *http.Response) {
+	raw := resp.Header.Get("Location")
+	if raw == "" {
+		return
+	}
+	location, err := url.Parse(raw)
+	if err != nil || !location.IsAbs() {
+		return
+	}
+
+	origin, ok := resp.Request.Context().Value(publicOriginContextKey{}).(*url.URL)
+	if !ok || !h.isUpstreamHost(resp.Request.URL.Host, location.Host) {
+		return
+	}
+
+	location.Scheme = origin.Scheme
+	location.Host = origin.Host
+	resp.Header.Set("Location", location.String())
+}
+
+func (h *RelayHandler) isUpstreamHost(current string, host string) bool {
+	if host == current {
+		return true
+	}
+	for _, upstream := range h.balancer.Upstreams() {
+		if upstream.URL.Host == host {
+			return true
+		}
+	}
+	return false
+}
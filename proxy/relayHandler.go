@@ -0,0 +1,486 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/sash2721/Relay/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http2"
+)
+
+// the status nginx logs for a client that closed the connection before the
+// response, nobody reads it but the access log and the metrics
+const statusClientClosedRequest = 499
+
+type upstreamContextKey struct{}
+
+type failoverContextKey struct{}
+
+// errFailover is returned from ModifyResponse to hand the request to the
+// next upstream instead of passing the response on
+var errFailover = stderrors.New("failing over to the next upstream")
+
+// errTransform wraps the error of a response transformer, the upstream
+// answered and is not to blame for it
+var errTransform = stderrors.New("failed to transform the response")
+
+// failoverState follows one inbound request across the upstreams it tried
+type failoverState struct {
+	in        *http.Request
+	tried     []*Upstream
+	next      *Upstream
+	remaining int
+}
+
+// RelayHandler forwards every request to an upstream picked by the balancer,
+// keeping method, path, query, headers and body and setting X-Forwarded-*
+type RelayHandler struct {
+	balancer         *Balancer
+	proxy            *httputil.ReverseProxy
+	failoverStatuses map[int]bool
+	maxFailovers     int
+	headers          HeaderRules
+	maxReplayBytes   int64
+	shadow           *Shadow
+	transformers     []ResponseTransformer
+	tlsConfig        *tls.Config
+	dnsCache         *DNSCache
+}
+
+type RelayOptions struct {
+	// MaxRetries applies to idempotent methods only
+	MaxRetries   int
+	RetryBackoff Backoff
+	Headers      HeaderRules
+	// FailoverStatuses are the upstream statuses that send the request on to
+	// the next upstream, at most MaxFailovers times
+	FailoverStatuses []int
+	MaxFailovers     int
+	// Transport carries the requests to the upstreams, nil uses http.DefaultTransport
+	Transport http.RoundTripper
+	// MaxReplayBodyBytes is the largest body buffered so a retry or failover
+	// can send it again, larger ones stream straight to the upstream and are
+	// sent once
+	MaxReplayBodyBytes int64
+	// RetryBudget throttles the retries per upstream host, nil leaves them
+	// bounded only by MaxRetries
+	RetryBudget *RetryBudget
+	// Shadow mirrors every relayed request to a second upstream, nil mirrors none
+	Shadow *Shadow
+	// FollowRedirects follows the upstream's redirects to its own host
+	// instead of passing them on to the client
+	FollowRedirects bool
+	// Transformers rewrite every response in order before it goes back to
+	// the client, the last upstream's one after any failover
+	Transformers []ResponseTransformer
+	// TLSConfig and DNSCache are the ones of Transport, for the websocket
+	// upgrades dialed outside of it. nil keeps the defaults
+	TLSConfig *tls.Config
+	DNSCache  *DNSCache
+}
+
+// TransportOptions size the upstream connection pools
+type TransportOptions struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// MaxConnsPerHost caps dialing plus active plus idle connections, 0 is unlimited
+	MaxConnsPerHost int
+	// DNSCache resolves the upstream hosts, nil leaves it to the system resolver
+	DNSCache *DNSCache
+	// TLSConfig verifies the HTTPS upstreams, nil keeps the defaults
+	TLSConfig *tls.Config
+}
+
+// NewTransport is http.DefaultTransport with the pools sized by opts, share
+// one between relays so connections to an upstream are reused across them
+func NewTransport(opts TransportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+	if opts.DNSCache != nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = opts.DNSCache.DialContext(dialer)
+	}
+	return transport
+}
+
+// NewH2CTransport speaks HTTP/2 over cleartext TCP for upstreams that only
+// offer h2c, every request multiplexes over the connection per host
+func NewH2CTransport(opts TransportOptions) *http2.Transport {
+	dial := opts.DNSCache.DialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	return &http2.Transport{
+		AllowHTTP: true,
+		// the "TLS" dial is a plain one, there is no handshake on h2c
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+		IdleConnTimeout: opts.IdleConnTimeout,
+	}
+}
+
+// NewRelayHandler relays to a single upstream
+func NewRelayHandler(upstream string) (http.Handler, error) {
+	balancer, err := NewBalancer([]string{upstream}, &RoundRobin{}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBalancedRelayHandler(balancer, RelayOptions{}), nil
+}
+
+func NewBalancedRelayHandler(balancer *Balancer, opts RelayOptions) *RelayHandler {
+	h := &RelayHandler{
+		balancer:         balancer,
+		failoverStatuses: make(map[int]bool, len(opts.FailoverStatuses)),
+		maxFailovers:     opts.MaxFailovers,
+		headers:          opts.Headers,
+		maxReplayBytes:   opts.MaxReplayBodyBytes,
+		shadow:           opts.Shadow,
+		transformers:     opts.Transformers,
+		tlsConfig:        opts.TLSConfig,
+		dnsCache:         opts.DNSCache,
+	}
+	for _, status := range opts.FailoverStatuses {
+		h.failoverStatuses[status] = true
+	}
+
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			upstream := pr.In.Context().Value(upstreamContextKey{}).(*Upstream)
+			pr.SetURL(upstream.URL)
+			pr.SetXForwarded()
+			h.headers.Apply(pr.Out.Header)
+		},
+		Transport:      buildTransport(balancer, opts),
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.handleError,
+	}
+
+	return h
+}
+
+func (h *RelayHandler) Balancer() *Balancer {
+	return h.balancer
+}
+
+func (h *RelayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// a HEAD never carries a body upstream, whatever the client sent
+	if r.Method == http.MethodHead {
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.GetBody = nil
+	}
+
+	// an admin pinned the request to an upstream, it skips the pool and the
+	// failover
+	if target, ok := upstreamOverride(r.Context()); ok {
+		slog.Info("Relaying to an overridden upstream",
+			slog.String("Method", r.Method),
+			slog.String("Path", r.URL.Path),
+			slog.String("Upstream", target.Host),
+		)
+		h.forward(w, r, &Upstream{URL: target})
+		return
+	}
+
+	upstream, err := h.balancer.Next()
+	if err != nil {
+		slog.Warn("No healthy upstream to relay to",
+			slog.String("Method", r.Method),
+			slog.String("Path", r.URL.Path),
+		)
+		if writeGRPCError(w, r, grpcUnavailable, "No healthy upstream available") {
+			return
+		}
+		errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeServiceUnavailable, "No healthy upstream available")
+		return
+	}
+
+	// a gRPC stream is relayed as it flows, never held back to be copied or
+	// sent twice
+	if IsGRPC(r) {
+		h.forward(w, r, upstream)
+		return
+	}
+
+	// the copy goes out before the primary reads the body it shares
+	h.shadow.Mirror(r, h.headers)
+
+	// a request that may fail over keeps its body so it can be sent again
+	if h.failoverEnabled() {
+		replayable, err := makeBodyReplayable(r, h.maxReplayBytes)
+		if err != nil {
+			h.handleError(w, r, err)
+			return
+		}
+
+		if replayable {
+			state := &failoverState{remaining: h.maxFailovers}
+			r = r.WithContext(context.WithValue(r.Context(), failoverContextKey{}, state))
+			state.in = r
+		} else {
+			slog.Debug("Request body can't be replayed, relaying it without failover",
+				slog.String("Method", r.Method),
+				slog.String("Path", r.URL.Path),
+			)
+		}
+	}
+
+	h.forward(w, r, upstream)
+}
+
+func (h *RelayHandler) forward(w http.ResponseWriter, r *http.Request, upstream *Upstream) {
+	if breakers := h.balancer.CircuitBreakers(); breakers != nil && !breakers.Get(upstream.URL.Host).Allow() {
+		slog.Warn("Upstream circuit is open, failing fast",
+			slog.String("Upstream", upstream.URL.Host),
+		)
+		if writeGRPCError(w, r, grpcUnavailable, "Upstream temporarily unavailable") {
+			return
+		}
+		errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeServiceUnavailable, "Upstream temporarily unavailable")
+		return
+	}
+
+	if state, ok := r.Context().Value(failoverContextKey{}).(*failoverState); ok {
+		state.tried = append(state.tried, upstream)
+	}
+
+	if IsWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, upstream)
+		return
+	}
+
+	if expectsContinue(r) {
+		w = &continueWriter{ResponseWriter: w}
+	}
+
+	ctx := context.WithValue(withPublicOrigin(r.Context(), r), upstreamContextKey{}, upstream)
+	ctx, attempt := startTraceAttempt(ctx, upstream)
+	h.proxy.ServeHTTP(w, r.WithContext(ctx))
+	if attempt != nil {
+		attempt.log(r)
+	}
+}
+
+// modifyResponse fails over on a configured status while another upstream is
+// left to try, the last upstream's response always goes back to the client
+// through the route's transformers. An error of a transformer answers 502
+func (h *RelayHandler) modifyResponse(resp *http.Response) error {
+	if attempt := traceAttemptFromContext(resp.Request.Context()); attempt != nil {
+		attempt.setStatus(resp)
+	}
+	h.rewriteLocation(resp)
+
+	err := h.failover(resp)
+	if err != nil {
+		return err
+	}
+
+	if len(h.transformers) > 0 && transformable(resp) {
+		for _, transformer := range h.transformers {
+			err = transformer.Transform(resp.Request.Context(), resp)
+			if err != nil {
+				return fmt.Errorf("%w: %w", errTransform, err)
+			}
+		}
+	}
+
+	// the reverse proxy flushes an event stream, and a chunked or any other
+	// response of unknown length, after every write so each chunk reaches the
+	// client as it arrives. nginx in front of Relay is told not to buffer it
+	// either
+	if IsEventStream(resp.Header) || isStreamed(resp) {
+		resp.Header.Set("X-Accel-Buffering", "no")
+	}
+	return nil
+}
+
+// failover returns errFailover with the next upstream picked when resp has a
+// failover status and another upstream is left to try
+func (h *RelayHandler) failover(resp *http.Response) error {
+	if !h.failoverStatuses[resp.StatusCode] {
+		return nil
+	}
+
+	state, ok := resp.Request.Context().Value(failoverContextKey{}).(*failoverState)
+	if !ok || state.remaining <= 0 {
+		return nil
+	}
+
+	next, err := h.balancer.NextExcept(state.tried)
+	if err != nil {
+		return nil
+	}
+
+	slog.Warn("Failing over to the next upstream",
+		slog.String("Method", resp.Request.Method),
+		slog.String("Upstream", resp.Request.URL.Host),
+		slog.Int("StatusCode", resp.StatusCode),
+		slog.String("Next", next.URL.Host),
+	)
+	state.next = next
+	state.remaining--
+	return errFailover
+}
+
+func (h *RelayHandler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	// r is the outbound request here, the failover starts over from the inbound one
+	if err == errFailover {
+		if attempt := traceAttemptFromContext(r.Context()); attempt != nil {
+			attempt.setFailedOver()
+		}
+		state := r.Context().Value(failoverContextKey{}).(*failoverState)
+		if state.in.GetBody != nil {
+			state.in.Body, _ = state.in.GetBody()
+		}
+		h.forward(w, state.in, state.next)
+		return
+	}
+
+	if IsGRPC(r) {
+		h.handleGRPCError(w, r, err)
+		return
+	}
+
+	// the client sent too much, the upstream is not to blame
+	if isBodyTooLarge(err) {
+		slog.Warn("Relayed request body too large",
+			slog.String("Method", r.Method),
+			slog.String("Path", r.URL.Path),
+		)
+		errors.WriteError(w, http.StatusRequestEntityTooLarge, errors.CodePayloadTooLarge, "Request body too large")
+		return
+	}
+
+	// the inbound deadline fired, RequestTimeoutMiddleware answers with 503
+	if r.Context().Err() == context.DeadlineExceeded {
+		slog.Warn("Relayed request cancelled by the request timeout",
+			slog.String("Method", r.Method),
+			slog.String("Path", r.URL.Path),
+		)
+		errors.WriteError(w, http.StatusServiceUnavailable, errors.CodeTimeout, "Request timed out")
+		return
+	}
+
+	// the client went away, so did the outbound request, the upstream is not to blame
+	if r.Context().Err() == context.Canceled {
+		slog.Info("Client disconnected, relayed request cancelled",
+			slog.String("Method", r.Method),
+			slog.String("Path", r.URL.Path),
+			slog.String("Upstream", r.URL.Host),
+		)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+
+	if stderrors.Is(err, errTransform) {
+		slog.Error("Failed to transform the relayed response",
+			slog.String("Method", r.Method),
+			slog.String("Path", r.URL.Path),
+			slog.String("Upstream", r.URL.Host),
+			slog.Any("Error", err),
+		)
+		errors.WriteError(w, http.StatusBadGateway, errors.CodeBadGateway, "Upstream response could not be transformed")
+		return
+	}
+
+	upstream, _ := r.Context().Value(upstreamContextKey{}).(*Upstream)
+	if upstream != nil {
+		h.balancer.MarkFailed(upstream)
+	}
+
+	relayErrorHandler(w, r, err)
+}
+
+// helper functions
+
+// circuit breaking wraps retries so a request counts once on the breaker, and
+// a followed redirect retries on its own
+func buildTransport(balancer *Balancer, opts RelayOptions) http.RoundTripper {
+	base := opts.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// the otel transport links the upstream span to the inbound one
+	var transport http.RoundTripper = &retryTransport{
+		base:         &metricsTransport{base: otelhttp.NewTransport(base)},
+		maxRetries:   opts.MaxRetries,
+		backoff:      opts.RetryBackoff,
+		maxBodyBytes: opts.MaxReplayBodyBytes,
+		budget:       opts.RetryBudget,
+	}
+	if opts.FollowRedirects {
+		transport = &redirectTransport{base: transport, maxBodyBytes: opts.MaxReplayBodyBytes}
+	}
+
+	if breakers := balancer.CircuitBreakers(); breakers != nil {
+		transport = &breakerTransport{base: transport, breakers: breakers}
+	}
+
+	return transport
+}
+
+// IsEventStream reports whether header describes a text/event-stream response
+func IsEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// isStreamed reports whether resp has no length up front, it is then sent
+// with chunked encoding whatever the upstream used
+func isStreamed(resp *http.Response) bool {
+	return resp.ContentLength < 0 && resp.Request.Method != http.MethodHead && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+func (h *RelayHandler) failoverEnabled() bool {
+	return len(h.failoverStatuses) > 0 && h.maxFailovers > 0
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return stderrors.As(err, &maxBytesError)
+}
+
+func parseUpstream(upstream string) (*url.URL, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL %q: %w", upstream, err)
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream URL %q: scheme must be http or https", upstream)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("invalid upstream URL %q: host is missing", upstream)
+	}
+
+	return target, nil
+}
+
+func relayErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Error("Failed to relay the request upstream",
+		slog.String("Method", r.Method),
+		slog.String("Path", r.URL.Path),
+		slog.String("Upstream", r.URL.Host),
+		slog.Any("Error", err),
+	)
+
+	errors.WriteError(w, http.StatusBadGateway, errors.CodeBadGateway, "Upstream is unreachable")
+}
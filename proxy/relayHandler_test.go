@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+func TestRelayCancelsUpstreamWhenClientDisconnects(t *testing.T) {
+	arrived := make(chan struct{})
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+			io.WriteString(w, "too late")
+		}
+	}))
+	defer upstream.Close()
+
+	balancer, err := NewBalancer([]string{upstream.URL}, &RoundRobin{}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(NewBalancedRelayHandler(balancer, RelayOptions{}))
+	defer front.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, front.URL+"/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request never reached the upstream")
+	}
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not cancelled after the client disconnected")
+	}
+	if err := <-done; err == nil {
+		t.Error("the cancelled client request succeeded")
+	}
+
+	// the client left, the upstream stays in the pool. Close waits for the
+	// relay to finish handling the error
+	front.Close()
+	if !balancer.Available()[upstream.Listener.Addr().String()] {
+		t.Errorf("upstream marked failed after a client disconnect: %v", balancer.Available())
+	}
+}
+
+func TestRelayForwardsHeadWithoutBody(t *testing.T) {
+	type received struct {
+		method        string
+		contentLength int64
+		body          int
+	}
+	requests := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{method: r.Method, contentLength: r.ContentLength, body: len(body)}
+		w.Header().Set("Content-Length", "42")
+		w.Header().Set("Content-Type", "text/plain")
+	}))
+	defer upstream.Close()
+
+	relay := newTestRelay(t, upstream.URL, RelayOptions{})
+	rec := httptest.NewRecorder()
+	relay.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/files/report", strings.NewReader("a body a HEAD must not carry")))
+
+	got := <-requests
+	if got.method != http.MethodHead {
+		t.Errorf("upstream method = %s, want HEAD", got.method)
+	}
+	if got.contentLength != 0 || got.body != 0 {
+		t.Errorf("upstream got Content-Length %d and a %d byte body, want none", got.contentLength, got.body)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Header().Get("Content-Length") != "42" {
+		t.Errorf("Content-Length = %q, want the upstream's 42", rec.Header().Get("Content-Length"))
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("the relay wrote a %d byte body for HEAD", rec.Body.Len())
+	}
+}
+
+func TestRelayStreamsChunkedResponse(t *testing.T) {
+	const chunks = 3
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range chunks {
+			fmt.Fprintf(w, "chunk %d\n", i)
+			w.(http.Flusher).Flush()
+			// the next chunk only goes out once the client has this one, a
+			// relay holding the body back never gets it
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	front := httptest.NewServer(newTestRelay(t, upstream.URL, RelayOptions{}))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Transfer-Encoding = %v, want chunked", resp.TransferEncoding)
+	}
+	if resp.Header.Get("X-Accel-Buffering") != "no" {
+		t.Errorf("X-Accel-Buffering = %q, want no", resp.Header.Get("X-Accel-Buffering"))
+	}
+
+	lines := bufio.NewReader(resp.Body)
+	for i := range chunks {
+		started := time.Now()
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if line != fmt.Sprintf("chunk %d\n", i) {
+			t.Fatalf("chunk %d = %q", i, line)
+		}
+		if waited := time.Since(started); waited > 2*time.Second {
+			t.Fatalf("chunk %d took %v, it was held back", i, waited)
+		}
+		received <- struct{}{}
+	}
+}
+
+func TestRouteRelayToH2CUpstream(t *testing.T) {
+	protos := make(chan string, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+		io.WriteString(w, "over h2c")
+	}))
+	// HTTP/2 with prior knowledge only, an HTTP/1.1 request never gets through
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	relay, err := NewRouteRelay(&configs.ServerConfig{}, Route{Upstreams: []string{upstream.URL}, H2C: true}, nil)
+	if err != nil {
+		t.Fatalf("NewRouteRelay: %v", err)
+	}
+	front := httptest.NewServer(relay)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/h2c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "over h2c" {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "over h2c")
+	}
+	if proto := <-protos; proto != "HTTP/2.0" {
+		t.Errorf("the upstream got %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestRelayStreamsLargeBodyWithBoundedMemory(t *testing.T) {
+	const bodySize = 128 << 20
+
+	received := make(chan int64, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received <- n
+	}))
+	defer upstream.Close()
+
+	// a PUT is retried and may fail over, only a body up to 1 MiB is buffered for that
+	relay := newTestRelay(t, upstream.URL, RelayOptions{
+		MaxRetries:         2,
+		FailoverStatuses:   []int{http.StatusBadGateway},
+		MaxFailovers:       1,
+		MaxReplayBodyBytes: 1 << 20,
+	})
+	front := httptest.NewServer(relay)
+	defer front.Close()
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// no Content-Length, the upload is sent chunked like an unbounded stream
+	req, err := http.NewRequest(http.MethodPut, front.URL+"/upload", io.LimitReader(zeros{}, bodySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if n := <-received; n != bodySize {
+		t.Errorf("the upstream received %d bytes, want %d", n, bodySize)
+	}
+	// the body is copied through fixed buffers, what was allocated while it
+	// streamed is a fraction of its size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > bodySize/8 {
+		t.Errorf("relaying a %d byte body allocated %d bytes", bodySize, allocated)
+	}
+}
+
+func BenchmarkRelayTransport(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	transports := []struct {
+		name      string
+		transport *http.Transport
+	}{
+		{name: "default", transport: http.DefaultTransport.(*http.Transport).Clone()},
+		{name: "tuned", transport: NewTransport(TransportOptions{
+			MaxIdleConns:        512,
+			MaxIdleConnsPerHost: 256,
+			IdleConnTimeout:     90 * time.Second,
+		})},
+	}
+
+	for _, tt := range transports {
+		b.Run(tt.name, func(b *testing.B) {
+			defer tt.transport.CloseIdleConnections()
+			relay := newTestRelay(b, upstream.URL, RelayOptions{Transport: tt.transport})
+			front := httptest.NewServer(relay)
+			defer front.Close()
+
+			// the client side keeps its connections, only the relay's pool differs
+			client := &http.Client{Transport: NewTransport(TransportOptions{MaxIdleConns: 512, MaxIdleConnsPerHost: 256})}
+			defer client.CloseIdleConnections()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(front.URL + "/bench")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
+
+// helper functions
+
+// zeros is an endless body
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// newTestRelay relays to the one upstream with opts
+func newTestRelay(tb testing.TB, upstream string, opts RelayOptions) *RelayHandler {
+	tb.Helper()
+	balancer, err := NewBalancer([]string{upstream}, &RoundRobin{}, 0)
+	if err != nil {
+		tb.Fatalf("NewBalancer: %v", err)
+	}
+	return NewBalancedRelayHandler(balancer, opts)
+}
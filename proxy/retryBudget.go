@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// a budget never holds more retries than this, or a second of its floor
+const retryBudgetBurst = 10
+
+// RetryBudget caps the retries sent to each upstream host: every request
+// earns ratio of a retry, every retry spends a whole one and minPerSecond
+// trickle in regardless. While an upstream fails for everyone its budget
+// runs dry and the requests fail fast instead of multiplying the traffic
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond float64
+	capacity     float64
+
+	mu      sync.Mutex
+	buckets map[string]*retryBucket
+}
+
+type retryBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRetryBudget allows retries of up to ratio of the requests to a host,
+// plus minPerSecond a second
+func NewRetryBudget(ratio float64, minPerSecond float64) *RetryBudget {
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		capacity:     max(retryBudgetBurst, minPerSecond),
+		buckets:      make(map[string]*retryBucket),
+	}
+}
+
+// Deposit credits a request sent to host, a nil budget ignores it
+func (b *RetryBudget) Deposit(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket := b.refill(host)
+	bucket.tokens = min(b.capacity, bucket.tokens+b.ratio)
+}
+
+// Withdraw spends a retry of host and reports whether one was left, a nil
+// budget always allows it
+func (b *RetryBudget) Withdraw(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket := b.refill(host)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// helper functions
+
+// refill adds the floor earned since the last call, a new host starts with
+// a full budget
+func (b *RetryBudget) refill(host string) *retryBucket {
+	now := time.Now()
+	bucket, ok := b.buckets[host]
+	if !ok {
+		bucket = &retryBucket{tokens: b.capacity, updated: now}
+		b.buckets[host] = bucket
+		return bucket
+	}
+
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = min(b.capacity, bucket.tokens+elapsed*b.minPerSecond)
+	bucket.updated = now
+	return bucket
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+}
+
+// retryTransport retries idempotent requests that failed before any response
+// came back, once RoundTrip returns a response it is never retried
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	backoff    Backoff
+	// bodies over this many bytes stream through and are never retried
+	maxBodyBytes int64
+	// budget throttles the retries per upstream, nil leaves them unlimited
+	budget *RetryBudget
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.maxRetries <= 0 || !idempotentMethods[req.Method] {
+		return t.base.RoundTrip(req)
+	}
+	t.budget.Deposit(req.URL.Host)
+
+	replayable, err := makeBodyReplayable(req, t.maxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return t.base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if req.GetBody != nil {
+				req.Body, err = req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			delay := t.backoff.Next(attempt)
+			slog.Warn("Retrying relayed request",
+				slog.String("Method", req.Method),
+				slog.String("Upstream", req.URL.Host),
+				slog.Int("Attempt", attempt),
+				slog.Duration("Delay", delay),
+			)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			case <-timer.C:
+			}
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+
+		if attempt >= t.maxRetries || req.Context().Err() != nil {
+			return nil, err
+		}
+		if !t.budget.Withdraw(req.URL.Host) {
+			slog.Warn("Retry budget spent, failing fast",
+				slog.String("Method", req.Method),
+				slog.String("Upstream", req.URL.Host),
+			)
+			upstreamRetriesRejected.WithLabelValues(req.URL.Host).Inc()
+			return nil, err
+		}
+	}
+}
+
+// helper functions
+
+// makeBodyReplayable buffers the body of req so it can be sent again, up to
+// limit bytes. A larger body, declared or turning out so while read, is left
+// streaming from the client and reported as not replayable, so an upload of
+// any size never sits in memory whole. So is the body of a client waiting for
+// 100 Continue, reading it would have the client send it before the upstream
+// agreed to take it
+func makeBodyReplayable(req *http.Request, limit int64) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true, nil
+	}
+	if expectsContinue(req) {
+		return false, nil
+	}
+	if req.ContentLength > limit {
+		return false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		req.Body.Close()
+		return false, err
+	}
+	if int64(len(body)) > limit {
+		// the bytes already read go out first, the rest streams on
+		req.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		return false, nil
+	}
+	req.Body.Close()
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// prefixedBody reads the buffered start of a body before the rest of it
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
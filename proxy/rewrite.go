@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Rewrite changes the outbound path and query of a route before relaying,
+// Prefix replaces the matched route prefix, RemoveQuery drops parameters and
+// SetQuery adds or replaces them
+type Rewrite struct {
+	Prefix      string            `yaml:"prefix"`
+	RemoveQuery []string          `yaml:"remove_query"`
+	SetQuery    map[string]string `yaml:"set_query"`
+}
+
+// Key names the route by its prefix and query conditions, two routes may
+// share a prefix as long as their keys differ
+func (r Route) Key() string {
+	if len(r.Query) == 0 {
+		return r.Prefix
+	}
+	names := make([]string, 0, len(r.Query))
+	for name := range r.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conditions := make([]string, len(names))
+	for i, name := range names {
+		conditions[i] = name + "=" + r.Query[name]
+	}
+	return r.Prefix + "?" + strings.Join(conditions, "&")
+}
+
+// MatchesQuery reports whether query carries every parameter of r.Query,
+// "*" accepts any value as long as the parameter is there
+func (r Route) MatchesQuery(query url.Values) bool {
+	for name, want := range r.Query {
+		values, ok := query[name]
+		if !ok {
+			return false
+		}
+		if want != "*" && !slices.Contains(values, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// RewriteHandler applies the route's strip_prefix and rewrite settings to the
+// request before next relays it. The parameters it doesn't touch keep their
+// original encoding, only the ones it sets are encoded by it
+func RewriteHandler(route Route, next http.Handler) http.Handler {
+	rewrite := route.Rewrite
+	if rewrite == nil {
+		if route.StripPrefix {
+			return http.StripPrefix(route.Prefix, next)
+		}
+		return next
+	}
+
+	replacement := ""
+	switch {
+	case rewrite.Prefix != "":
+		replacement = strings.TrimSuffix(rewrite.Prefix, "/")
+	case !route.StripPrefix:
+		replacement = route.Prefix
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+
+		r2.URL.Path = replacePrefix(r.URL.Path, route.Prefix, replacement)
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = replacePrefix(r.URL.RawPath, route.Prefix, replacement)
+		}
+		r2.URL.RawQuery = rewriteQuery(r.URL.RawQuery, rewrite.RemoveQuery, rewrite.SetQuery)
+		r2.RequestURI = r2.URL.RequestURI()
+
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// helper functions
+
+func replacePrefix(path, prefix, replacement string) string {
+	rest := strings.TrimPrefix(path, prefix)
+	path = replacement + rest
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// rewriteQuery edits the raw query pair by pair, so the pairs it keeps stay
+// byte for byte what the client sent, set parameters go at the end in name
+// order
+func rewriteQuery(rawQuery string, remove []string, set map[string]string) string {
+	if len(remove) == 0 && len(set) == 0 {
+		return rawQuery
+	}
+
+	var pairs []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if _, replaced := set[name]; replaced || slices.Contains(remove, name) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(set[name]))
+	}
+
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"crypto/tls"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+	"golang.org/x/net/http2"
+	"gopkg.in/yaml.v3"
+)
+
+// Route relays every request under Prefix to its own upstream pool, a zero
+// Timeout, BodyReadTimeout or RetryBackoff and a nil Retries fall back to the
+// server settings.
+// Routes may share a prefix when their Query conditions differ
+type Route struct {
+	Prefix    string        `yaml:"prefix"`
+	Upstreams []string      `yaml:"upstreams"`
+	Timeout   time.Duration `yaml:"timeout"`
+	// BodyReadTimeout is the time the client gets to send the request body,
+	// past READ_TIMEOUT for an upload route
+	BodyReadTimeout time.Duration `yaml:"body_read_timeout"`
+	Retries         *int          `yaml:"retries"`
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`
+	// StripPrefix relays /prefix/users as /users
+	StripPrefix bool `yaml:"strip_prefix"`
+	// H2C talks HTTP/2 over cleartext to upstreams that only speak that
+	H2C bool `yaml:"h2c"`
+	// GRPC relays gRPC calls, over h2c to http upstreams and HTTP/2 to https
+	// ones, streamed both ways with the grpc-status trailers kept and never
+	// retried or redirected
+	GRPC bool `yaml:"grpc"`
+	// Query only matches requests carrying these parameters, see MatchesQuery
+	Query   map[string]string `yaml:"query"`
+	Rewrite *Rewrite          `yaml:"rewrite"`
+	// ContentTypes the route accepts request bodies in, empty falls back to
+	// RELAY_CONTENT_TYPES
+	ContentTypes []string `yaml:"content_types"`
+	// Middleware are the policies of the route, see RouteMiddleware
+	Middleware []RouteMiddleware `yaml:"middleware"`
+	// Transform rewrites the route's responses in order, see RouteTransform
+	Transform []RouteTransform `yaml:"transform"`
+}
+
+// names of the route middleware
+const (
+	MiddlewareAPIKey    = "api_key"
+	MiddlewarePublic    = "public"
+	MiddlewareJWT       = "jwt"
+	MiddlewareRateLimit = "rate_limit"
+	MiddlewareBodyLimit = "body_limit"
+	MiddlewareSignature = "signature"
+)
+
+// RouteMiddleware is one policy of a route: api_key checks API_KEYS, public
+// skips that check and jwt requires a login token instead, a route without
+// any of the three checks API_KEYS. rate_limit allows RPS requests a second
+// per client with Burst on top, body_limit replaces RELAY_MAX_BODY_BYTES
+// with MaxBytes and signature requires an HMAC of the raw body keyed with
+// WEBHOOK_SECRET
+type RouteMiddleware struct {
+	Name     string  `yaml:"name"`
+	RPS      float64 `yaml:"rps"`
+	Burst    int     `yaml:"burst"`
+	MaxBytes int64   `yaml:"max_bytes"`
+}
+
+type routesFile struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// LoadRoutes reads the route table at path and reports every invalid route at once
+func LoadRoutes(path string) ([]Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the routes file: %w", err)
+	}
+	defer file.Close()
+
+	var parsed routesFile
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&parsed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %w", path, err)
+	}
+
+	err = validateRoutes(parsed.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %w", path, err)
+	}
+
+	return parsed.Routes, nil
+}
+
+// every relay built from the config shares one transport, so a route table
+// reload keeps the idle connections
+var sharedTransport struct {
+	once      sync.Once
+	transport *http.Transport
+	// the upstream TLS settings as loaded, the transport adds its own
+	// NextProtos to the copy it holds
+	tlsConfig *tls.Config
+}
+
+var sharedDNSCache struct {
+	once  sync.Once
+	cache *DNSCache
+}
+
+// one budget per upstream host no matter how many routes share the host
+var sharedRetryBudget struct {
+	once   sync.Once
+	budget *RetryBudget
+}
+
+var sharedH2CTransport struct {
+	once      sync.Once
+	transport *http2.Transport
+}
+
+// every relay mirrors to the one SHADOW_UPSTREAM and shares its in-flight cap
+var sharedShadow struct {
+	once   sync.Once
+	shadow *Shadow
+	err    error
+}
+
+// NewRouteRelay balances route across its upstreams with the cooldown, breaker,
+// header, failover, connection pool and shadow settings of cfg and the route's
+// own retries, health may be nil to skip the background health checks
+func NewRouteRelay(cfg *configs.ServerConfig, route Route, health *HealthPoller) (*RelayHandler, error) {
+	balancer, err := NewBalancer(route.Upstreams, &RoundRobin{}, cfg.UpstreamCooldown)
+	if err != nil {
+		return nil, err
+	}
+	health.Watch(balancer)
+	if cfg.BreakerThreshold > 0 {
+		balancer.UseCircuitBreakers(NewBreakerRegistry(cfg.BreakerThreshold, cfg.BreakerResetTimeout))
+	}
+
+	opts := RelayOptions{
+		MaxRetries: cfg.RelayMaxRetries,
+		RetryBackoff: Backoff{
+			Base:       cfg.RelayRetryBackoff,
+			Multiplier: cfg.RelayRetryBackoffMultiplier,
+			Max:        cfg.RelayRetryBackoffMax,
+			Jitter:     cfg.RelayRetryJitter,
+		},
+		Headers: HeaderRules{
+			Set:    cfg.RelaySetHeaders,
+			Remove: cfg.RelayRemoveHeaders,
+		},
+		FailoverStatuses:   cfg.RelayFailoverStatuses,
+		MaxFailovers:       cfg.RelayMaxFailovers,
+		Transport:          ConfiguredTransport(cfg),
+		MaxReplayBodyBytes: cfg.RelayReplayMaxBodyBytes,
+		RetryBudget:        configuredRetryBudget(cfg),
+		FollowRedirects:    cfg.RelayRedirects == "follow",
+		TLSConfig:          configuredUpstreamTLS(cfg),
+		DNSCache:           configuredDNSCache(cfg),
+	}
+	if route.Retries != nil {
+		opts.MaxRetries = *route.Retries
+	}
+	if route.RetryBackoff > 0 {
+		opts.RetryBackoff.Base = route.RetryBackoff
+	}
+	if route.H2C {
+		opts.Transport = configuredH2CTransport(cfg)
+	}
+	if route.GRPC {
+		// the https upstreams negotiate HTTP/2 on the shared transport
+		if balancer.Upstreams()[0].URL.Scheme == "http" {
+			opts.Transport = configuredH2CTransport(cfg)
+		}
+		opts.MaxRetries = 0
+		opts.FollowRedirects = false
+	}
+	opts.Shadow, err = configuredShadow(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts.Transformers, err = buildTransformers(route.Transform)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBalancedRelayHandler(balancer, opts), nil
+}
+
+// helper functions
+
+// validateRoutes also trims the trailing slash off every prefix so /api and
+// /api/ count as the same route
+func validateRoutes(routes []Route) error {
+	var problems []error
+	seen := make(map[string]int, len(routes))
+
+	for i := range routes {
+		route := &routes[i]
+		route.Prefix = strings.TrimSuffix(strings.TrimSpace(route.Prefix), "/")
+		name := fmt.Sprintf("route %d (%s)", i+1, route.Key())
+
+		switch {
+		case route.Prefix == "":
+			problems = append(problems, fmt.Errorf("%s: prefix must be a path below /", name))
+		case !strings.HasPrefix(route.Prefix, "/"):
+			problems = append(problems, fmt.Errorf("%s: prefix must start with /", name))
+		case strings.ContainsAny(route.Prefix, "{}*"):
+			problems = append(problems, fmt.Errorf("%s: prefix must be a plain path", name))
+		}
+		if first, ok := seen[route.Key()]; ok {
+			problems = append(problems, fmt.Errorf("%s: prefix and query already used by route %d", name, first))
+		} else {
+			seen[route.Key()] = i + 1
+		}
+		for param := range route.Query {
+			if param == "" {
+				problems = append(problems, fmt.Errorf("%s: query parameter names must not be empty", name))
+			}
+		}
+		if rewrite := route.Rewrite; rewrite != nil && rewrite.Prefix != "" {
+			if !strings.HasPrefix(rewrite.Prefix, "/") {
+				problems = append(problems, fmt.Errorf("%s: rewrite prefix must start with /", name))
+			}
+			if route.StripPrefix {
+				problems = append(problems, fmt.Errorf("%s: strip_prefix and rewrite prefix cannot be combined", name))
+			}
+		}
+
+		if len(route.Upstreams) == 0 {
+			problems = append(problems, fmt.Errorf("%s: at least one upstream is required", name))
+		}
+		schemes := make(map[string]bool, 2)
+		for _, upstream := range route.Upstreams {
+			target, err := parseUpstream(upstream)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			if route.H2C && target.Scheme != "http" {
+				problems = append(problems, fmt.Errorf("%s: h2c upstream %s must be an http URL", name, upstream))
+			}
+			schemes[target.Scheme] = true
+		}
+		if route.GRPC {
+			// one transport carries every call of the route, h2c or HTTP/2 over TLS
+			if len(schemes) > 1 {
+				problems = append(problems, fmt.Errorf("%s: grpc upstreams must be all http or all https", name))
+			}
+			if len(route.Transform) > 0 {
+				problems = append(problems, fmt.Errorf("%s: grpc and transform cannot be combined", name))
+			}
+		}
+
+		problems = append(problems, validateRouteMiddleware(name, route.Middleware)...)
+		if _, err := buildTransformers(route.Transform); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", name, err))
+		}
+		for _, contentType := range route.ContentTypes {
+			if !validMediaPattern(contentType) {
+				problems = append(problems, fmt.Errorf("%s: content type %q must be type/subtype or type/*", name, contentType))
+			}
+		}
+
+		if route.Timeout < 0 {
+			problems = append(problems, fmt.Errorf("%s: timeout must not be negative", name))
+		}
+		if route.BodyReadTimeout < 0 {
+			problems = append(problems, fmt.Errorf("%s: body_read_timeout must not be negative", name))
+		}
+		if route.Retries != nil && *route.Retries < 0 {
+			problems = append(problems, fmt.Errorf("%s: retries must not be negative", name))
+		}
+		if route.RetryBackoff < 0 {
+			problems = append(problems, fmt.Errorf("%s: retry_backoff must not be negative", name))
+		}
+	}
+
+	return stderrors.Join(problems...)
+}
+
+// validateRouteMiddleware rejects unknown names right away so a typo never
+// leaves a route without the policy it was meant to have
+func validateRouteMiddleware(name string, middleware []RouteMiddleware) []error {
+	var problems []error
+	seen := make(map[string]bool, len(middleware))
+	auth := 0
+
+	for _, m := range middleware {
+		if seen[m.Name] {
+			problems = append(problems, fmt.Errorf("%s: middleware %s listed twice", name, m.Name))
+			continue
+		}
+		seen[m.Name] = true
+
+		switch m.Name {
+		case MiddlewareAPIKey, MiddlewarePublic, MiddlewareJWT:
+			auth++
+		case MiddlewareRateLimit:
+			if m.RPS <= 0 {
+				problems = append(problems, fmt.Errorf("%s: rate_limit needs a positive rps", name))
+			}
+			if m.Burst < 0 {
+				problems = append(problems, fmt.Errorf("%s: rate_limit burst must not be negative", name))
+			}
+		case MiddlewareBodyLimit:
+			if m.MaxBytes <= 0 {
+				problems = append(problems, fmt.Errorf("%s: body_limit needs a positive max_bytes", name))
+			}
+		case MiddlewareSignature:
+		default:
+			problems = append(problems, fmt.Errorf("%s: unknown middleware %q, must be one of %s, %s, %s, %s, %s or %s",
+				name, m.Name, MiddlewareAPIKey, MiddlewarePublic, MiddlewareJWT, MiddlewareRateLimit, MiddlewareBodyLimit, MiddlewareSignature))
+		}
+	}
+	if auth > 1 {
+		problems = append(problems, fmt.Errorf("%s: only one of api_key, public and jwt may be listed", name))
+	}
+
+	return problems
+}
+
+func validMediaPattern(pattern string) bool {
+	kind, subtype, ok := strings.Cut(pattern, "/")
+	return ok && kind != "" && subtype != "" && !strings.ContainsAny(pattern, "; ")
+}
+
+// ConfiguredTransport is the transport every relay built from cfg shares, with
+// its pool, DNS and upstream TLS settings
+func ConfiguredTransport(cfg *configs.ServerConfig) *http.Transport {
+	sharedTransport.once.Do(func() {
+		// Validate already rejected a CA file that doesn't load
+		tlsConfig, err := cfg.UpstreamTLSConfig()
+		if err != nil {
+			slog.Error("Invalid upstream TLS settings, using the defaults", slog.Any("Error", err))
+		}
+		if cfg.UpstreamInsecureSkipVerify {
+			slog.Warn("UPSTREAM TLS VERIFICATION IS DISABLED, relayed HTTPS calls accept any certificate. Never set UPSTREAM_INSECURE_SKIP_VERIFY outside of development",
+				slog.String("Env", cfg.Env),
+			)
+		}
+
+		sharedTransport.tlsConfig = tlsConfig
+		var transportTLS *tls.Config
+		if tlsConfig != nil {
+			transportTLS = tlsConfig.Clone()
+		}
+		sharedTransport.transport = NewTransport(TransportOptions{
+			MaxIdleConns:        cfg.RelayMaxIdleConns,
+			MaxIdleConnsPerHost: cfg.RelayMaxIdleConnsPerHost,
+			IdleConnTimeout:     cfg.RelayIdleConnTimeout,
+			MaxConnsPerHost:     cfg.RelayMaxConnsPerHost,
+			DNSCache:            configuredDNSCache(cfg),
+			TLSConfig:           transportTLS,
+		})
+	})
+	return sharedTransport.transport
+}
+
+// configuredUpstreamTLS is the upstream TLS config ConfiguredTransport loaded,
+// nil for the defaults
+func configuredUpstreamTLS(cfg *configs.ServerConfig) *tls.Config {
+	ConfiguredTransport(cfg)
+	return sharedTransport.tlsConfig
+}
+
+func configuredH2CTransport(cfg *configs.ServerConfig) *http2.Transport {
+	sharedH2CTransport.once.Do(func() {
+		sharedH2CTransport.transport = NewH2CTransport(TransportOptions{
+			IdleConnTimeout: cfg.RelayIdleConnTimeout,
+			DNSCache:        configuredDNSCache(cfg),
+		})
+	})
+	return sharedH2CTransport.transport
+}
+
+// a ratio of 0 turns the budget off
+func configuredRetryBudget(cfg *configs.ServerConfig) *RetryBudget {
+	sharedRetryBudget.once.Do(func() {
+		if cfg.RelayRetryBudgetRatio > 0 {
+			sharedRetryBudget.budget = NewRetryBudget(cfg.RelayRetryBudgetRatio, cfg.RelayRetryBudgetMinPerSecond)
+		}
+	})
+	return sharedRetryBudget.budget
+}
+
+// configuredShadow is nil while SHADOW_UPSTREAM is empty
+func configuredShadow(cfg *configs.ServerConfig) (*Shadow, error) {
+	sharedShadow.once.Do(func() {
+		if cfg.ShadowUpstream == "" {
+			return
+		}
+		sharedShadow.shadow, sharedShadow.err = NewShadow(cfg.ShadowUpstream, ConfiguredTransport(cfg), cfg.ShadowTimeout, cfg.ShadowMaxBodyBytes)
+		if sharedShadow.err == nil {
+			slog.Info("Mirroring relayed requests to the shadow upstream", slog.String("Upstream", sharedShadow.shadow.target.Host))
+		}
+	})
+	return sharedShadow.shadow, sharedShadow.err
+}
+
+func configuredDNSCache(cfg *configs.ServerConfig) *DNSCache {
+	sharedDNSCache.once.Do(func() {
+		sharedDNSCache.cache = NewDNSCache(cfg.RelayDNSCacheTTL, cfg.RelayDNSRetries)
+	})
+	return sharedDNSCache.cache
+}
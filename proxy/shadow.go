@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ShadowHeader marks a mirrored request so the shadow upstream can tell
+	// it from real traffic
+	ShadowHeader = "X-Relay-Shadow"
+	// mirrored requests still waiting on the shadow past this many are
+	// dropped, a slow shadow must not pile up goroutines
+	shadowMaxInFlight = 64
+)
+
+var shadowRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "relay_shadow_requests_total",
+		Help: "Relayed requests mirrored to SHADOW_UPSTREAM by result, \"sent\", \"error\", \"skipped\" for a body too large to copy and \"dropped\" while too many were in flight.",
+	},
+	[]string{"result"},
+)
+
+// Shadow mirrors a copy of every relayed request to a second upstream and
+// throws its answer away, for trying a new backend on real traffic. The copy
+// is sent on its own goroutine with a context of its own, so neither the
+// shadow's latency nor its errors ever reach the client
+type Shadow struct {
+	target       *url.URL
+	transport    http.RoundTripper
+	timeout      time.Duration
+	maxBodyBytes int64
+	inFlight     chan struct{}
+}
+
+// NewShadow mirrors to upstream through transport, nil uses
+// http.DefaultTransport. Bodies over maxBodyBytes aren't mirrored, and a
+// mirrored request is given up on after timeout
+func NewShadow(upstream string, transport http.RoundTripper, timeout time.Duration, maxBodyBytes int64) (*Shadow, error) {
+	target, err := parseUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Shadow{
+		target:       target,
+		transport:    transport,
+		timeout:      timeout,
+		maxBodyBytes: maxBodyBytes,
+		inFlight:     make(chan struct{}, shadowMaxInFlight),
+	}, nil
+}
+
+// Mirror sends a copy of r to the shadow upstream and returns at once. It
+// buffers r's body up to the shadow limit so the primary still reads all of
+// it, a larger or a 100-continue body leaves the request unmirrored
+func (s *Shadow) Mirror(r *http.Request, headers HeaderRules) {
+	if s == nil || IsWebSocketUpgrade(r) {
+		return
+	}
+
+	replayable, err := makeBodyReplayable(r, s.maxBodyBytes)
+	if err != nil || !replayable {
+		shadowRequestsTotal.WithLabelValues("skipped").Inc()
+		return
+	}
+
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		shadowRequestsTotal.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	// the copy outlives the inbound request, it only keeps its values
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), s.timeout)
+	outreq, err := s.request(ctx, r, headers)
+	if err != nil {
+		cancel()
+		<-s.inFlight
+		shadowRequestsTotal.WithLabelValues("error").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-s.inFlight }()
+		defer cancel()
+		s.send(outreq)
+	}()
+}
+
+// helper functions
+
+// request copies r for the shadow upstream, the way the reverse proxy
+// rewrites it for the primary
+func (s *Shadow) request(ctx context.Context, r *http.Request, headers HeaderRules) (*http.Request, error) {
+	outreq := r.Clone(ctx)
+	outreq.Body = http.NoBody
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outreq.Body = body
+	}
+
+	target := *s.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	target.RawPath = ""
+	outreq.URL = &target
+	outreq.URL.RawQuery = joinQuery(s.target.RawQuery, r.URL.RawQuery)
+	outreq.Host = s.target.Host
+	outreq.RequestURI = ""
+
+	for _, name := range hopByHopHeaders {
+		outreq.Header.Del(name)
+	}
+	outreq.Header.Del("Forwarded")
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	outreq.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		outreq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outreq.Header.Set("X-Forwarded-Proto", "http")
+	}
+	outreq.Header.Set(ShadowHeader, "true")
+
+	headers.Apply(outreq.Header)
+	return outreq, nil
+}
+
+func (s *Shadow) send(outreq *http.Request) {
+	resp, err := s.transport.RoundTrip(outreq)
+	if err != nil {
+		shadowRequestsTotal.WithLabelValues("error").Inc()
+		slog.Debug("Failed to mirror the request to the shadow upstream",
+			slog.String("Method", outreq.Method),
+			slog.String("Path", outreq.URL.Path),
+			slog.String("Upstream", s.target.Host),
+			slog.Any("Error", err),
+		)
+		return
+	}
+	// drained so the connection goes back to the pool
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	shadowRequestsTotal.WithLabelValues("sent").Inc()
+}
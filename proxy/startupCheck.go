@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CheckUpstreams sends a HEAD to every upstream in parallel and logs whether
+// it answered, any status counts as reachable. The error lists the upstreams
+// that did not answer within timeout, transport nil uses http.DefaultTransport
+func CheckUpstreams(ctx context.Context, upstreams []string, timeout time.Duration, transport http.RoundTripper) error {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// a redirect already proves the upstream is up
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var unreachable []string
+
+	for _, upstream := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := probeUpstream(ctx, client, upstream)
+			if err != nil {
+				mu.Lock()
+				unreachable = append(unreachable, upstream)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(unreachable) > 0 {
+		return fmt.Errorf("unreachable upstreams: %v", unreachable)
+	}
+	return nil
+}
+
+// helper functions
+func probeUpstream(ctx context.Context, client *http.Client, upstream string) error {
+	started := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, upstream, nil)
+	if err != nil {
+		slog.Warn("Upstream unreachable", slog.String("Upstream", upstream), slog.Any("Error", err))
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Warn("Upstream unreachable",
+			slog.String("Upstream", upstream),
+			slog.Duration("Latency", time.Since(started)),
+			slog.Any("Error", err),
+		)
+		return err
+	}
+	resp.Body.Close()
+
+	slog.Info("Upstream reachable",
+		slog.String("Upstream", upstream),
+		slog.Int("StatusCode", resp.StatusCode),
+		slog.Duration("Latency", time.Since(started)),
+	)
+	return nil
+}
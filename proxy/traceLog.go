@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type traceLogContextKey struct{}
+
+type traceAttemptContextKey struct{}
+
+// sampledRequest is a request picked for the trace log
+type sampledRequest struct {
+	start     time.Time
+	requestID string
+}
+
+// WithTraceLog marks the request as sampled for the trace log, arrived at
+// start. The relay then logs the timings of every upstream call it makes
+// for it, a request without the mark costs the relay one context lookup
+func WithTraceLog(ctx context.Context, start time.Time, requestID string) context.Context {
+	return context.WithValue(ctx, traceLogContextKey{}, sampledRequest{start: start, requestID: requestID})
+}
+
+// traceAttempt times one upstream call of a sampled request through the
+// httptrace hooks, which the transport may call from its own goroutines
+type traceAttempt struct {
+	mu sync.Mutex
+
+	request    sampledRequest
+	relayStart time.Time
+	upstream   string
+
+	getConn      time.Time
+	gotConn      time.Time
+	reused       bool
+	dnsStart     time.Time
+	dns          time.Duration
+	connectStart time.Time
+	connect      time.Duration
+	tlsStart     time.Time
+	tlsHandshake time.Duration
+	wroteRequest time.Time
+	firstByte    time.Time
+	attempts     int
+	status       int
+	failedOver   bool
+}
+
+// helper functions
+
+// startTraceAttempt hooks a trace onto ctx when its request is sampled
+func startTraceAttempt(ctx context.Context, upstream *Upstream) (context.Context, *traceAttempt) {
+	request, ok := ctx.Value(traceLogContextKey{}).(sampledRequest)
+	if !ok {
+		return ctx, nil
+	}
+
+	attempt := &traceAttempt{request: request, relayStart: time.Now(), upstream: upstream.URL.Host}
+	ctx = context.WithValue(ctx, traceAttemptContextKey{}, attempt)
+	return httptrace.WithClientTrace(ctx, attempt.clientTrace()), attempt
+}
+
+func traceAttemptFromContext(ctx context.Context) *traceAttempt {
+	attempt, _ := ctx.Value(traceAttemptContextKey{}).(*traceAttempt)
+	return attempt
+}
+
+// clientTrace keeps the last time of every hook, a retried call reports its
+// final attempt and how many it took
+func (t *traceAttempt) clientTrace() *httptrace.ClientTrace {
+	record := func(set func(now time.Time)) {
+		now := time.Now()
+		t.mu.Lock()
+		set(now)
+		t.mu.Unlock()
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			record(func(now time.Time) {
+				t.getConn = now
+				t.attempts++
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			record(func(now time.Time) {
+				t.gotConn = now
+				t.reused = info.Reused
+			})
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			record(func(now time.Time) { t.dnsStart = now })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			record(func(now time.Time) { t.dns = now.Sub(t.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			record(func(now time.Time) { t.connectStart = now })
+		},
+		ConnectDone: func(string, string, error) {
+			record(func(now time.Time) { t.connect = now.Sub(t.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			record(func(now time.Time) { t.tlsStart = now })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			record(func(now time.Time) { t.tlsHandshake = now.Sub(t.tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			record(func(now time.Time) { t.wroteRequest = now })
+		},
+		GotFirstResponseByte: func() {
+			record(func(now time.Time) { t.firstByte = now })
+		},
+	}
+}
+
+// setStatus keeps the upstream's status, the trace never sees the response
+func (t *traceAttempt) setStatus(resp *http.Response) {
+	t.mu.Lock()
+	t.status = resp.StatusCode
+	t.mu.Unlock()
+}
+
+func (t *traceAttempt) setFailedOver() {
+	t.mu.Lock()
+	t.failedOver = true
+	t.mu.Unlock()
+}
+
+// log writes the breakdown once the response went back to the client: the
+// time the middleware took before the relay, getting a connection, sending
+// the request, the upstream taking to answer and the body transfer. A phase
+// that never happened is left at 0
+func (t *traceAttempt) log(r *http.Request) {
+	end := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	slog.Info("Relay trace",
+		slog.String("Method", r.Method),
+		slog.String("Path", r.URL.Path),
+		slog.String("Upstream", t.upstream),
+		slog.Int("StatusCode", t.status),
+		slog.Bool("FailedOver", t.failedOver),
+		slog.Int("Attempts", t.attempts),
+		slog.Bool("ConnReused", t.reused),
+		slog.Duration("Total", end.Sub(t.request.start)),
+		slog.Group("Timings",
+			slog.Duration("Middleware", t.relayStart.Sub(t.request.start)),
+			slog.Duration("GetConn", between(t.getConn, t.gotConn)),
+			slog.Duration("DNS", t.dns),
+			slog.Duration("Connect", t.connect),
+			slog.Duration("TLSHandshake", t.tlsHandshake),
+			slog.Duration("WriteRequest", between(t.gotConn, t.wroteRequest)),
+			slog.Duration("UpstreamResponse", between(t.wroteRequest, t.firstByte)),
+			slog.Duration("BodyTransfer", between(t.firstByte, end)),
+		),
+		slog.String("RequestID", t.request.requestID),
+	)
+}
+
+// between is 0 unless both ends happened in order
+func between(from time.Time, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
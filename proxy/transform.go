@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// response bodies over this many bytes stream through untransformed, a
+// transformer holds the whole body in memory
+const maxTransformBodyBytes = 8 << 20
+
+// ResponseTransformer rewrites a relayed response before it goes back to the
+// client. One that changes the body goes through ReadResponseBody and
+// SetResponseBody so Content-Length and Content-Encoding stay in step with it
+type ResponseTransformer interface {
+	Transform(ctx context.Context, resp *http.Response) error
+}
+
+// names of the built-in transformers
+const (
+	TransformStripFields = "strip_fields"
+)
+
+// RouteTransform is one transformer of a route: strip_fields removes the
+// JSON paths in Fields from a JSON body, a registered transformer reads
+// whatever it needs from Options
+type RouteTransform struct {
+	Name    string            `yaml:"name"`
+	Fields  []string          `yaml:"fields"`
+	Options map[string]string `yaml:"options"`
+}
+
+// TransformerFactory builds a transformer from its route settings, an error
+// fails the route table load
+type TransformerFactory func(config RouteTransform) (ResponseTransformer, error)
+
+var transformerRegistry = struct {
+	mu        sync.RWMutex
+	factories map[string]TransformerFactory
+}{
+	factories: map[string]TransformerFactory{
+		TransformStripFields: newStripFieldsTransformer,
+	},
+}
+
+// RegisterTransformer makes name usable under a route's transform, call it
+// before the route table loads. A name already taken is replaced
+func RegisterTransformer(name string, factory TransformerFactory) {
+	transformerRegistry.mu.Lock()
+	defer transformerRegistry.mu.Unlock()
+
+	transformerRegistry.factories[name] = factory
+}
+
+// ReadResponseBody reads the whole body of resp, decoding a gzip one. false
+// leaves the body as it was, for a response too large to hold or in an
+// encoding other than gzip
+func ReadResponseBody(resp *http.Response) ([]byte, bool, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "gzip" && encoding != "identity" {
+		return nil, false, nil
+	}
+	if resp.ContentLength > maxTransformBodyBytes {
+		return nil, false, nil
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(raw)) > maxTransformBodyBytes {
+		// the bytes already read go out first, the rest streams on
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(raw), resp.Body), Closer: resp.Body}
+		return nil, false, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+
+	if encoding != "gzip" {
+		return raw, true, nil
+	}
+	// a corrupt gzip body goes to the client the way the upstream sent it
+	reader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, maxTransformBodyBytes+1))
+	if err != nil || int64(len(body)) > maxTransformBodyBytes {
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// SetResponseBody replaces the body of resp with the decoded bytes of body,
+// sent as they are with a Content-Length to match. Gzip on the way out is
+// left to the server's own compression
+func SetResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Uncompressed = false
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	// the validator named the upstream's bytes
+	resp.Header.Del("ETag")
+	resp.Header.Del("Content-MD5")
+}
+
+// helper functions
+
+// buildTransformers builds the transformers of a route in order
+func buildTransformers(configs []RouteTransform) ([]ResponseTransformer, error) {
+	transformerRegistry.mu.RLock()
+	defer transformerRegistry.mu.RUnlock()
+
+	transformers := make([]ResponseTransformer, 0, len(configs))
+	for _, config := range configs {
+		factory, ok := transformerRegistry.factories[config.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q, must be one of %s", config.Name, strings.Join(transformerNames(), ", "))
+		}
+		transformer, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s: %w", config.Name, err)
+		}
+		transformers = append(transformers, transformer)
+	}
+	return transformers, nil
+}
+
+// transformerNames expects the registry to be read-locked
+func transformerNames() []string {
+	names := make([]string, 0, len(transformerRegistry.factories))
+	for name := range transformerRegistry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transformable leaves the responses without a body to rewrite alone, and
+// the streams, which go to the client as they arrive
+func transformable(resp *http.Response) bool {
+	if resp.Request.Method == http.MethodHead || resp.StatusCode < http.StatusOK ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return !IsEventStream(resp.Header) && !IsGRPC(resp.Request)
+}
+
+// stripFieldsTransformer removes JSON paths from a JSON body. A path is a
+// dotted list of object keys, $.user.password or user.password, where * is
+// every key of an object or every element of an array. The other keys come
+// out in sorted order
+type stripFieldsTransformer struct {
+	paths [][]string
+}
+
+func newStripFieldsTransformer(config RouteTransform) (ResponseTransformer, error) {
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("at least one field is required")
+	}
+
+	t := &stripFieldsTransformer{}
+	for _, field := range config.Fields {
+		field = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(field), "$"), ".")
+		segments := strings.Split(field, ".")
+		for _, segment := range segments {
+			if segment == "" {
+				return nil, fmt.Errorf("invalid field path %q", field)
+			}
+		}
+		t.paths = append(t.paths, segments)
+	}
+	return t, nil
+}
+
+func (t *stripFieldsTransformer) Transform(ctx context.Context, resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+
+	body, ok, err := ReadResponseBody(resp)
+	if err != nil || !ok {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// numbers keep their exact digits through the round trip
+	decoder.UseNumber()
+	var document any
+	err = decoder.Decode(&document)
+	if err != nil {
+		// not JSON after all, passed on untouched
+		SetResponseBody(resp, body)
+		return nil
+	}
+
+	for _, path := range t.paths {
+		stripPath(document, path)
+	}
+
+	var stripped bytes.Buffer
+	encoder := json.NewEncoder(&stripped)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(document)
+	if err != nil {
+		return err
+	}
+	SetResponseBody(resp, bytes.TrimSuffix(stripped.Bytes(), []byte("\n")))
+	return nil
+}
+
+func stripPath(node any, path []string) {
+	last := len(path) == 1
+	switch value := node.(type) {
+	case map[string]any:
+		if path[0] == "*" {
+			for key, child := range value {
+				if last {
+					delete(value, key)
+				} else {
+					stripPath(child, path[1:])
+				}
+			}
+			return
+		}
+		child, ok := value[path[0]]
+		if !ok {
+			return
+		}
+		if last {
+			delete(value, path[0])
+		} else {
+			stripPath(child, path[1:])
+		}
+	case []any:
+		// an array is walked through, items.*.secret and items.secret both
+		// strip the secret of every item
+		for _, child := range value {
+			if path[0] == "*" {
+				if !last {
+					stripPath(child, path[1:])
+				}
+			} else {
+				stripPath(child, path)
+			}
+		}
+	}
+}
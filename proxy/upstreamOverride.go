@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"context"
+	"net/url"
+)
+
+// UpstreamOverrideHeader pins a single request to the upstream URL it names,
+// middlewares.UpstreamOverrideMiddleware decides who may send it
+const UpstreamOverrideHeader = "X-Relay-Upstream"
+
+type upstreamOverrideKey struct{}
+
+// WithUpstreamOverride makes the relay send the request to target instead of
+// an upstream of its pool, target must already be checked
+func WithUpstreamOverride(ctx context.Context, target *url.URL) context.Context {
+	return context.WithValue(ctx, upstreamOverrideKey{}, target)
+}
+
+func upstreamOverride(ctx context.Context) (*url.URL, bool) {
+	target, ok := ctx.Value(upstreamOverrideKey{}).(*url.URL)
+	return target, ok
+}
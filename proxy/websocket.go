@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sash2721/Relay/errors"
+)
+
+// bounds the dial and the handshake with the upstream
+const webSocketDialTimeout = 10 * time.Second
+
+// headers that only make sense on a single hop, the upgrade pair is added
+// back for the handshake
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// IsWebSocketUpgrade reports whether r asks to switch to the websocket protocol
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerContainsToken(r.Header, "Connection", "upgrade")
+}
+
+// serveWebSocket sends the handshake to upstream and, once it switches
+// protocols, copies frames both ways over the hijacked client connection
+// until either peer disconnects or the request context is done
+func (h *RelayHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, upstream *Upstream) {
+	outreq := h.webSocketRequest(r, upstream)
+
+	backConn, err := dialUpstream(r.Context(), upstream, h.tlsConfig, h.dnsCache)
+	if err != nil {
+		// a client that left during the dial says nothing about the upstream
+		if r.Context().Err() == context.Canceled {
+			if breakers := h.balancer.CircuitBreakers(); breakers != nil {
+				breakers.Get(upstream.URL.Host).releaseProbe()
+			}
+			return
+		}
+		h.balancer.MarkFailed(upstream)
+		h.recordBreaker(upstream, false)
+		relayErrorHandler(w, outreq, err)
+		return
+	}
+	defer backConn.Close()
+
+	// the handshake gets the dial timeout too, the stream itself has none
+	backConn.SetDeadline(time.Now().Add(webSocketDialTimeout))
+
+	err = outreq.Write(backConn)
+	if err != nil {
+		h.balancer.MarkFailed(upstream)
+		h.recordBreaker(upstream, false)
+		relayErrorHandler(w, outreq, err)
+		return
+	}
+
+	backReader := bufio.NewReader(backConn)
+	resp, err := http.ReadResponse(backReader, outreq)
+	if err != nil {
+		h.balancer.MarkFailed(upstream)
+		h.recordBreaker(upstream, false)
+		relayErrorHandler(w, outreq, err)
+		return
+	}
+	h.recordBreaker(upstream, resp.StatusCode < http.StatusInternalServerError)
+	backConn.SetDeadline(time.Time{})
+
+	// upstream refused the upgrade, its answer goes back as a plain response
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	clientConn, clientBuffer, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("Failed to hijack the websocket connection", slog.Any("Error", err))
+		errors.WriteError(w, http.StatusInternalServerError, errors.CodeInternal, "WebSocket upgrade not supported")
+		return
+	}
+	defer clientConn.Close()
+
+	// the server's read and write timeouts would cut the stream short
+	clientConn.SetDeadline(time.Time{})
+
+	err = resp.Write(clientConn)
+	if err != nil {
+		slog.Warn("Failed to send the websocket handshake to the client", slog.Any("Error", err))
+		return
+	}
+
+	slog.Info("WebSocket relay opened",
+		slog.String("Path", r.URL.Path),
+		slog.String("Upstream", upstream.URL.Host),
+	)
+	started := time.Now()
+
+	// closing both connections unblocks whichever copy is still running
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			clientConn.Close()
+			backConn.Close()
+		})
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// the client may already have sent frames after the handshake
+		io.Copy(backConn, clientBuffer.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, backReader)
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+	}
+	closeBoth()
+	<-done
+
+	slog.Info("WebSocket relay closed",
+		slog.String("Path", r.URL.Path),
+		slog.String("Upstream", upstream.URL.Host),
+		slog.Duration("Duration", time.Since(started)),
+	)
+}
+
+// helper functions
+
+// webSocketRequest builds the handshake the way the reverse proxy rewrites a
+// relayed request, keeping the Sec-WebSocket-* headers
+func (h *RelayHandler) webSocketRequest(r *http.Request, upstream *Upstream) *http.Request {
+	outreq := r.Clone(r.Context())
+	target := *upstream.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	target.RawPath = ""
+	outreq.URL = &target
+	outreq.URL.RawQuery = joinQuery(upstream.URL.RawQuery, r.URL.RawQuery)
+	outreq.Host = upstream.URL.Host
+	outreq.RequestURI = ""
+	outreq.Body = http.NoBody
+	outreq.ContentLength = 0
+
+	for _, name := range hopByHopHeaders {
+		outreq.Header.Del(name)
+	}
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", "websocket")
+
+	outreq.Header.Del("Forwarded")
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	outreq.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		outreq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outreq.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	h.headers.Apply(outreq.Header)
+	return outreq
+}
+
+func (h *RelayHandler) recordBreaker(upstream *Upstream, success bool) {
+	breakers := h.balancer.CircuitBreakers()
+	if breakers == nil {
+		return
+	}
+	if success {
+		breakers.Get(upstream.URL.Host).RecordSuccess()
+	} else {
+		breakers.Get(upstream.URL.Host).RecordFailure()
+	}
+}
+
+// dialUpstream dials the upstream the way the relay transport does, through
+// dnsCache and verifying an https upstream with tlsConfig
+func dialUpstream(ctx context.Context, upstream *Upstream, tlsConfig *tls.Config, dnsCache *DNSCache) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, webSocketDialTimeout)
+	defer cancel()
+
+	dial := dnsCache.DialContext(&net.Dialer{Timeout: webSocketDialTimeout})
+	conn, err := dial(ctx, "tcp", upstreamAddress(upstream))
+	if err != nil || upstream.URL.Scheme != "https" {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
+	config.ServerName = upstream.URL.Hostname()
+	// the upgrade is an HTTP/1.1 handshake, never h2
+	config.NextProtos = []string{"http/1.1"}
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upstreamAddress is the host:port to dial, with the scheme's default port
+func upstreamAddress(upstream *Upstream) string {
+	if upstream.URL.Port() != "" {
+		return upstream.URL.Host
+	}
+	if upstream.URL.Scheme == "https" {
+		return net.JoinHostPort(upstream.URL.Hostname(), "443")
+	}
+	return net.JoinHostPort(upstream.URL.Hostname(), "80")
+}
+
+func joinQuery(upstreamQuery string, requestQuery string) string {
+	if upstreamQuery == "" || requestQuery == "" {
+		return upstreamQuery + requestQuery
+	}
+	return upstreamQuery + "&" + requestQuery
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ShutdownHook stops one component, ctx carries the hook's share of the
+// shutdown budget
+type ShutdownHook func(ctx context.Context) error
+
+type namedHook struct {
+	name string
+	hook ShutdownHook
+}
+
+// Lifecycle runs the shutdown hooks in reverse registration order, like
+// defer, so registering each component right after it starts closes the
+// dependencies after everything that uses them
+type Lifecycle struct {
+	mu    sync.Mutex
+	hooks []namedHook
+	// how long each hook of the last Shutdown took, in the order they ran
+	phases []ShutdownPhase
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+func (l *Lifecycle) OnShutdown(name string, hook ShutdownHook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hooks = append(l.hooks, namedHook{name: name, hook: hook})
+}
+
+// Shutdown runs every hook within budget, each one gets an even share of what
+// is left so time a hook doesn't use goes to the ones after it. A failing
+// hook doesn't stop the others, their errors are joined
+func (l *Lifecycle) Shutdown(budget time.Duration) error {
+	l.mu.Lock()
+	hooks := make([]namedHook, len(l.hooks))
+	copy(hooks, l.hooks)
+	l.mu.Unlock()
+
+	deadline := time.Now().Add(budget)
+	var problems []error
+	phases := make([]ShutdownPhase, 0, len(hooks))
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		share := time.Until(deadline) / time.Duration(i+1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), share)
+		started := time.Now()
+		err := h.hook(ctx)
+		cancel()
+
+		took := time.Since(started)
+		phases = append(phases, ShutdownPhase{Name: h.name, Duration: took})
+		RecordShutdownPhase(h.name, took)
+
+		if err != nil {
+			slog.Error("Shutdown hook failed",
+				slog.String("Hook", h.name),
+				slog.Duration("Budget", share),
+				slog.Duration("Duration", took),
+				slog.Any("Error", err),
+			)
+			problems = append(problems, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		slog.Info("Shutdown hook done",
+			slog.String("Hook", h.name),
+			slog.Duration("Duration", took),
+		)
+	}
+
+	l.mu.Lock()
+	l.phases = phases
+	l.mu.Unlock()
+
+	if len(problems) > 0 {
+		slog.Error("Shutdown finished with failures",
+			slog.Int("Failed", len(problems)),
+			slog.Int("Hooks", len(hooks)),
+		)
+	}
+	return stderrors.Join(problems...)
+}
+
+// Phases returns how long each hook of the last Shutdown took, in the order
+// they ran
+func (l *Lifecycle) Phases() []ShutdownPhase {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	phases := make([]ShutdownPhase, len(l.phases))
+	copy(phases, l.phases)
+	return phases
+}
+
+// Go runs fn on its own goroutine, a panic in it is logged with its stack and
+// calls shutdown so main can stop cleanly instead of the process crashing
+func Go(name string, fn func(), shutdown func()) {
+	go func() {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			slog.Error("Recovered from a panic, shutting down",
+				slog.String("Goroutine", name),
+				slog.Any("Panic", recovered),
+				slog.String("Stack", string(debug.Stack())),
+			)
+			shutdown()
+		}()
+
+		fn()
+	}()
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoRecoversPanicAndShutsDown(t *testing.T) {
+	logs := captureLogs(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	lifecycle := NewLifecycle()
+	closed := make(chan struct{})
+	lifecycle.OnShutdown("api server", func(ctx context.Context) error {
+		defer close(closed)
+		return server.Shutdown(ctx)
+	})
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// the serve goroutine panics in its setup before it ever serves
+	Go("api server", func() {
+		var setup func(*http.Server)
+		setup(server)
+		server.Serve(listener)
+	}, stop)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the panic did not signal the shutdown")
+	}
+
+	err = lifecycle.Shutdown(time.Second)
+	if err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	select {
+	case <-closed:
+	default:
+		t.Error("the shutdown hook did not run")
+	}
+
+	recovered := logs.find("Recovered from a panic, shutting down")
+	if recovered == nil {
+		t.Fatal("the panic was not logged")
+	}
+	if recovered["Goroutine"] != "api server" {
+		t.Errorf("Goroutine = %v, want api server", recovered["Goroutine"])
+	}
+	if stack, _ := recovered["Stack"].(string); !strings.Contains(stack, "TestGoRecoversPanicAndShutsDown") {
+		t.Errorf("the logged stack does not reach the panicking goroutine: %q", stack)
+	}
+	listener.Close()
+}
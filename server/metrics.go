@@ -0,0 +1,53 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the phases are the shutdown hooks plus the grace period, a fixed handful
+var (
+	shutdownPhaseDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "relay_shutdown_phase_duration_seconds",
+			Help: "Time the last shutdown spent in each phase, the grace period and every shutdown hook.",
+		},
+		[]string{"phase"},
+	)
+
+	shutdownDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "relay_shutdown_duration_seconds",
+			Help: "Time the last shutdown took from the signal until every hook returned.",
+		},
+	)
+)
+
+// RegisterMetrics registers the shutdown metrics on the given registerer
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{shutdownPhaseDuration, shutdownDuration} {
+		err := registerer.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShutdownPhase is how long one phase of the shutdown took
+type ShutdownPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// RecordShutdownPhase sets the duration of a phase the lifecycle doesn't run
+// itself, like the grace period
+func RecordShutdownPhase(name string, duration time.Duration) {
+	shutdownPhaseDuration.WithLabelValues(name).Set(duration.Seconds())
+}
+
+// RecordShutdown sets the total duration of the shutdown
+func RecordShutdown(duration time.Duration) {
+	shutdownDuration.Set(duration.Seconds())
+}
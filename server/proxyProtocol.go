@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the first bytes of a v2 header, v1 starts with "PROXY "
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// the longest v1 line, CRLF included
+	proxyV1MaxLength = 107
+	// v2 address families, the high nibble, and the TCP or UDP protocols
+	proxyV2FamilyIPv4 = 0x1
+	proxyV2FamilyIPv6 = 0x2
+)
+
+var errNoProxyHeader = stderrors.New("connection did not start with a PROXY protocol header")
+
+// proxyProtocolListener expects every connection to open with a PROXY
+// protocol header, v1 or v2, and reports the client it names as the
+// connection's RemoteAddr. One without a header fails its first read and the
+// server closes it, so PROXY_PROTOCOL is only for listeners nothing but the
+// load balancer can reach
+type proxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// wrapProxyProtocol leaves listener as it is unless PROXY_PROTOCOL is set
+func wrapProxyProtocol(enabled bool, timeout time.Duration, listener net.Listener) net.Listener {
+	if !enabled {
+		return listener
+	}
+	return &proxyProtocolListener{Listener: listener, timeout: timeout}
+}
+
+// Accept doesn't read the header, the connection does on its first use so a
+// slow client holds up its own goroutine and not the accept loop
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr is the client the header named, the peer itself for a header
+// that names none such as a health check's LOCAL one
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// helper functions
+
+func (c *proxyProtocolConn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	c.remoteAddr, c.err = readProxyHeader(c.reader)
+	if c.err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// readProxyHeader consumes the header, the address is nil when it names no client
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	// even the shortest v1 header, "PROXY UNKNOWN\r\n", is longer than this
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(reader)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, stderrors.New("v1 header is not terminated by CRLF within 107 bytes")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	source, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	if (fields[1] == "TCP4") != source.Is4() {
+		return nil, fmt.Errorf("v1 source address %q is not %s", fields[2], fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header, the TLVs after the addresses are skipped
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", version)
+	}
+	family := header[13] >> 4
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, the load balancer's own connection such as a health check
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	switch family {
+	case proxyV2FamilyIPv4:
+		if length < 12 {
+			return nil, stderrors.New("v2 IPv4 addresses are truncated")
+		}
+		source := netip.AddrFrom4([4]byte(payload[0:4]))
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, port)), nil
+	case proxyV2FamilyIPv6:
+		if length < 36 {
+			return nil, stderrors.New("v2 IPv6 addresses are truncated")
+		}
+		source := netip.AddrFrom16([16]byte(payload[0:16]))
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, port)), nil
+	}
+	// UNSPEC or a unix socket, nothing ClientIP could use
+	return nil, nil
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/middlewares"
+	"github.com/sash2721/Relay/proxy"
+)
+
+// RouteTable serves the routes of ROUTES_FILE and can be reloaded while
+// running, a request keeps the table it started on
+type RouteTable struct {
+	cfg      *configs.ServerConfig
+	ipFilter *middlewares.IPFilter
+	cache    *middlewares.ResponseCache
+	// replays POSTs with a repeated Idempotency-Key
+	idempotency *middlewares.Idempotency
+	health      *proxy.HealthPoller
+	// serializes reloads, requests only ever load current
+	mu      sync.Mutex
+	current atomic.Pointer[routeSet]
+}
+
+// routeSet is one loaded version of the route table, prefixes holds the
+// groups by path segment so the longest matching prefix is found in one walk
+// down the path however many routes there are
+type routeSet struct {
+	routes   []proxy.Route
+	groups   []*prefixGroup
+	prefixes prefixNode
+}
+
+// prefixNode is one path segment of the prefix trie, group is set on the
+// node a prefix ends at
+type prefixNode struct {
+	children map[string]*prefixNode
+	group    *prefixGroup
+}
+
+// prefixGroup holds every route of a prefix, the ones with query conditions
+// first so a request only lands on the plain route when none of them match
+type prefixGroup struct {
+	prefix   string
+	variants []routeVariant
+}
+
+type routeVariant struct {
+	route   proxy.Route
+	relay   *proxy.RelayHandler
+	handler http.Handler
+}
+
+// NewRouteTable guards every route with ipFilter, caches GET responses in
+// cache, replays repeated POSTs through idempotency and skips the upstreams
+// health found down, any of them may be nil
+func NewRouteTable(cfg *configs.ServerConfig, ipFilter *middlewares.IPFilter, cache *middlewares.ResponseCache, idempotency *middlewares.Idempotency, health *proxy.HealthPoller) *RouteTable {
+	return &RouteTable{cfg: cfg, ipFilter: ipFilter, cache: cache, idempotency: idempotency, health: health}
+}
+
+// Load reads ROUTES_FILE and swaps it in, an invalid file leaves the current
+// table in place
+func (t *RouteTable) Load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	routes, err := proxy.LoadRoutes(t.cfg.RoutesFile)
+	if err != nil {
+		return err
+	}
+
+	next, err := t.build(routes)
+	if err != nil {
+		return err
+	}
+
+	previous := t.current.Swap(next)
+	if previous == nil {
+		slog.Info("Route table loaded",
+			slog.String("File", t.cfg.RoutesFile),
+			slog.Int("Routes", len(routes)),
+		)
+		return nil
+	}
+
+	added, removed, changed := diffRoutes(previous.routes, routes)
+	slog.Info("Route table reloaded",
+		slog.String("File", t.cfg.RoutesFile),
+		slog.Any("Added", added),
+		slog.Any("Removed", removed),
+		slog.Any("Changed", changed),
+	)
+	return nil
+}
+
+// Routes returns the routes of the current table
+func (t *RouteTable) Routes() []proxy.Route {
+	set := t.current.Load()
+	if set == nil {
+		return nil
+	}
+	return set.routes
+}
+
+// Relays returns the relay of every route of the current table by route key
+func (t *RouteTable) Relays() map[string]*proxy.RelayHandler {
+	set := t.current.Load()
+	if set == nil {
+		return nil
+	}
+
+	relays := make(map[string]*proxy.RelayHandler, len(set.routes))
+	for _, group := range set.groups {
+		for _, variant := range group.variants {
+			relays[variant.route.Key()] = variant.relay
+		}
+	}
+	return relays
+}
+
+// Middleware serves the requests under a route table prefix and passes every
+// other request on, so the table takes precedence over the API routes. A
+// request under a prefix whose routes all have query conditions it doesn't
+// meet is passed on as well
+func (t *RouteTable) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set := t.current.Load()
+		if set == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		variant, ok := set.match(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the metrics and access logs label the request by its route
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			rctx.RoutePatterns = append(rctx.RoutePatterns, variant.route.Prefix+"/*")
+		}
+		variant.handler.ServeHTTP(w, r)
+	})
+}
+
+// helper functions
+
+// pattern is the pattern Middleware labels the request with, empty when the
+// table doesn't serve it
+func (t *RouteTable) pattern(r *http.Request) string {
+	set := t.current.Load()
+	if set == nil {
+		return ""
+	}
+	variant, ok := set.match(r)
+	if !ok {
+		return ""
+	}
+	return variant.route.Prefix + "/*"
+}
+
+// build creates a relay per route, each with its own timeouts and the relay
+// body limit
+func (t *RouteTable) build(routes []proxy.Route) (*routeSet, error) {
+	bodyLimiter := middlewares.NewBodyLimiter(t.cfg.RelayMaxBodyBytes)
+	groups := make(map[string]*prefixGroup)
+
+	for _, route := range routes {
+		relay, err := proxy.NewRouteRelay(t.cfg, route, t.health)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout := t.cfg.RequestTimeout
+		if route.Timeout > 0 {
+			timeout = route.Timeout
+		}
+		contentTypes := t.cfg.RelayContentTypes
+		if len(route.ContentTypes) > 0 {
+			contentTypes = route.ContentTypes
+		}
+
+		auth, rateLimit, routeBodyLimiter, signature, err := t.policies(route, bodyLimiter)
+		if err != nil {
+			return nil, err
+		}
+
+		handler := chi.Chain(
+			t.ipFilter.Middleware,
+			auth,
+			middlewares.UpstreamOverrideMiddleware(t.cfg.AdminAPIKeys, t.cfg.RelayOverrideHosts),
+			rateLimit,
+			middlewares.ContentTypeMiddleware(contentTypes),
+			// BODY_READ_TIMEOUT is set ahead of the route table, a route's own
+			// replaces it
+			middlewares.BodyReadTimeoutMiddleware(route.BodyReadTimeout),
+			routeBodyLimiter.Middleware,
+			signature,
+			t.idempotency.Middleware,
+			t.cache.Middleware,
+			middlewares.RequestTimeoutMiddleware(timeout),
+			middlewares.RestoreOriginalPath(t.cfg.RelayOriginalPath, route.Prefix),
+		).Handler(proxy.RewriteHandler(route, relay))
+
+		group, ok := groups[route.Prefix]
+		if !ok {
+			group = &prefixGroup{prefix: route.Prefix}
+			groups[route.Prefix] = group
+		}
+		group.variants = append(group.variants, routeVariant{route: route, relay: relay, handler: handler})
+	}
+
+	set := &routeSet{routes: routes}
+	for _, group := range groups {
+		// more conditions first, the file order breaks ties
+		sort.SliceStable(group.variants, func(i, j int) bool {
+			return len(group.variants[i].route.Query) > len(group.variants[j].route.Query)
+		})
+		set.groups = append(set.groups, group)
+		set.prefixes.insert(group)
+	}
+
+	return set, nil
+}
+
+// policies returns the auth, rate limit, body limit and signature middleware
+// the route lists, API_KEYS guards a route that doesn't name its auth. Only a
+// route listing signature verifies one, the route table runs ahead of
+// REQUEST_DECOMPRESSION so the HMAC covers the body as the client sent it
+func (t *RouteTable) policies(route proxy.Route, bodyLimiter *middlewares.BodyLimiter) (func(http.Handler) http.Handler, func(http.Handler) http.Handler, *middlewares.BodyLimiter, func(http.Handler) http.Handler, error) {
+	auth := middlewares.APIKeyMiddleware(t.cfg.APIKeys)
+	rateLimit := passThrough
+	signature := passThrough
+
+	for _, m := range route.Middleware {
+		switch m.Name {
+		case proxy.MiddlewarePublic:
+			auth = passThrough
+		case proxy.MiddlewareJWT:
+			auth = middlewares.AuthZMiddleware
+		case proxy.MiddlewareRateLimit:
+			burst := m.Burst
+			if burst == 0 {
+				burst = int(math.Ceil(m.RPS))
+			}
+			rateLimit = middlewares.NewClientRateLimiter(m.RPS, burst).Middleware
+		case proxy.MiddlewareBodyLimit:
+			bodyLimiter = middlewares.NewBodyLimiter(m.MaxBytes)
+		case proxy.MiddlewareSignature:
+			// without a secret the check would be a no-op, the route would
+			// take unsigned requests it was meant to refuse
+			if t.cfg.WebhookSecret == "" {
+				return nil, nil, nil, nil, fmt.Errorf("route %s: the signature middleware needs WEBHOOK_SECRET", route.Key())
+			}
+			signature = middlewares.SignatureMiddleware(t.cfg.WebhookSecret, t.cfg.WebhookSignatureHeader, t.cfg.WebhookSignaturePrefix)
+		}
+	}
+
+	return auth, rateLimit, bodyLimiter, signature, nil
+}
+
+func passThrough(next http.Handler) http.Handler {
+	return next
+}
+
+// match finds the route of the longest prefix covering the path whose query
+// conditions the request meets
+func (s *routeSet) match(r *http.Request) (routeVariant, bool) {
+	group := s.prefixes.longest(r.URL.Path)
+	if group == nil {
+		return routeVariant{}, false
+	}
+
+	query := r.URL.Query()
+	for _, variant := range group.variants {
+		if variant.route.MatchesQuery(query) {
+			return variant, true
+		}
+	}
+	return routeVariant{}, false
+}
+
+func (n *prefixNode) insert(group *prefixGroup) {
+	node := n
+	for _, segment := range strings.Split(strings.TrimPrefix(group.prefix, "/"), "/") {
+		child, ok := node.children[segment]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*prefixNode)
+			}
+			child = &prefixNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.group = group
+}
+
+// longest returns the group of the longest prefix path equals or lies below,
+// nil for none. It walks the path a segment at a time without allocating
+func (n *prefixNode) longest(path string) *prefixGroup {
+	rest, ok := strings.CutPrefix(path, "/")
+	if !ok {
+		return nil
+	}
+
+	var found *prefixGroup
+	node := n
+	for {
+		segment, remaining, more := strings.Cut(rest, "/")
+		node = node.children[segment]
+		if node == nil {
+			return found
+		}
+		if node.group != nil {
+			found = node.group
+		}
+		if !more {
+			return found
+		}
+		rest = remaining
+	}
+}
+
+// diffRoutes returns the route keys only in next, only in previous and in both
+// with different settings
+func diffRoutes(previous []proxy.Route, next []proxy.Route) ([]string, []string, []string) {
+	before := make(map[string]proxy.Route, len(previous))
+	for _, route := range previous {
+		before[route.Key()] = route
+	}
+
+	var added, removed, changed []string
+	for _, route := range next {
+		old, ok := before[route.Key()]
+		switch {
+		case !ok:
+			added = append(added, route.Key())
+		case !reflect.DeepEqual(old, route):
+			changed = append(changed, route.Key())
+		}
+		delete(before, route.Key())
+	}
+	for _, route := range previous {
+		if _, ok := before[route.Key()]; ok {
+			removed = append(removed, route.Key())
+		}
+	}
+
+	return added, removed, changed
+}
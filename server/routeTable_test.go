@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sash2721/Relay/errors"
+	"github.com/sash2721/Relay/proxy"
+)
+
+func TestRouteSetMatchesLongestPrefix(t *testing.T) {
+	set := newTestRouteSet([]string{"/api", "/api/v2", "/api/v2/users", "/static"})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api", want: "/api"},
+		{path: "/api/v1/users", want: "/api"},
+		{path: "/api/v2", want: "/api/v2"},
+		{path: "/api/v2/users/42", want: "/api/v2/users"},
+		// a prefix covers whole segments only
+		{path: "/api/v2users", want: "/api"},
+		{path: "/apiv2", want: ""},
+		{path: "/other", want: ""},
+	}
+
+	for _, tt := range tests {
+		variant, ok := set.match(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		got := ""
+		if ok {
+			got = variant.route.Prefix
+		}
+		if got != tt.want {
+			t.Errorf("match(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteTableSignatureIsOptIn(t *testing.T) {
+	const secret = "webhook-secret"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	t.Setenv("WEBHOOK_SECRET", secret)
+	t.Setenv("REQUEST_DECOMPRESSION", "gzip")
+	cfg := newTestConfig(t)
+	cfg.RoutesFile = writeRoutesFile(t, `routes:
+  - prefix: /open
+    upstreams: [`+upstream.URL+`]
+    middleware: [{name: public}]
+  - prefix: /hooks
+    upstreams: [`+upstream.URL+`]
+    middleware: [{name: public}, {name: signature}]
+`)
+	deps := newTestDependencies()
+	deps.Routes = NewRouteTable(cfg, nil, nil, nil, nil)
+	err := deps.Routes.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	router := BuildRouter(cfg, deps)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, `{"action":"push"}`)
+	zw.Close()
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		signOver  []byte
+		gzipped   bool
+		want      int
+		wantError string
+	}{
+		{name: "unlisted route takes an unsigned GET", method: http.MethodGet, path: "/open/status", want: http.StatusNoContent},
+		{name: "unlisted route takes an unsigned POST", method: http.MethodPost, path: "/open/events", want: http.StatusNoContent},
+		{name: "unsigned", method: http.MethodPost, path: "/hooks/github", want: http.StatusUnauthorized, wantError: errors.CodeUnauthenticated},
+		{name: "signed raw body", method: http.MethodPost, path: "/hooks/github", signOver: compressed.Bytes(), gzipped: true, want: http.StatusNoContent},
+		// the HMAC is over the bytes as sent, never the decoded ones
+		{name: "signed decoded body", method: http.MethodPost, path: "/hooks/github", signOver: []byte(`{"action":"push"}`), gzipped: true, want: http.StatusUnauthorized, wantError: errors.CodeUnauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.method == http.MethodPost {
+				body = bytes.NewReader(compressed.Bytes())
+			}
+			req := httptest.NewRequest(tt.method, tt.path, body)
+			if tt.gzipped {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if tt.signOver != nil {
+				mac := hmac.New(sha256.New, []byte(secret))
+				mac.Write(tt.signOver)
+				req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.wantError == "" {
+				return
+			}
+			var envelope errors.ErrorResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &envelope)
+			if err != nil || envelope.Error.Code != tt.wantError || envelope.Error.RequestID == "" {
+				t.Errorf("body = %s, want the %s envelope with the request ID", rec.Body.String(), tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRouteTableSignatureNeedsSecret(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "")
+	cfg := newTestConfig(t)
+	cfg.RoutesFile = writeRoutesFile(t, `routes:
+  - prefix: /hooks
+    upstreams: [http://127.0.0.1:9]
+    middleware: [{name: signature}]
+`)
+
+	err := NewRouteTable(cfg, nil, nil, nil, nil).Load()
+	if err == nil || !strings.Contains(err.Error(), "WEBHOOK_SECRET") {
+		t.Errorf("Load = %v, want the missing WEBHOOK_SECRET reported", err)
+	}
+}
+
+func BenchmarkRouteSetMatch(b *testing.B) {
+	for _, count := range []int{10, 100, 1000, 10000} {
+		prefixes := make([]string, count)
+		for i := range prefixes {
+			prefixes[i] = fmt.Sprintf("/service-%d/api/v%d", i, i%3)
+		}
+		set := newTestRouteSet(prefixes)
+
+		// the last route added, a linear scan would reach it last
+		req := httptest.NewRequest(http.MethodGet, prefixes[count-1]+"/users/42/orders", nil)
+
+		b.Run(fmt.Sprintf("routes=%d", count), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, ok := set.match(req); !ok {
+					b.Fatal("no route matched")
+				}
+			}
+		})
+	}
+}
+
+// helper functions
+
+func writeRoutesFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestRouteSet holds a route without a relay per prefix, as build adds them
+func newTestRouteSet(prefixes []string) *routeSet {
+	set := &routeSet{}
+	for _, prefix := range prefixes {
+		group := &prefixGroup{prefix: prefix, variants: []routeVariant{{route: proxy.Route{Prefix: prefix}}}}
+		set.routes = append(set.routes, group.variants[0].route)
+		set.groups = append(set.groups, group)
+		set.prefixes.insert(group)
+	}
+	return set
+}
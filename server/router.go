@@ -0,0 +1,360 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/handlers"
+	"github.com/sash2721/Relay/middlewares"
+)
+
+const frontendDir = "./frontend/dist"
+
+// the methods DEFAULT_UPSTREAM is forwarded, HEAD goes along through GetHead
+var forwardedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// Dependencies are the handlers BuildRouter mounts, Relay is optional and
+// leaves RelayAPI unmounted while nil, IPFilter guards it, ResponseCache
+// caches its GET responses and Idempotency replays its repeated POSTs.
+// JSONValidator holds the schemas of the routes validating their JSON bodies.
+// RateLimiter and RequestTimeout, when set, let a config reload change the
+// rate limit and REQUEST_TIMEOUT. DefaultRelay, when set, takes every request
+// no route matches in place of the frontend, and AccessRules, when set,
+// limits the methods and roles of the paths it lists
+type Dependencies struct {
+	AuthHandler       *handlers.AuthHandler
+	ProjectHandler    *handlers.ProjectHandler
+	LogStreamHandler  *handlers.LogStreamHandler
+	DeploymentHandler *handlers.DeploymentHandler
+	WebhookHandler    *handlers.WebhookHandler
+	HealthHandler     *handlers.HealthHandler
+	AdminHandler      *handlers.AdminHandler
+	StatsHandler      *handlers.StatsHandler
+	InFlightTracker   *middlewares.InFlightTracker
+	IPFilter          *middlewares.IPFilter
+	ResponseCache     *middlewares.ResponseCache
+	Idempotency       *middlewares.Idempotency
+	RateLimiter       *middlewares.ClientRateLimiter
+	RequestTimeout    *middlewares.ReloadableTimeout
+	JSONValidator     *middlewares.JSONValidator
+	AccessRules       *middlewares.AccessRules
+	Relay             http.Handler
+	DefaultRelay      http.Handler
+	Routes            *RouteTable
+}
+
+// BuildRouter mounts every route behind the common middlewares, outermost first:
+//
+//  1. RequestID, so every later log line and response carries the ID
+//  2. the TRACE_LOG_SAMPLE_RATE sampling, starting the clock of the relay trace log
+//  3. the stream deadlines, lifting READ_TIMEOUT and WRITE_TIMEOUT off websockets and SSE
+//  4. the security headers, set on every response on its way out
+//  5. Logging, it sees the final status and latency of everything below it
+//  6. Recovery, inside Logging so a panic is still logged as a 500
+//  7. the MAX_URL_LENGTH limit, a 414 before the URL is worked on at all
+//  8. path normalization, so every route below matches the normalized path
+//  9. Metrics and Tracing, measuring the request as the handlers see it
+//  10. the shutdown gate, a 503 for new requests once /readyz reports shutting down
+//  11. the maintenance gate, a 503 for everything but the probes and /admin
+//  12. the MAX_CONCURRENT_REQUESTS cap, shedding excess load before any work
+//  13. the load shedder, rejecting a share of requests while the p99 is over target
+//  14. CORS, answering preflights before any auth or limit can refuse them
+//  15. Gzip, compressing whatever the handlers write
+//  16. the ACCESS_RULES_FILE method and role rules, by route pattern or path
+//  17. the per-client rate limit, a no-op while RATE_LIMIT_RPS is 0
+//  18. the in-flight tracker, so shutdown can report what it cut off
+//  19. the BODY_READ_TIMEOUT deadline, before anything reads the body
+//  20. the debug body logging of BODY_LOG_PATHS
+//  21. the ROUTES_FILE route table, serving its prefixes with their own limits
+//  22. the body limit
+//  23. the REQUEST_DECOMPRESSION decoding, so the handlers read plain bodies
+//  24. GetHead, so every GET route answers HEAD with its headers and no body
+//
+// Route groups then add AuthZ and AuthN ahead of the request timeout, so a
+// rejected token never holds a timeout goroutine
+func BuildRouter(cfg *configs.ServerConfig, deps Dependencies) http.Handler {
+	r := chi.NewRouter()
+
+	// common middlewares for all routes here
+	r.Use(middlewares.RequestIDMiddleware)
+	r.Use(middlewares.TraceLogMiddleware(cfg.TraceLogSampleRate))
+	r.Use(middlewares.StreamDeadlineMiddleware)
+	r.Use(middlewares.SecurityHeadersMiddleware(cfg.SecurityHeaders(), cfg.SecurityHeadersDefer))
+	r.Use(middlewares.LoggingMiddleware(cfg))
+	r.Use(middlewares.RecoveryMiddleware)
+	r.Use(middlewares.URLLengthMiddleware(cfg.MaxURLLength))
+	r.Use(middlewares.PathNormalizeMiddleware(cfg.PathTrailingSlash, cfg.PathLowercase))
+	r.Use(middlewares.MetricsMiddleware)
+	r.Use(middlewares.TracingMiddleware)
+	r.Use(middlewares.ShutdownMiddleware(deps.HealthHandler.Readiness.IsShuttingDown))
+	r.Use(middlewares.MaintenanceMiddleware(deps.HealthHandler.Readiness.InMaintenance, cfg.MaintenanceMessage))
+	r.Use(middlewares.ConcurrencyLimitMiddleware(cfg.MaxConcurrentRequests))
+	r.Use(middlewares.NewLoadShedder(cfg.LoadShedTargetLatency, cfg.LoadShedMaxRate).Middleware)
+	r.Use(middlewares.CORSMiddleware(cfg))
+	r.Use(middlewares.GzipMiddleware(cfg.GzipMinSize, cfg.GzipLevel))
+	r.Use(deps.AccessRules.Middleware(routePattern(r, deps.Routes)))
+	rateLimiter := deps.RateLimiter
+	if rateLimiter == nil {
+		rateLimiter = middlewares.NewClientRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	}
+	r.Use(rateLimiter.Middleware)
+	if deps.InFlightTracker != nil {
+		r.Use(deps.InFlightTracker.Middleware)
+	}
+	r.Use(middlewares.BodyReadTimeoutMiddleware(cfg.BodyReadTimeout))
+	r.Use(middlewares.BodyLoggingMiddleware(cfg))
+	if deps.Routes != nil {
+		r.Use(deps.Routes.Middleware)
+	}
+	bodyLimiter := middlewares.NewBodyLimiter(cfg.MaxBodyBytes)
+	if deps.Relay != nil {
+		bodyLimiter.Override(cfg.RelayAPI+"/", cfg.RelayMaxBodyBytes)
+	}
+	r.Use(bodyLimiter.Middleware)
+	r.Use(middlewares.DecompressMiddleware(cfg.RequestDecompression, cfg.RequestDecompressionMaxBytes, cfg.RequestDecompressionStrict))
+	r.Use(middleware.GetHead)
+
+	// JSON instead of chi's plain text answers
+	r.NotFound(handlers.HandleNotFound)
+	r.MethodNotAllowed(handlers.HandleMethodNotAllowed)
+
+	r.Get("/health", handlers.NewRootHandler(cfg.RootHandlerMode, cfg.RootMessage, cfg.RootRedirectURL))
+	r.Get("/version", handlers.HandleVersion)
+
+	// every route answers within REQUEST_TIMEOUT except the long-lived streams
+	requestTimeout := routeTimeout(cfg, deps)
+
+	// with ADMIN_PORT the operational routes live on the admin server only,
+	// their paths answer 404 here rather than reaching the frontend or the
+	// DEFAULT_UPSTREAM
+	if cfg.AdminPort == "" {
+		mountOperationalRoutes(r, cfg, deps, requestTimeout)
+	} else {
+		for _, path := range operationalPaths {
+			r.Handle(path, http.HandlerFunc(handlers.HandleNotFound))
+		}
+	}
+
+	// public routes
+	r.Group(func(r chi.Router) {
+		r.Use(requestTimeout)
+
+		r.Post(cfg.LoginAPI, deps.AuthHandler.HandleLogin)
+		r.Post(cfg.SignupAPI, deps.AuthHandler.HandleSignup)
+		r.Get(cfg.GoogleLoginAPI, deps.AuthHandler.HandleGoogleLogin)
+		r.Get(cfg.GoogleCallbackAPI, deps.AuthHandler.HandleGoogleCallback)
+		r.Get(cfg.GithubLoginAPI, deps.AuthHandler.HandleGithubLogin)
+		r.Get(cfg.GithubCallbackAPI, deps.AuthHandler.HandleGithubCallback)
+		r.Get(cfg.LogoutAPI, handlers.HandleLogout)
+	})
+
+	// protected streaming routes, no request timeout
+	r.Group(func(r chi.Router) {
+		r.Use(middlewares.AuthZMiddleware)
+		r.Use(middlewares.AuthNMiddleware)
+
+		// log streamer
+		r.Get(cfg.StreamLogsAPI, deps.LogStreamHandler.HandlerLogStream)
+	})
+
+	// protected routes
+	r.Group(func(r chi.Router) {
+		r.Use(middlewares.AuthZMiddleware)
+		r.Use(middlewares.AuthNMiddleware)
+		r.Use(requestTimeout)
+
+		// add protected routes here
+		// project handler
+		r.Post(cfg.ProjectAPI, deps.ProjectHandler.HandleCreateProject)
+		r.Get(cfg.ProjectAPI, deps.ProjectHandler.HandleListProjects)
+		r.Get(cfg.UpdateProjectAPI, deps.ProjectHandler.HandleGetProject)
+		r.Delete(cfg.UpdateProjectAPI, deps.ProjectHandler.HandleDeleteProject)
+
+		// deployment handler
+		// adding rate limit to the trigger deployment
+		r.Post(cfg.TriggerDeploymentAPI,
+			middlewares.RateLimitMiddleware(
+				http.HandlerFunc(deps.DeploymentHandler.HandleTriggerDeployment),
+			).ServeHTTP,
+		)
+		r.Get(cfg.GetDeploymentAPI, deps.DeploymentHandler.HandleGetDeployment)
+		r.Get(cfg.ListDeploymentsAPI, deps.DeploymentHandler.HandleListDeployments)
+		r.Delete(cfg.DeleteDeploymentAPI, deps.DeploymentHandler.HandleDeleteDeployment)
+
+		// webhook relay
+		r.With(
+			middlewares.ContentTypeMiddleware(cfg.WebhookContentTypes),
+			deps.JSONValidator.Middleware(cfg.WebhookAPI),
+		).Post(cfg.WebhookAPI, deps.WebhookHandler.HandleCreateWebhook)
+		r.Get(cfg.WebhookDeliveryAPI, deps.WebhookHandler.HandleGetWebhookDelivery)
+	})
+
+	// relay routes, everything under RelayAPI is balanced across the upstreams
+	if deps.Relay != nil {
+		r.With(
+			deps.IPFilter.Middleware,
+			middlewares.APIKeyMiddleware(cfg.APIKeys),
+			middlewares.UpstreamOverrideMiddleware(cfg.AdminAPIKeys, cfg.RelayOverrideHosts),
+			middlewares.ContentTypeMiddleware(cfg.RelayContentTypes),
+			deps.Idempotency.Middleware,
+			deps.ResponseCache.Middleware,
+			requestTimeout,
+			middlewares.RestoreOriginalPath(cfg.RelayOriginalPath, cfg.RelayAPI),
+		).Handle(cfg.RelayAPI+"/*", http.StripPrefix(cfg.RelayAPI, deps.Relay))
+	}
+
+	// forward everything else, the catch-all ranks below every other route.
+	// HEAD is left out so GetHead still hands it to the GET route of its path
+	if deps.DefaultRelay != nil {
+		forward := chi.Chain(
+			deps.IPFilter.Middleware,
+			middlewares.APIKeyMiddleware(cfg.APIKeys),
+			middlewares.ContentTypeMiddleware(cfg.RelayContentTypes),
+			requestTimeout,
+		).Handler(builtinRoutesGuard(r, deps.DefaultRelay))
+		for _, method := range forwardedMethods {
+			r.Method(method, "/*", forward)
+		}
+		return r
+	}
+
+	// Serve frontend static files
+	fs := http.FileServer(http.Dir(frontendDir))
+	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+		// Try to serve the file directly
+		path := frontendDir + r.URL.Path
+		if _, err := os.Stat(path); err == nil {
+			fs.ServeHTTP(w, r)
+			return
+		}
+		// SPA fallback — serve index.html for client-side routing
+		http.ServeFile(w, r, frontendDir+"/index.html")
+	})
+
+	return r
+}
+
+// BuildAdminRouter mounts the operational routes for ADMIN_PORT: the probes,
+// /metrics, /stats, /admin and the pprof profiles. Only RequestID, Logging,
+// Recovery and GetHead go in front of them, the public server's gates and
+// limits are for the public traffic
+func BuildAdminRouter(cfg *configs.ServerConfig, deps Dependencies) http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(middlewares.RequestIDMiddleware)
+	r.Use(middlewares.LoggingMiddleware(cfg))
+	r.Use(middlewares.RecoveryMiddleware)
+	r.Use(middleware.GetHead)
+
+	r.NotFound(handlers.HandleNotFound)
+	r.MethodNotAllowed(handlers.HandleMethodNotAllowed)
+
+	mountOperationalRoutes(r, cfg, deps, routeTimeout(cfg, deps))
+	return r
+}
+
+// helper functions
+
+// the paths mountOperationalRoutes serves, for the public router to refuse
+var operationalPaths = []string{"/healthz", "/healthz/deep", "/readyz", "/metrics", "/stats", "/admin/*", "/debug/pprof/*"}
+
+func routeTimeout(cfg *configs.ServerConfig, deps Dependencies) func(http.Handler) http.Handler {
+	if deps.RequestTimeout != nil {
+		return deps.RequestTimeout.Middleware
+	}
+	return middlewares.RequestTimeoutMiddleware(cfg.RequestTimeout)
+}
+
+// mountOperationalRoutes mounts the probes, /metrics and the routes behind
+// API_KEYS on r, the public router or the ADMIN_PORT one
+func mountOperationalRoutes(r chi.Router, cfg *configs.ServerConfig, deps Dependencies, requestTimeout func(http.Handler) http.Handler) {
+	r.Get("/healthz", handlers.HandleHealthz)
+	r.Get("/healthz/deep", deps.HealthHandler.HandleDeepHealth)
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/readyz", deps.HealthHandler.HandleReadyz)
+
+	// admin routes, only mounted with API_KEYS since an admin endpoint never
+	// goes out unguarded
+	if deps.AdminHandler != nil && len(cfg.APIKeys) > 0 {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(deps.IPFilter.Middleware)
+			r.Use(middlewares.APIKeyMiddleware(cfg.APIKeys))
+			r.Use(requestTimeout)
+
+			r.Post("/maintenance", deps.AdminHandler.HandleMaintenance)
+			r.Get("/breakers", deps.AdminHandler.HandleBreakers)
+			r.Post("/breakers/{upstream}/reset", deps.AdminHandler.HandleBreakerReset)
+		})
+	}
+
+	// operational snapshot for those not scraping /metrics, behind API_KEYS
+	// like the admin routes
+	if deps.StatsHandler != nil && len(cfg.APIKeys) > 0 {
+		r.With(
+			deps.IPFilter.Middleware,
+			middlewares.APIKeyMiddleware(cfg.APIKeys),
+			requestTimeout,
+		).Get("/stats", deps.StatsHandler.HandleStats)
+	}
+
+	// runtime profiles, not even registered unless ENABLE_PPROF is set, and
+	// without a request timeout since a CPU profile runs for its duration
+	if cfg.EnablePprof {
+		r.Route("/debug/pprof", func(r chi.Router) {
+			r.Use(deps.IPFilter.Middleware)
+			r.Use(middlewares.APIKeyMiddleware(cfg.APIKeys))
+
+			r.Get("/", pprof.Index)
+			r.Get("/cmdline", pprof.Cmdline)
+			r.Get("/profile", pprof.Profile)
+			r.HandleFunc("/symbol", pprof.Symbol)
+			r.Get("/trace", pprof.Trace)
+			r.Get("/{profile}", pprof.Index)
+		})
+	}
+}
+
+// routePattern finds the pattern a request will be routed by before the
+// router has run, the route table first since its prefixes win. A path routed
+// under another method gives that route's pattern, for the rules to answer 405
+func routePattern(routes chi.Routes, table *RouteTable) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if table != nil {
+			if pattern := table.pattern(r); pattern != "" {
+				return pattern
+			}
+		}
+
+		pattern := routes.Find(chi.NewRouteContext(), r.Method, r.URL.Path)
+		if pattern != "" {
+			return pattern
+		}
+		for _, method := range forwardedMethods {
+			pattern = routes.Find(chi.NewRouteContext(), method, r.URL.Path)
+			if pattern != "" {
+				return pattern
+			}
+		}
+		return ""
+	}
+}
+
+// builtinRoutesGuard answers 405 instead of forwarding a path a built-in route
+// serves under another method, so POST /health never reaches the upstream
+func builtinRoutesGuard(routes chi.Routes, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range forwardedMethods {
+			pattern := routes.Find(chi.NewRouteContext(), method, r.URL.Path)
+			if pattern != "" && pattern != "/*" {
+				handlers.HandleMethodNotAllowed(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sash2721/Relay/configs"
+	"github.com/sash2721/Relay/handlers"
+	"github.com/sash2721/Relay/middlewares"
+	"github.com/sash2721/Relay/services"
+)
+
+func TestBuildRouterRecoversPanicAndLogs500(t *testing.T) {
+	cfg := newTestConfig(t)
+	logs := captureLogs(t)
+
+	deps := newTestDependencies()
+	deps.DefaultRelay = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler blew up")
+	})
+	router := BuildRouter(cfg, deps)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panics", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	completed := logs.find("Completed Request")
+	if completed == nil {
+		t.Fatal("the panicking request was not logged")
+	}
+	if completed["level"] != "ERROR" {
+		t.Errorf("level = %v, want ERROR", completed["level"])
+	}
+	if status, _ := completed["StatusCode"].(float64); status != http.StatusInternalServerError {
+		t.Errorf("logged StatusCode = %v, want %d", completed["StatusCode"], http.StatusInternalServerError)
+	}
+	if completed["RequestID"] == "" || completed["RequestID"] != rec.Header().Get("X-Request-ID") {
+		t.Errorf("logged RequestID = %v, response has %q", completed["RequestID"], rec.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestBuiltinHandlersAnswerHead(t *testing.T) {
+	cfg := newTestConfig(t)
+	deps := newTestDependencies()
+	deps.HealthHandler.Readiness.MarkStarted()
+	front := httptest.NewServer(BuildRouter(cfg, deps))
+	defer front.Close()
+
+	// compare the plain bodies, gzip would change the GET's length
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, path := range []string{"/health", "/healthz", "/readyz", "/version"} {
+		t.Run(path, func(t *testing.T) {
+			get, err := client.Get(front.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(get.Body)
+			get.Body.Close()
+
+			head, err := client.Head(front.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headBody, _ := io.ReadAll(head.Body)
+			head.Body.Close()
+
+			if head.StatusCode != get.StatusCode {
+				t.Errorf("HEAD status = %d, GET answered %d", head.StatusCode, get.StatusCode)
+			}
+			if len(headBody) != 0 {
+				t.Errorf("HEAD wrote a %d byte body", len(headBody))
+			}
+			if head.ContentLength != -1 && head.ContentLength != int64(len(body)) {
+				t.Errorf("HEAD Content-Length = %d, the GET body is %d bytes", head.ContentLength, len(body))
+			}
+			if head.Header.Get("Content-Type") != get.Header.Get("Content-Type") {
+				t.Errorf("HEAD Content-Type = %q, GET has %q", head.Header.Get("Content-Type"), get.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+// helper functions
+
+// the route paths of template.env, the config has no defaults for them
+var testRoutePaths = map[string]string{
+	"GOOGLE_LOGIN_API":       "/auth/google/login",
+	"GOOGLE_CALLBACK_API":    "/auth/google/callback",
+	"GITHUB_LOGIN_API":       "/auth/github/login",
+	"GITHUB_CALLBACK_API":    "/auth/github/callback",
+	"LOGIN_API":              "/auth/login",
+	"SIGNUP_API":             "/auth/signup",
+	"LOGOUT_API":             "/auth/logout",
+	"PROJECT_API":            "/api/projects",
+	"UPDATE_PROJECT_API":     "/api/projects/{projectID}",
+	"STREAM_LOGS_API":        "/api/projects/{projectID}/deployments/{deploymentID}/logs",
+	"TRIGGER_DEPLOYMENT_API": "/api/projects/{projectID}/deployments",
+	"LIST_DEPLOYMENTS_API":   "/api/projects/{projectID}/deployments",
+	"GET_DEPLOYMENT_API":     "/api/projects/{projectID}/deployments/{deploymentID}",
+	"DELETE_DEPLOYMENT_API":  "/api/projects/{projectID}/deployments/{deploymentID}",
+}
+
+// newTestConfig reads the config from the env like the server does, without
+// the command line flags the test binary has
+func newTestConfig(t *testing.T) *configs.ServerConfig {
+	t.Helper()
+	for key, path := range testRoutePaths {
+		t.Setenv(key, path)
+	}
+	err := configs.InitServerConfig()
+	if err != nil {
+		t.Fatalf("InitServerConfig: %v", err)
+	}
+	cfg := *configs.GetServerConfig()
+	return &cfg
+}
+
+// newTestDependencies has every handler BuildRouter mounts, none of them
+// connected to a database
+func newTestDependencies() Dependencies {
+	readiness := services.NewReadinessService()
+	return Dependencies{
+		AuthHandler:       &handlers.AuthHandler{},
+		ProjectHandler:    &handlers.ProjectHandler{},
+		LogStreamHandler:  &handlers.LogStreamHandler{},
+		DeploymentHandler: &handlers.DeploymentHandler{},
+		WebhookHandler:    &handlers.WebhookHandler{},
+		HealthHandler:     &handlers.HealthHandler{Readiness: readiness},
+		AdminHandler:      &handlers.AdminHandler{Readiness: readiness},
+		StatsHandler:      &handlers.StatsHandler{},
+		JSONValidator:     middlewares.NewJSONValidator(),
+	}
+}
+
+// capturedLogs keeps the JSON lines of the default logger
+type capturedLogs struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *capturedLogs) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// find returns the last record logged with msg, nil without one
+func (l *capturedLogs) find(msg string) map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var found map[string]any
+	for _, line := range bytes.Split(l.buf.Bytes(), []byte("\n")) {
+		var record map[string]any
+		if json.Unmarshal(line, &record) == nil && record["msg"] == msg {
+			found = record
+		}
+	}
+	return found
+}
+
+func captureLogs(t *testing.T) *capturedLogs {
+	t.Helper()
+	logs := &capturedLogs{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
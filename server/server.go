@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+// NewServer builds the backend server from cfg, the timeouts already carry
+// the defaults of the cfg.Env profile
+func NewServer(cfg *configs.ServerConfig, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              cfg.ListenAddr(),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+
+	if cfg.TLSEnabled() {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	// HTTP/2 without TLS, with prior knowledge like gRPC clients speak it,
+	// next to HTTP/1.1 on the same port. Over TLS HTTP/2 is always on
+	if cfg.HTTP2Cleartext {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return server
+}
+
+// Listen binds the backend server up front, on LISTEN_NETWORK=unix as a
+// socket file, so a bind failure is reported to the caller instead of
+// inside the serve goroutine
+func Listen(cfg *configs.ServerConfig, server *http.Server) (net.Listener, error) {
+	if cfg.ListenNetwork == "unix" {
+		listener, err := listenUnix(server.Addr, cfg.SocketMode)
+		if err != nil {
+			return nil, err
+		}
+		return wrapProxyProtocol(cfg.ProxyProtocol, cfg.ReadHeaderTimeout, listener), nil
+	}
+	return ListenTCP(cfg, server)
+}
+
+// ListenTCP binds the server address up front, sharing the port with other
+// processes under REUSEPORT and resizing the accept queue to LISTEN_BACKLOG.
+// Where either isn't supported it warns and listens without it. Under
+// PROXY_PROTOCOL every connection reports the client its header names
+func ListenTCP(cfg *configs.ServerConfig, server *http.Server) (net.Listener, error) {
+	var listenConfig net.ListenConfig
+	if cfg.ReusePort {
+		if reusePortSupported {
+			listenConfig.Control = reusePort
+		} else {
+			slog.Warn("REUSEPORT is not supported on this platform, listening without it",
+				slog.String("Addr", server.Addr),
+			)
+		}
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", server.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", server.Addr, err)
+	}
+
+	if cfg.ListenBacklog > 0 {
+		err = setBacklog(listener, cfg.ListenBacklog)
+		if err != nil {
+			slog.Warn("Failed to set LISTEN_BACKLOG, keeping the system default",
+				slog.String("Addr", server.Addr),
+				slog.Any("Error", err),
+			)
+		}
+	}
+	return wrapProxyProtocol(cfg.ProxyProtocol, cfg.ReadHeaderTimeout, listener), nil
+}
+
+// Serve serves HTTPS on listener when cfg carries a cert and key, plain HTTP otherwise
+func Serve(cfg *configs.ServerConfig, server *http.Server, listener net.Listener) error {
+	if cfg.TLSEnabled() {
+		return server.ServeTLS(listener, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return server.Serve(listener)
+}
+
+// helper functions
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %w", path, err)
+	}
+
+	// the socket is created with the umask, the reverse proxy in front needs mode
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to chmod unix socket %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes a socket file left behind by a process that did
+// not shut down cleanly, a socket that still accepts connections is in use
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat unix socket %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is already in use", path)
+	}
+
+	slog.Warn("Removing stale unix socket", slog.String("Path", path))
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+	}
+
+	return nil
+}
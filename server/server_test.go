@@ -0,0 +1,124 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sash2721/Relay/configs"
+)
+
+func TestNewServerPerEnv(t *testing.T) {
+	tests := []struct {
+		env         string
+		host        string
+		port        string
+		addr        string
+		readTimeout time.Duration
+		idleTimeout time.Duration
+	}{
+		{env: "development", addr: ":8080", readTimeout: 10 * time.Second, idleTimeout: 60 * time.Second},
+		{env: "staging", port: "9090", addr: ":9090", readTimeout: 15 * time.Second, idleTimeout: 120 * time.Second},
+		{env: "production", host: "127.0.0.1", port: ":8443", addr: "127.0.0.1:8443", readTimeout: 15 * time.Second, idleTimeout: 120 * time.Second},
+		// an empty or unknown ENV falls back to the default profile
+		{env: "", host: "::1", addr: "[::1]:8080", readTimeout: 15 * time.Second, idleTimeout: 120 * time.Second},
+		{env: "qa", host: "0.0.0.0", port: "3000", addr: "0.0.0.0:3000", readTimeout: 15 * time.Second, idleTimeout: 120 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run("ENV="+tt.env, func(t *testing.T) {
+			t.Setenv("ENV", tt.env)
+			t.Setenv("HOST", tt.host)
+			t.Setenv("PORT", tt.port)
+			t.Setenv("LISTEN_NETWORK", "")
+			t.Setenv("LISTEN_ADDR", "")
+			t.Setenv("READ_TIMEOUT", "")
+			t.Setenv("WRITE_TIMEOUT", "")
+			t.Setenv("IDLE_TIMEOUT", "")
+
+			err := configs.InitServerConfig()
+			if err != nil {
+				t.Fatalf("InitServerConfig: %v", err)
+			}
+
+			server := NewServer(configs.GetServerConfig(), http.NotFoundHandler())
+			if server == nil {
+				t.Fatal("NewServer returned nil")
+			}
+			if server.Handler == nil {
+				t.Error("server has no handler")
+			}
+			if server.Addr != tt.addr {
+				t.Errorf("Addr = %q, want %q", server.Addr, tt.addr)
+			}
+			if server.ReadTimeout != tt.readTimeout {
+				t.Errorf("ReadTimeout = %v, want %v", server.ReadTimeout, tt.readTimeout)
+			}
+			if server.WriteTimeout != 0 {
+				t.Errorf("WriteTimeout = %v, want it disabled", server.WriteTimeout)
+			}
+			if server.IdleTimeout != tt.idleTimeout {
+				t.Errorf("IdleTimeout = %v, want %v", server.IdleTimeout, tt.idleTimeout)
+			}
+		})
+	}
+}
+
+func TestListenFailsFastOnOccupiedPort(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	cfg := &configs.ServerConfig{ListenNetwork: "tcp", Port: occupied.Addr().String()}
+	server := NewServer(cfg, http.NotFoundHandler())
+
+	started := time.Now()
+	listener, err := Listen(cfg, server)
+	if err == nil {
+		listener.Close()
+		t.Fatalf("Listen on the occupied %s succeeded", occupied.Addr())
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Listen took %v to fail", elapsed)
+	}
+}
+
+func TestReadHeaderTimeoutClosesSlowHeaders(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	cfg := &configs.ServerConfig{ListenNetwork: "tcp", Port: "127.0.0.1:0", ReadHeaderTimeout: timeout}
+	server := NewServer(cfg, http.NotFoundHandler())
+	listener, err := Listen(cfg, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(cfg, server, listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the request line and one header, the blank line never comes
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: relay\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the server may answer 408 before it closes, the connection ends either way
+	_, err = io.ReadAll(conn)
+	elapsed := time.Since(started)
+	if err != nil {
+		t.Fatalf("the connection was not closed: %v", err)
+	}
+	if elapsed < timeout/2 {
+		t.Errorf("closed after %v, before the %v timeout", elapsed, timeout)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// SO_REUSEPORT and resizing the backlog are Linux and BSD only
+const reusePortSupported = false
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errors.ErrUnsupported
+}
+
+func setBacklog(listener net.Listener, backlog int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,26 @@
+package services
+
+// FatalError is a failure a background component can't recover from, the
+// app shuts down on the first one instead of running degraded
+type FatalError struct {
+	Component string
+	Err       error
+}
+
+func (e *FatalError) Error() string {
+	return e.Component + ": " + e.Err.Error()
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// ReportFatal sends err of component on fatal without blocking, the first
+// error already shuts the app down so the ones after it are dropped, as is
+// everything sent on a nil channel
+func ReportFatal(fatal chan<- error, component string, err error) {
+	select {
+	case fatal <- &FatalError{Component: component, Err: err}:
+	default:
+	}
+}
@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadinessChecker is implemented by components (DB, queue, ...) that the
+// service needs before it can take traffic
+type ReadinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// ReadinessCheckerFunc adapts a plain function into a ReadinessChecker
+type ReadinessCheckerFunc func(ctx context.Context) error
+
+func (f ReadinessCheckerFunc) Ready(ctx context.Context) error {
+	return f(ctx)
+}
+
+// degradedError marks a check that still works, only worse, such as a pool
+// with some of its members down
+type degradedError struct {
+	err error
+}
+
+func (e *degradedError) Error() string {
+	return "degraded: " + e.err.Error()
+}
+
+func (e *degradedError) Unwrap() error {
+	return e.err
+}
+
+// Degraded wraps err so a checker can report a soft failure, readiness treats
+// it as passing and the deep health check reports it apart from hard failures
+func Degraded(err error) error {
+	return &degradedError{err: err}
+}
+
+// IsDegraded reports whether err came from Degraded
+func IsDegraded(err error) bool {
+	var degraded *degradedError
+	return stderrors.As(err, &degraded)
+}
+
+// CheckResult is the outcome of one checker in a deep check
+type CheckResult struct {
+	Err     error
+	Latency time.Duration
+}
+
+// WarmupFunc primes a dependency or cache before the service reports ready
+type WarmupFunc func(ctx context.Context) error
+
+type namedChecker struct {
+	name    string
+	checker ReadinessChecker
+}
+
+type namedWarmup struct {
+	name   string
+	warmup WarmupFunc
+}
+
+type ReadinessService struct {
+	mu           sync.RWMutex
+	checkers     []namedChecker
+	warmups      []namedWarmup
+	started      atomic.Bool
+	shuttingDown atomic.Bool
+	maintenance  atomic.Bool
+}
+
+func NewReadinessService() *ReadinessService {
+	return &ReadinessService{}
+}
+
+func (s *ReadinessService) Register(name string, checker ReadinessChecker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkers = append(s.checkers, namedChecker{name: name, checker: checker})
+}
+
+// AddWarmup registers a hook Warmup runs before the service takes traffic
+func (s *ReadinessService) AddWarmup(name string, warmup WarmupFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.warmups = append(s.warmups, namedWarmup{name: name, warmup: warmup})
+}
+
+// Warmup runs the hooks in the order they were added and stops at the first
+// error, readiness stays off until MarkStarted
+func (s *ReadinessService) Warmup(ctx context.Context) error {
+	s.mu.RLock()
+	warmups := make([]namedWarmup, len(s.warmups))
+	copy(warmups, s.warmups)
+	s.mu.RUnlock()
+
+	for _, w := range warmups {
+		err := w.warmup(ctx)
+		if err != nil {
+			return fmt.Errorf("warmup %s failed: %w", w.name, err)
+		}
+	}
+	return nil
+}
+
+// MarkStarted flips readiness on once startup has finished
+func (s *ReadinessService) MarkStarted() {
+	s.started.Store(true)
+}
+
+// MarkShuttingDown reports not-ready right away so load balancers stop
+// sending traffic before the server drains
+func (s *ReadinessService) MarkShuttingDown() {
+	s.shuttingDown.Store(true)
+}
+
+// IsShuttingDown reports whether MarkShuttingDown has been called
+func (s *ReadinessService) IsShuttingDown() bool {
+	return s.shuttingDown.Load()
+}
+
+// SetMaintenance switches maintenance mode on or off, /readyz reports not
+// ready while it's on so load balancers deregister the instance
+func (s *ReadinessService) SetMaintenance(on bool) {
+	s.maintenance.Store(on)
+}
+
+// InMaintenance reports whether maintenance mode is on
+func (s *ReadinessService) InMaintenance() bool {
+	return s.maintenance.Load()
+}
+
+// Check returns the state of every registered checker by name and an error
+// when the service should not receive traffic
+func (s *ReadinessService) Check(ctx context.Context) (map[string]error, error) {
+	if s.shuttingDown.Load() {
+		return nil, fmt.Errorf("service is shutting down")
+	}
+	if !s.started.Load() {
+		return nil, fmt.Errorf("service is still starting")
+	}
+	if s.maintenance.Load() {
+		return nil, fmt.Errorf("service is in maintenance")
+	}
+
+	s.mu.RLock()
+	checkers := make([]namedChecker, len(s.checkers))
+	copy(checkers, s.checkers)
+	s.mu.RUnlock()
+
+	results := make(map[string]error, len(checkers))
+	var failed []string
+	for _, c := range checkers {
+		err := c.checker.Ready(ctx)
+		results[c.name] = err
+		if err != nil && !IsDegraded(err) {
+			failed = append(failed, c.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("checks failing: %v", failed)
+	}
+
+	return results, nil
+}
+
+// CheckDeep runs every registered checker in parallel and reports each one's
+// error and latency, unlike Check it ignores the startup and shutdown state
+func (s *ReadinessService) CheckDeep(ctx context.Context) map[string]CheckResult {
+	s.mu.RLock()
+	checkers := make([]namedChecker, len(s.checkers))
+	copy(checkers, s.checkers)
+	s.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]CheckResult, len(checkers))
+	for _, c := range checkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			started := time.Now()
+			err := c.checker.Ready(ctx)
+			result := CheckResult{Err: err, Latency: time.Since(started)}
+
+			mu.Lock()
+			results[c.name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,376 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sash2721/Relay/models"
+)
+
+const (
+	redisKeyPrefix = "relay:webhooks:"
+	// a blocked Dequeue wakes up this often to promote the due retries and
+	// notice ctx is done
+	redisPollInterval = time.Second
+	// bounds every call that doesn't get a ctx of its own
+	redisOpTimeout = 5 * time.Second
+	// a finish losing its WATCH to other deliveries' writes this often gives up
+	maxFinishAttempts = 10
+	// and waits up to this much longer after every one it loses
+	finishRetryPause = 2 * time.Millisecond
+)
+
+// promoteDue moves the delayed deliveries whose retry is due onto the ready
+// list, in one step so two workers never promote the same one
+var promoteDue = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('LPUSH', KEYS[2], id)
+end
+return #due
+`)
+
+// expireLeases puts the deliveries whose lease ran out back at the front of
+// the ready list, the next Dequeue counts the attempt they were on
+var expireLeases = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[1], id)
+	if redis.call('LREM', KEYS[2], 1, id) > 0 then
+		redis.call('RPUSH', KEYS[3], id)
+	end
+end
+return #expired
+`)
+
+// requeueUnleased moves the IDs on the processing list without a lease, taken
+// by a Dequeue that stopped before leasing them, back onto the ready list
+var requeueUnleased = redis.NewScript(`
+local ids = redis.call('LRANGE', KEYS[1], 0, -1)
+local requeued = 0
+for _, id in ipairs(ids) do
+	if not redis.call('ZSCORE', KEYS[3], id) then
+		redis.call('LREM', KEYS[1], 1, id)
+		redis.call('RPUSH', KEYS[2], id)
+		requeued = requeued + 1
+	end
+end
+return requeued
+`)
+
+// RedisWebhookQueue keeps the deliveries in Redis so they survive a restart,
+// with the reliable queue pattern: Dequeue moves an ID from the ready list
+// onto the processing list in one step and only Ack, Nack or DeadLetter take
+// it off again. The deliveries themselves live in a hash, retries wait in a
+// sorted set scored by their due time and the leases of the ones being
+// delivered in another scored by when they run out
+type RedisWebhookQueue struct {
+	client            *redis.Client
+	deliveriesKey     string
+	readyKey          string
+	processingKey     string
+	delayedKey        string
+	leasesKey         string
+	visibilityTimeout time.Duration
+}
+
+// NewRedisWebhookQueue connects to url and requeues the deliveries a previous
+// run took off the ready list without leasing them. The leased ones it was
+// still delivering when it stopped come back once their lease runs out, they
+// are delivered again since delivery is at least once anyway. A dequeued
+// delivery is leased for visibilityTimeout, across every instance sharing
+// the queue
+func NewRedisWebhookQueue(ctx context.Context, url string, visibilityTimeout time.Duration) (*RedisWebhookQueue, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+
+	q := &RedisWebhookQueue{
+		client:        redis.NewClient(options),
+		deliveriesKey: redisKeyPrefix + "deliveries",
+		readyKey:      redisKeyPrefix + "ready",
+		processingKey: redisKeyPrefix + "processing",
+		delayedKey:    redisKeyPrefix + "delayed",
+		leasesKey:     redisKeyPrefix + "leases",
+
+		visibilityTimeout: visibilityTimeout,
+	}
+
+	err = q.Ping(ctx)
+	if err != nil {
+		q.client.Close()
+		return nil, fmt.Errorf("failed to reach redis: %w", err)
+	}
+
+	requeued, err := q.requeueProcessing(ctx)
+	if err != nil {
+		q.client.Close()
+		return nil, err
+	}
+	if requeued > 0 {
+		slog.Warn("Requeued webhook deliveries interrupted by the last shutdown", slog.Int("Deliveries", requeued))
+	}
+
+	return q, nil
+}
+
+func (q *RedisWebhookQueue) Enqueue(delivery models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	delivery.Status = models.DeliveryStatusPending
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.deliveriesKey, delivery.Id, encoded)
+		if delivery.NextAttemptAt.After(time.Now()) {
+			pipe.ZAdd(ctx, q.delayedKey, redis.Z{Score: float64(delivery.NextAttemptAt.UnixMilli()), Member: delivery.Id})
+		} else {
+			pipe.LPush(ctx, q.readyKey, delivery.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue delivery %s: %w", delivery.Id, err)
+	}
+	return nil
+}
+
+func (q *RedisWebhookQueue) Dequeue(ctx context.Context) (models.WebhookDelivery, error) {
+	for {
+		if ctx.Err() != nil {
+			return models.WebhookDelivery{}, ctx.Err()
+		}
+
+		err := promoteDue.Run(ctx, q.client, []string{q.delayedKey, q.readyKey}, time.Now().UnixMilli()).Err()
+		if err != nil {
+			return models.WebhookDelivery{}, fmt.Errorf("failed to promote the due deliveries: %w", err)
+		}
+		err = expireLeases.Run(ctx, q.client, []string{q.leasesKey, q.processingKey, q.readyKey}, time.Now().UnixMilli()).Err()
+		if err != nil {
+			return models.WebhookDelivery{}, fmt.Errorf("failed to expire the delivery leases: %w", err)
+		}
+
+		id, err := q.client.BLMove(ctx, q.readyKey, q.processingKey, "RIGHT", "LEFT", redisPollInterval).Result()
+		if stderrors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return models.WebhookDelivery{}, fmt.Errorf("failed to dequeue: %w", err)
+		}
+
+		delivery, ok, err := q.load(ctx, q.client, id)
+		if err != nil {
+			return models.WebhookDelivery{}, err
+		}
+		if !ok || isFinished(delivery.Status) {
+			// the ID outlived its delivery, nothing left to deliver
+			q.client.LRem(ctx, q.processingKey, 1, id)
+			continue
+		}
+
+		now := time.Now()
+		// still delivering, so its last lease ran out or the instance holding
+		// it stopped before finishing it
+		if delivery.Status == models.DeliveryStatusDelivering {
+			delivery.Attempts++
+			delivery.LastError = leaseExpiredError
+		}
+		delivery.Status = models.DeliveryStatusDelivering
+		delivery.UpdatedAt = now
+		delivery.LeaseId = uuid.NewString()
+		delivery.LeaseExpiresAt = now.Add(q.visibilityTimeout)
+
+		_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			err := q.save(ctx, pipe, delivery)
+			if err != nil {
+				return err
+			}
+			pipe.ZAdd(ctx, q.leasesKey, redis.Z{Score: float64(delivery.LeaseExpiresAt.UnixMilli()), Member: delivery.Id})
+			return nil
+		})
+		if err != nil {
+			return models.WebhookDelivery{}, fmt.Errorf("failed to lease delivery %s: %w", delivery.Id, err)
+		}
+		return delivery, nil
+	}
+}
+
+func (q *RedisWebhookQueue) Ack(delivery models.WebhookDelivery) error {
+	return q.finish(delivery, func(stored *models.WebhookDelivery) {
+		stored.Status = models.DeliveryStatusDelivered
+		stored.Attempts = delivery.Attempts
+		stored.LastError = ""
+	}, nil)
+}
+
+func (q *RedisWebhookQueue) Nack(delivery models.WebhookDelivery, retryAt time.Time) error {
+	return q.finish(delivery, func(stored *models.WebhookDelivery) {
+		stored.Status = models.DeliveryStatusPending
+		stored.Attempts = delivery.Attempts
+		stored.LastError = delivery.LastError
+		stored.NextAttemptAt = retryAt
+	}, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.ZAdd(ctx, q.delayedKey, redis.Z{Score: float64(retryAt.UnixMilli()), Member: delivery.Id})
+	})
+}
+
+func (q *RedisWebhookQueue) DeadLetter(delivery models.WebhookDelivery) error {
+	return q.finish(delivery, func(stored *models.WebhookDelivery) {
+		stored.Status = models.DeliveryStatusDead
+		stored.Attempts = delivery.Attempts
+		stored.LastError = delivery.LastError
+	}, nil)
+}
+
+func (q *RedisWebhookQueue) Get(id string) (models.WebhookDelivery, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	delivery, ok, err := q.load(ctx, q.client, id)
+	if err != nil {
+		slog.Error("Failed to load a webhook delivery", slog.String("Id", id), slog.Any("Error", err))
+		return models.WebhookDelivery{}, false
+	}
+	return delivery, ok
+}
+
+// Depth adds up the ready, delayed and processing deliveries
+func (q *RedisWebhookQueue) Depth() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	var ready, delayed, processing *redis.IntCmd
+	_, err := q.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		ready = pipe.LLen(ctx, q.readyKey)
+		delayed = pipe.ZCard(ctx, q.delayedKey)
+		processing = pipe.LLen(ctx, q.processingKey)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count the queued deliveries: %w", err)
+	}
+	return int(ready.Val() + delayed.Val() + processing.Val()), nil
+}
+
+// Ping reports whether redis answers, for the readiness check
+func (q *RedisWebhookQueue) Ping(ctx context.Context) error {
+	return q.client.Ping(ctx).Err()
+}
+
+func (q *RedisWebhookQueue) Close() error {
+	return q.client.Close()
+}
+
+// helper functions
+
+// finish updates the stored delivery and takes it off the processing list
+// and its lease in one transaction, along with whatever queue the delivery
+// moves on to. The lease is checked under WATCH, so a delivery leased out
+// again in between is never finished by the worker that lost it
+func (q *RedisWebhookQueue) finish(leased models.WebhookDelivery, apply func(delivery *models.WebhookDelivery), next func(ctx context.Context, pipe redis.Pipeliner)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	id := leased.Id
+	update := func(tx *redis.Tx) error {
+		// read on the watching connection, one from the pool per finish
+		// would run it dry while the watches hold theirs
+		delivery, ok, err := q.load(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("delivery %s not found", id)
+		}
+		now := time.Now()
+		if !holdsLease(&delivery, leased, now) {
+			return fmt.Errorf("delivery %s: %w", id, ErrLeaseExpired)
+		}
+
+		apply(&delivery)
+		delivery.LeaseId = ""
+		delivery.UpdatedAt = now
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			err := q.save(ctx, pipe, delivery)
+			if err != nil {
+				return err
+			}
+			pipe.LRem(ctx, q.processingKey, 1, id)
+			pipe.ZRem(ctx, q.leasesKey, id)
+			if next != nil {
+				next(ctx, pipe)
+			}
+			return nil
+		})
+		return err
+	}
+
+	// the hash holds every delivery, a write to any other one in between
+	// fails the transaction too and it is tried again after a random pause,
+	// so the finishes that collided don't collide again
+	var err error
+	for attempt := range maxFinishAttempts {
+		err = q.client.Watch(ctx, update, q.deliveriesKey)
+		if !stderrors.Is(err, redis.TxFailedErr) {
+			break
+		}
+		time.Sleep(rand.N(time.Duration(attempt+1) * finishRetryPause))
+	}
+	if err != nil {
+		if stderrors.Is(err, ErrLeaseExpired) {
+			return err
+		}
+		return fmt.Errorf("failed to update delivery %s: %w", id, err)
+	}
+	return nil
+}
+
+func (q *RedisWebhookQueue) load(ctx context.Context, client redis.Cmdable, id string) (models.WebhookDelivery, bool, error) {
+	encoded, err := client.HGet(ctx, q.deliveriesKey, id).Bytes()
+	if stderrors.Is(err, redis.Nil) {
+		return models.WebhookDelivery{}, false, nil
+	}
+	if err != nil {
+		return models.WebhookDelivery{}, false, fmt.Errorf("failed to load delivery %s: %w", id, err)
+	}
+
+	var delivery models.WebhookDelivery
+	err = json.Unmarshal(encoded, &delivery)
+	if err != nil {
+		return models.WebhookDelivery{}, false, fmt.Errorf("failed to decode delivery %s: %w", id, err)
+	}
+	return delivery, true, nil
+}
+
+func (q *RedisWebhookQueue) save(ctx context.Context, client redis.Cmdable, delivery models.WebhookDelivery) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return client.HSet(ctx, q.deliveriesKey, delivery.Id, encoded).Err()
+}
+
+// requeueProcessing moves the IDs on the processing list without a lease
+// back onto the end of the ready list Dequeue takes from, so they go out
+// first. The leased ones may belong to another instance still delivering them
+func (q *RedisWebhookQueue) requeueProcessing(ctx context.Context) (int, error) {
+	requeued, err := requeueUnleased.Run(ctx, q.client, []string{q.processingKey, q.readyKey, q.leasesKey}).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue the interrupted deliveries: %w", err)
+	}
+	return requeued, nil
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/sash2721/Relay/models"
+)
+
+func TestRedisQueueAckAfterLeaseExpiry(t *testing.T) {
+	testAckAfterLeaseExpiry(t, newTestRedisQueue(t, miniredis.RunT(t)))
+}
+
+func TestRedisQueueStaleLeaseCannotFinish(t *testing.T) {
+	testStaleLeaseCannotFinish(t, newTestRedisQueue(t, miniredis.RunT(t)))
+}
+
+func TestRedisQueueDeadLettersAfterExpiredLeases(t *testing.T) {
+	testDeadLettersAfterExpiredLeases(t, newTestRedisQueue(t, miniredis.RunT(t)))
+}
+
+func TestRedisQueueRecoversAfterRestart(t *testing.T) {
+	server := miniredis.RunT(t)
+	crashed := newTestRedisQueue(t, server)
+	for _, id := range []string{"taken", "leased", "waiting"} {
+		enqueueTestDelivery(t, crashed, id)
+	}
+
+	// the run that stopped took "taken" off the ready list without leasing
+	// it, and was still delivering "leased"
+	leased := dequeueWithin(t, crashed, time.Second)
+	if leased.Id != "taken" {
+		t.Fatalf("dequeued %s first, want the oldest", leased.Id)
+	}
+	leased = dequeueWithin(t, crashed, time.Second)
+	_, err := crashed.client.ZRem(context.Background(), crashed.leasesKey, "taken").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestRedisQueue(t, server)
+	if depth, err := restarted.Depth(); err != nil || depth != 3 {
+		t.Fatalf("Depth after the restart = %d, %v, want all 3", depth, err)
+	}
+
+	// the unleased one is requeued at the front, the leased one stays with
+	// its lease until it runs out
+	first := dequeueWithin(t, restarted, time.Second)
+	if first.Id != "taken" {
+		t.Fatalf("first after the restart = %s, want the requeued taken", first.Id)
+	}
+	second := dequeueWithin(t, restarted, time.Second)
+	if second.Id != "waiting" {
+		t.Fatalf("second after the restart = %s, want waiting while leased still holds its lease", second.Id)
+	}
+	for _, delivery := range []models.WebhookDelivery{first, second} {
+		if err := restarted.Ack(delivery); err != nil {
+			t.Fatalf("Ack %s: %v", delivery.Id, err)
+		}
+	}
+
+	recovered := dequeueWithin(t, restarted, testVisibilityTimeout+time.Second)
+	if recovered.Id != leased.Id || recovered.Attempts != leased.Attempts+1 {
+		t.Fatalf("recovered %s with Attempts %d, want %s with %d", recovered.Id, recovered.Attempts, leased.Id, leased.Attempts+1)
+	}
+	if err := crashed.Ack(leased); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("Ack from the stopped run = %v, want ErrLeaseExpired", err)
+	}
+
+	if err := restarted.Ack(recovered); err != nil {
+		t.Errorf("Ack %s: %v", recovered.Id, err)
+	}
+	if depth, err := restarted.Depth(); err != nil || depth != 0 {
+		t.Errorf("Depth = %d, %v after every Ack, want 0", depth, err)
+	}
+}
+
+func TestRedisQueueFinishesConcurrently(t *testing.T) {
+	q := newTestRedisQueue(t, miniredis.RunT(t))
+	q.visibilityTimeout = time.Minute
+	const deliveries = 20
+	for i := range deliveries {
+		enqueueTestDelivery(t, q, fmt.Sprintf("delivery-%d", i))
+	}
+	leased := make([]models.WebhookDelivery, deliveries)
+	for i := range leased {
+		leased[i] = dequeueWithin(t, q, time.Second)
+	}
+
+	// every finish writes the one deliveries hash, the ones losing their
+	// WATCH to another try again
+	var wg sync.WaitGroup
+	errs := make(chan error, deliveries)
+	for i, delivery := range leased {
+		wg.Go(func() {
+			if i%2 == 0 {
+				errs <- q.Ack(delivery)
+				return
+			}
+			errs <- q.Nack(delivery, time.Now().Add(time.Hour))
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("finish: %v", err)
+		}
+	}
+
+	for i, delivery := range leased {
+		stored, _ := q.Get(delivery.Id)
+		want := models.DeliveryStatusDelivered
+		if i%2 == 1 {
+			want = models.DeliveryStatusPending
+		}
+		if stored.Status != want || stored.LeaseId != "" {
+			t.Errorf("%s is %q with lease %q, want %q without one", delivery.Id, stored.Status, stored.LeaseId, want)
+		}
+	}
+	if depth, err := q.Depth(); err != nil || depth != deliveries/2 {
+		t.Errorf("Depth = %d, %v, want the %d nacked ones", depth, err, deliveries/2)
+	}
+}
+
+// helper functions
+
+func newTestRedisQueue(t *testing.T, server *miniredis.Miniredis) *RedisWebhookQueue {
+	t.Helper()
+	q, err := NewRedisWebhookQueue(context.Background(), "redis://"+server.Addr(), testVisibilityTimeout)
+	if err != nil {
+		t.Fatalf("NewRedisWebhookQueue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sash2721/Relay/models"
+)
+
+// ErrLeaseExpired is returned for a delivery finished after its visibility
+// timeout, it went back on the queue and will be delivered again
+var ErrLeaseExpired = stderrors.New("delivery lease expired")
+
+// the LastError of a delivery whose lease ran out before it was finished
+const leaseExpiredError = "visibility timeout expired before the delivery was acknowledged"
+
+// Queue is what a queue backend implements, QUEUE_BACKEND picks between the
+// in-memory one and RedisWebhookQueue. A dequeued delivery is leased for the
+// visibility timeout, one still unfinished when the lease runs out becomes
+// visible again with the lost attempt counted
+type Queue interface {
+	Enqueue(delivery models.WebhookDelivery) error
+	// Dequeue blocks until a delivery is due or ctx is done
+	Dequeue(ctx context.Context) (models.WebhookDelivery, error)
+	// Ack marks the delivery as delivered, ErrLeaseExpired once its lease ran out
+	Ack(delivery models.WebhookDelivery) error
+	// Nack puts the delivery back to be retried at retryAt
+	Nack(delivery models.WebhookDelivery, retryAt time.Time) error
+}
+
+// WebhookQueue holds deliveries until the worker picks them up, on top of
+// Queue it parks dead deliveries and looks them up for the status API
+type WebhookQueue interface {
+	Queue
+	// DeadLetter parks a delivery that ran out of attempts
+	DeadLetter(delivery models.WebhookDelivery) error
+	Get(id string) (models.WebhookDelivery, bool)
+	// Depth counts the deliveries waiting or being delivered
+	Depth() (int, error)
+}
+
+type MemoryWebhookQueue struct {
+	mu         sync.Mutex
+	deliveries map[string]*models.WebhookDelivery
+	// deliveries neither delivered nor dead
+	open              int
+	notify            chan struct{}
+	visibilityTimeout time.Duration
+}
+
+// NewMemoryWebhookQueue leases every dequeued delivery for visibilityTimeout
+func NewMemoryWebhookQueue(visibilityTimeout time.Duration) *MemoryWebhookQueue {
+	return &MemoryWebhookQueue{
+		deliveries:        make(map[string]*models.WebhookDelivery),
+		notify:            make(chan struct{}, 1),
+		visibilityTimeout: visibilityTimeout,
+	}
+}
+
+func (q *MemoryWebhookQueue) Enqueue(delivery models.WebhookDelivery) error {
+	q.mu.Lock()
+	if stored, ok := q.deliveries[delivery.Id]; !ok || isFinished(stored.Status) {
+		q.open++
+	}
+	delivery.Status = models.DeliveryStatusPending
+	q.deliveries[delivery.Id] = &delivery
+	q.mu.Unlock()
+
+	q.wake()
+	return nil
+}
+
+func (q *MemoryWebhookQueue) Dequeue(ctx context.Context) (models.WebhookDelivery, error) {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		wait := time.Minute
+		var next *models.WebhookDelivery
+		for _, delivery := range q.deliveries {
+			if delivery.Status == models.DeliveryStatusDelivering {
+				if delivery.LeaseExpiresAt.After(now) {
+					wait = min(wait, delivery.LeaseExpiresAt.Sub(now))
+					continue
+				}
+				expireLease(delivery, now)
+			}
+			if delivery.Status != models.DeliveryStatusPending {
+				continue
+			}
+			if next == nil || delivery.NextAttemptAt.Before(next.NextAttemptAt) {
+				next = delivery
+			}
+		}
+
+		if next != nil && !next.NextAttemptAt.After(now) {
+			next.Status = models.DeliveryStatusDelivering
+			next.UpdatedAt = now
+			next.LeaseId = uuid.NewString()
+			next.LeaseExpiresAt = now.Add(q.visibilityTimeout)
+			delivery := *next
+			q.mu.Unlock()
+			return delivery, nil
+		}
+
+		// sleep until the earliest retry is due, a lease runs out or something
+		// new arrives
+		if next != nil {
+			wait = min(wait, next.NextAttemptAt.Sub(now))
+		}
+		q.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return models.WebhookDelivery{}, ctx.Err()
+		case <-q.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (q *MemoryWebhookQueue) Ack(delivery models.WebhookDelivery) error {
+	return q.finish(delivery, func(stored *models.WebhookDelivery) {
+		q.finishLocked(stored)
+		stored.Status = models.DeliveryStatusDelivered
+		stored.Attempts = delivery.Attempts
+		stored.LastError = ""
+	})
+}
+
+func (q *MemoryWebhookQueue) Nack(delivery models.WebhookDelivery, retryAt time.Time) error {
+	err := q.finish(delivery, func(stored *models.WebhookDelivery) {
+		stored.Status = models.DeliveryStatusPending
+		stored.Attempts = delivery.Attempts
+		stored.LastError = delivery.LastError
+		stored.NextAttemptAt = retryAt
+	})
+	q.wake()
+	return err
+}
+
+func (q *MemoryWebhookQueue) DeadLetter(delivery models.WebhookDelivery) error {
+	return q.finish(delivery, func(stored *models.WebhookDelivery) {
+		q.finishLocked(stored)
+		stored.Status = models.DeliveryStatusDead
+		stored.Attempts = delivery.Attempts
+		stored.LastError = delivery.LastError
+	})
+}
+
+func (q *MemoryWebhookQueue) Get(id string) (models.WebhookDelivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delivery, ok := q.deliveries[id]
+	if !ok {
+		return models.WebhookDelivery{}, false
+	}
+	return *delivery, true
+}
+
+func (q *MemoryWebhookQueue) Depth() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.open, nil
+}
+
+// helper functions
+func (q *MemoryWebhookQueue) finishLocked(delivery *models.WebhookDelivery) {
+	if !isFinished(delivery.Status) {
+		q.open--
+	}
+}
+
+func isFinished(status string) bool {
+	return status == models.DeliveryStatusDelivered || status == models.DeliveryStatusDead
+}
+
+// finish applies the outcome of the delivery's lease, ErrLeaseExpired when
+// the lease ran out or another Dequeue holds the delivery by now
+func (q *MemoryWebhookQueue) finish(delivery models.WebhookDelivery, apply func(stored *models.WebhookDelivery)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stored, ok := q.deliveries[delivery.Id]
+	if !ok {
+		return fmt.Errorf("delivery %s not found", delivery.Id)
+	}
+	now := time.Now()
+	if !holdsLease(stored, delivery, now) {
+		return fmt.Errorf("delivery %s: %w", delivery.Id, ErrLeaseExpired)
+	}
+
+	apply(stored)
+	stored.LeaseId = ""
+	stored.UpdatedAt = now
+	return nil
+}
+
+// holdsLease reports whether delivery still holds the live lease of stored
+func holdsLease(stored *models.WebhookDelivery, delivery models.WebhookDelivery, now time.Time) bool {
+	return stored.Status == models.DeliveryStatusDelivering &&
+		stored.LeaseId == delivery.LeaseId &&
+		now.Before(stored.LeaseExpiresAt)
+}
+
+// expireLease makes a delivery whose lease ran out visible again, the attempt
+// it was on counts as a failed one
+func expireLease(delivery *models.WebhookDelivery, now time.Time) {
+	delivery.Status = models.DeliveryStatusPending
+	delivery.Attempts++
+	delivery.LastError = leaseExpiredError
+	delivery.LeaseId = ""
+	delivery.NextAttemptAt = now
+	delivery.UpdatedAt = now
+}
+
+func (q *MemoryWebhookQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sash2721/Relay/models"
+)
+
+// every lease in these tests runs out this quickly
+const testVisibilityTimeout = 100 * time.Millisecond
+
+func TestMemoryQueueAckAfterLeaseExpiry(t *testing.T) {
+	testAckAfterLeaseExpiry(t, NewMemoryWebhookQueue(testVisibilityTimeout))
+}
+
+func TestMemoryQueueStaleLeaseCannotFinish(t *testing.T) {
+	testStaleLeaseCannotFinish(t, NewMemoryWebhookQueue(testVisibilityTimeout))
+}
+
+func TestMemoryQueueDeadLettersAfterExpiredLeases(t *testing.T) {
+	testDeadLettersAfterExpiredLeases(t, NewMemoryWebhookQueue(testVisibilityTimeout))
+}
+
+func TestMemoryQueueNackRetriesAtRetryAt(t *testing.T) {
+	q := NewMemoryWebhookQueue(time.Minute)
+	enqueueTestDelivery(t, q, "delivery-1")
+
+	leased := dequeueWithin(t, q, time.Second)
+	leased.Attempts++
+	leased.LastError = "destination responded with status 500"
+	err := q.Nack(leased, time.Now().Add(testVisibilityTimeout))
+	if err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+
+	// not before retryAt
+	ctx, cancel := context.WithTimeout(context.Background(), testVisibilityTimeout/2)
+	defer cancel()
+	if _, err := q.Dequeue(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue before retryAt = %v, want it to wait", err)
+	}
+
+	retried := dequeueWithin(t, q, time.Second)
+	if retried.Attempts != 1 || retried.LastError != leased.LastError {
+		t.Errorf("retry has Attempts %d and LastError %q, want the nacked 1 and %q", retried.Attempts, retried.LastError, leased.LastError)
+	}
+	if depth, _ := q.Depth(); depth != 1 {
+		t.Errorf("Depth = %d while the retry is delivering, want 1", depth)
+	}
+
+	if err := q.Ack(retried); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if depth, _ := q.Depth(); depth != 0 {
+		t.Errorf("Depth = %d after the Ack, want 0", depth)
+	}
+}
+
+// helper functions
+
+// testAckAfterLeaseExpiry holds a delivery past its visibility timeout, the
+// late Ack is rejected and the redelivery counts the lost attempt
+func testAckAfterLeaseExpiry(t *testing.T, q WebhookQueue) {
+	t.Helper()
+	enqueueTestDelivery(t, q, "delivery-1")
+
+	leased := dequeueWithin(t, q, time.Second)
+	if leased.Status != models.DeliveryStatusDelivering || leased.LeaseId == "" {
+		t.Fatalf("dequeued with status %q and lease %q, want a leased delivering one", leased.Status, leased.LeaseId)
+	}
+	time.Sleep(testVisibilityTimeout + 50*time.Millisecond)
+
+	err := q.Ack(leased)
+	if !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("Ack after the visibility timeout = %v, want ErrLeaseExpired", err)
+	}
+	if stored, _ := q.Get(leased.Id); stored.Status == models.DeliveryStatusDelivered {
+		t.Fatal("the late Ack marked the delivery delivered")
+	}
+
+	redelivered := dequeueWithin(t, q, time.Second)
+	if redelivered.Id != leased.Id {
+		t.Fatalf("redelivered %s, want %s", redelivered.Id, leased.Id)
+	}
+	if redelivered.Attempts != leased.Attempts+1 {
+		t.Errorf("redelivery Attempts = %d, want %d", redelivered.Attempts, leased.Attempts+1)
+	}
+	if redelivered.LastError != leaseExpiredError {
+		t.Errorf("redelivery LastError = %q, want %q", redelivered.LastError, leaseExpiredError)
+	}
+	if redelivered.LeaseId == leased.LeaseId {
+		t.Error("the redelivery kept the expired lease")
+	}
+
+	if err := q.Ack(redelivered); err != nil {
+		t.Fatalf("Ack within the new lease: %v", err)
+	}
+	if stored, _ := q.Get(leased.Id); stored.Status != models.DeliveryStatusDelivered {
+		t.Errorf("status = %q after the Ack, want %q", stored.Status, models.DeliveryStatusDelivered)
+	}
+}
+
+// testStaleLeaseCannotFinish lets a lease run out and the delivery go to
+// another worker, the first worker can neither Nack nor dead-letter it
+func testStaleLeaseCannotFinish(t *testing.T, q WebhookQueue) {
+	t.Helper()
+	enqueueTestDelivery(t, q, "delivery-1")
+
+	stale := dequeueWithin(t, q, time.Second)
+	time.Sleep(testVisibilityTimeout + 50*time.Millisecond)
+	current := dequeueWithin(t, q, time.Second)
+
+	stale.Attempts++
+	stale.LastError = "destination responded with status 500"
+	err := q.Nack(stale, time.Now())
+	if !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("Nack with the stale lease = %v, want ErrLeaseExpired", err)
+	}
+	err = q.DeadLetter(stale)
+	if !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("DeadLetter with the stale lease = %v, want ErrLeaseExpired", err)
+	}
+
+	stored, _ := q.Get(current.Id)
+	if stored.Status != models.DeliveryStatusDelivering || stored.LeaseId != current.LeaseId {
+		t.Fatalf("after the stale finish the delivery is %q with lease %q, want it still leased to %q", stored.Status, stored.LeaseId, current.LeaseId)
+	}
+	if err := q.Ack(current); err != nil {
+		t.Errorf("Ack with the current lease: %v", err)
+	}
+}
+
+// testDeadLettersAfterExpiredLeases loses every lease until the attempts run
+// out, the worker then dead-letters the delivery instead of sending it again
+func testDeadLettersAfterExpiredLeases(t *testing.T, q WebhookQueue) {
+	t.Helper()
+	const maxAttempts = 2
+	service := NewWebhookService(q, maxAttempts, time.Millisecond, time.Second)
+	enqueueTestDelivery(t, q, "delivery-1")
+
+	for attempt := range maxAttempts {
+		leased := dequeueWithin(t, q, time.Second)
+		if leased.Attempts != attempt {
+			t.Fatalf("lease %d has Attempts %d, want %d", attempt+1, leased.Attempts, attempt)
+		}
+		// the worker holding it stalls past the visibility timeout
+		time.Sleep(testVisibilityTimeout + 50*time.Millisecond)
+	}
+
+	last := dequeueWithin(t, q, time.Second)
+	if last.Attempts != maxAttempts {
+		t.Fatalf("the last lease has Attempts %d, want %d", last.Attempts, maxAttempts)
+	}
+	// the target is never called, there is no attempt left
+	last.TargetURL = "http://127.0.0.1:0/unreachable"
+	service.deliver(context.Background(), last)
+
+	stored, _ := q.Get(last.Id)
+	if stored.Status != models.DeliveryStatusDead {
+		t.Fatalf("status = %q, want %q", stored.Status, models.DeliveryStatusDead)
+	}
+	if stored.Attempts != maxAttempts || stored.LastError != leaseExpiredError {
+		t.Errorf("dead delivery has Attempts %d and LastError %q, want %d and %q", stored.Attempts, stored.LastError, maxAttempts, leaseExpiredError)
+	}
+	if depth, err := q.Depth(); err != nil || depth != 0 {
+		t.Errorf("Depth = %d, %v after the dead-letter, want 0", depth, err)
+	}
+}
+
+func enqueueTestDelivery(t *testing.T, q WebhookQueue, id string) {
+	t.Helper()
+	err := q.Enqueue(models.WebhookDelivery{
+		Id:            id,
+		TargetURL:     "http://127.0.0.1:0/hook",
+		Payload:       []byte(`{"event":"deployed"}`),
+		NextAttemptAt: time.Now(),
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+}
+
+func dequeueWithin(t *testing.T, q WebhookQueue, timeout time.Duration) models.WebhookDelivery {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	delivery, err := q.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	return delivery
+}
@@ -0,0 +1,253 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sash2721/Relay/errors"
+	"github.com/sash2721/Relay/models"
+)
+
+const maxWebhookBackoff = 10 * time.Minute
+
+// a queue that fails this many dequeues in a row, dequeueRetryDelay apart,
+// is taken as broken for good
+const (
+	maxDequeueFailures = 5
+	dequeueRetryDelay  = time.Second
+)
+
+type WebhookService struct {
+	Queue       WebhookQueue
+	Client      *http.Client
+	MaxAttempts int
+	BaseBackoff time.Duration
+}
+
+func NewWebhookService(queue WebhookQueue, maxAttempts int, baseBackoff time.Duration, deliveryTimeout time.Duration) *WebhookService {
+	return &WebhookService{
+		Queue:       queue,
+		Client:      &http.Client{Timeout: deliveryTimeout},
+		MaxAttempts: maxAttempts,
+		BaseBackoff: baseBackoff,
+	}
+}
+
+func (s *WebhookService) EnqueueWebhook(targetURL string, payload json.RawMessage) ([]byte, error, []byte, int) {
+	if !isValidWebhookTarget(targetURL) {
+		slog.Warn("Invalid webhook target URL")
+		errJsonData, badRequestError := errors.NewBadRequestError("targetUrl must be a valid http or https URL", nil)
+		return nil, badRequestError, errJsonData, badRequestError.Code
+	}
+
+	if len(payload) == 0 || !json.Valid(payload) {
+		errJsonData, badRequestError := errors.NewBadRequestError("payload must be valid JSON", nil)
+		return nil, badRequestError, errJsonData, badRequestError.Code
+	}
+
+	now := time.Now()
+	delivery := models.WebhookDelivery{
+		Id:            uuid.NewString(),
+		TargetURL:     targetURL,
+		Payload:       payload,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	err := s.Queue.Enqueue(delivery)
+	if err != nil {
+		slog.Error("Failed to enqueue the webhook delivery", slog.Any("Error", err))
+		errJsonData, internalServerError := errors.NewInternalServerError("Failed to enqueue the webhook delivery", err)
+		return nil, internalServerError, errJsonData, internalServerError.Code
+	}
+
+	slog.Info("Webhook delivery enqueued", slog.String("DeliveryID", delivery.Id))
+
+	return serializeResponse(models.WebhookAcceptedResponse{
+		Id:     delivery.Id,
+		Status: models.DeliveryStatusPending,
+	}, http.StatusAccepted)
+}
+
+func (s *WebhookService) GetDelivery(deliveryID string) ([]byte, error, []byte, int) {
+	delivery, ok := s.Queue.Get(deliveryID)
+	if !ok {
+		errJsonData, notFoundError := errors.NewNotFoundError("Webhook delivery not found", nil)
+		return nil, notFoundError, errJsonData, notFoundError.Code
+	}
+
+	return serializeResponse(models.WebhookDeliveryResponse{
+		Id:            delivery.Id,
+		TargetURL:     delivery.TargetURL,
+		Status:        delivery.Status,
+		Attempts:      delivery.Attempts,
+		LastError:     delivery.LastError,
+		NextAttemptAt: delivery.NextAttemptAt,
+		CreatedAt:     delivery.CreatedAt,
+		UpdatedAt:     delivery.UpdatedAt,
+	}, http.StatusOK)
+}
+
+// StartWorker stops taking deliveries once ctx is done, the delivery in
+// progress then still gets until the end of the drain window of workers.
+// A queue that keeps failing is reported on fatal and the worker stops
+func (s *WebhookService) StartWorker(ctx context.Context, workers *WorkerGroup, fatal chan<- error) {
+	workers.Go("webhook-delivery", func(drainCtx context.Context) {
+		failures := 0
+		for {
+			delivery, err := s.Queue.Dequeue(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failures++
+				slog.Error("Failed to dequeue a webhook delivery",
+					slog.Any("Error", err),
+					slog.Int("Failures", failures),
+				)
+				if failures >= maxDequeueFailures {
+					ReportFatal(fatal, "webhook-delivery", fmt.Errorf("webhook queue failed %d dequeues in a row: %w", failures, err))
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(dequeueRetryDelay):
+				}
+				continue
+			}
+			failures = 0
+
+			s.deliver(drainCtx, delivery)
+		}
+	})
+	slog.Info("Webhook delivery worker started")
+}
+
+// helper functions
+
+// deliver sends the delivery within its lease, the send is cut off when the
+// lease runs out since the delivery is visible to the other workers again
+func (s *WebhookService) deliver(ctx context.Context, delivery models.WebhookDelivery) {
+	// every attempt went to a lease that ran out, there is none left to try
+	if delivery.Attempts >= s.MaxAttempts {
+		s.deadLetter(delivery)
+		return
+	}
+	delivery.Attempts++
+
+	leaseCtx, cancel := context.WithDeadline(ctx, delivery.LeaseExpiresAt)
+	defer cancel()
+
+	err := s.send(leaseCtx, delivery)
+	if err == nil {
+		err = s.Queue.Ack(delivery)
+		if stderrors.Is(err, ErrLeaseExpired) {
+			slog.Warn("Webhook delivered after its visibility timeout, it will be delivered again",
+				slog.String("DeliveryID", delivery.Id),
+				slog.Int("Attempts", delivery.Attempts),
+			)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to acknowledge the webhook delivery",
+				slog.String("DeliveryID", delivery.Id),
+				slog.Any("Error", err),
+			)
+			return
+		}
+		slog.Info("Webhook delivered",
+			slog.String("DeliveryID", delivery.Id),
+			slog.Int("Attempts", delivery.Attempts),
+		)
+		return
+	}
+
+	delivery.LastError = err.Error()
+
+	if delivery.Attempts >= s.MaxAttempts {
+		s.deadLetter(delivery)
+		return
+	}
+
+	retryAt := time.Now().Add(webhookBackoff(s.BaseBackoff, delivery.Attempts))
+	err = s.Queue.Nack(delivery, retryAt)
+	if err != nil {
+		slog.Warn("Failed to requeue the failed webhook delivery",
+			slog.String("DeliveryID", delivery.Id),
+			slog.Any("Error", err),
+		)
+		return
+	}
+	slog.Warn("Webhook delivery failed, retrying later",
+		slog.String("DeliveryID", delivery.Id),
+		slog.Int("Attempts", delivery.Attempts),
+		slog.Time("RetryAt", retryAt),
+		slog.String("Error", delivery.LastError),
+	)
+}
+
+func (s *WebhookService) deadLetter(delivery models.WebhookDelivery) {
+	err := s.Queue.DeadLetter(delivery)
+	if err != nil {
+		slog.Warn("Failed to dead-letter the webhook delivery",
+			slog.String("DeliveryID", delivery.Id),
+			slog.Any("Error", err),
+		)
+		return
+	}
+	slog.Error("Webhook delivery exhausted its attempts, moved to dead-letter",
+		slog.String("DeliveryID", delivery.Id),
+		slog.Int("Attempts", delivery.Attempts),
+		slog.String("Error", delivery.LastError),
+	)
+}
+
+func (s *WebhookService) send(ctx context.Context, delivery models.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.TargetURL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Relay-Delivery-ID", delivery.Id)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("destination responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	delay := base << (attempts - 1)
+	if delay <= 0 || delay > maxWebhookBackoff {
+		return maxWebhookBackoff
+	}
+	return delay
+}
+
+func isValidWebhookTarget(targetURL string) bool {
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
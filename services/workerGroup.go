@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// WorkerGroup tracks the background workers so shutdown can wait for the job
+// each one is in the middle of
+type WorkerGroup struct {
+	wg          sync.WaitGroup
+	drainCtx    context.Context
+	cancelDrain context.CancelFunc
+}
+
+func NewWorkerGroup() *WorkerGroup {
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	return &WorkerGroup{
+		drainCtx:    drainCtx,
+		cancelDrain: cancelDrain,
+	}
+}
+
+// Go runs worker in its own goroutine, the context passed to it is for the
+// job in progress and is only cancelled once the drain window is over
+func (g *WorkerGroup) Go(name string, worker func(drainCtx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		worker(g.drainCtx)
+		slog.Info("Background worker stopped", slog.String("Worker", name))
+	}()
+}
+
+// Wait blocks until every worker returned, when ctx ends first the jobs still
+// running are cancelled and ctx.Err() is returned
+func (g *WorkerGroup) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		g.cancelDrain()
+		return nil
+	case <-ctx.Done():
+		g.cancelDrain()
+		<-done
+		return ctx.Err()
+	}
+}